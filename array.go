@@ -2,6 +2,8 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"reflect"
 )
@@ -29,11 +31,17 @@ func matchArray1(R Ruler, in *bufio.Reader, ctx *Context, fCheckNil bool) (v int
 				}
 				return ret.Interface(), nil
 			}
-			return
+			return nil, partialSlice(err, ret)
 		}
-		v, err = R.Match(in, ctx.NewSub())
+		if err = ctx.repeated(ret.Len() + 1); err != nil {
+			return nil, partialSlice(err, ret)
+		}
+		sub := ctx.newElem(ret.Len())
+		v, err = R.Match(in, sub)
+		sub.endSpan()
 		if err != nil {
-			return
+			err = matchError(err, indexOf(ret.Len()), in, ctx)
+			return nil, partialSlice(err, ret)
 		}
 		ret = reflect.Append(ret, valueOf(v, t))
 		fCheckNil = false
@@ -46,18 +54,36 @@ func matchArray(R Ruler, n int, in *bufio.Reader, ctx *Context) (v interface{},
 		return
 	}
 
+	if err = ctx.repeated(n); err != nil {
+		return
+	}
 	t := R.RetType()
+	if err = ctx.allocn(n, int(t.Size())); err != nil {
+		return
+	}
 	ret := reflect.MakeSlice(reflect.SliceOf(t), 0, n)
 	for i := 0; i < n; i++ {
-		v, err = R.Match(in, ctx.NewSub())
+		sub := ctx.newElem(i)
+		v, err = R.Match(in, sub)
+		sub.endSpan()
 		if err != nil {
-			return
+			err = matchError(err, indexOf(i), in, ctx)
+			return nil, partialSlice(err, ret)
 		}
 		ret = reflect.Append(ret, valueOf(v, t))
 	}
 	return ret.Interface(), nil
 }
 
+func encodeArrayN(R, r Ruler, n int, w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	m, err := encodeArray(r, w, dom, ctx)
+	if err == nil && n >= 0 && m != n {
+		err = &EncodeError{R: R, Dom: dom, Msg: fmt.Sprintf("len(value) != %d", n)}
+	}
+	return err
+}
+
 // -----------------------------------------------------------------------------
 
 type array1 struct {
@@ -66,9 +92,21 @@ type array1 struct {
 
 func (p *array1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	if s := ctx.streaming(in); s != nil {
+		return nil, matchRecords(s, p.r, in, ctx, 1)
+	}
 	return matchArray1(p.r, in, ctx, true)
 }
 
+func (p *array1) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	n, err := encodeArray(p.r, w, dom, ctx)
+	if err == nil && n == 0 {
+		err = &EncodeError{R: p, Dom: dom, Msg: "R+ requires at least one element"}
+	}
+	return err
+}
+
 func (p *array1) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
@@ -97,9 +135,17 @@ type array0 struct {
 
 func (p *array0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	if s := ctx.streaming(in); s != nil {
+		return nil, matchRecords(s, p.r, in, ctx, 0)
+	}
 	return matchArray1(p.r, in, ctx, false)
 }
 
+func (p *array0) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeArrayN(p, p.r, -1, w, dom, ctx)
+}
+
 func (p *array0) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
@@ -140,6 +186,11 @@ func (p *array) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error)
 	return matchArray(p.r, n, in, ctx)
 }
 
+func (p *array) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeArrayN(p, p.r, p.n, w, dom, ctx)
+}
+
 func (p *array) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
@@ -183,6 +234,11 @@ func (p *dynarray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return matchArray(p.r, n, in, ctx)
 }
 
+func (p *dynarray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeArrayN(p, p.r, -1, w, dom, ctx)
+}
+
 func (p *dynarray) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
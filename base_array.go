@@ -2,11 +2,11 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"reflect"
 	"unsafe"
-
-	"github.com/qiniu/x/bufiox"
 )
 
 // -----------------------------------------------------------------------------
@@ -17,9 +17,15 @@ func matchCharArray(n int, in *bufio.Reader, ctx *Context) (v interface{}, err e
 		return "", nil
 	}
 
+	if err = ctx.alloc(n); err != nil {
+		return
+	}
 	b := make([]byte, n)
-	_, err = io.ReadFull(in, b)
+	m, err := io.ReadFull(in, b)
 	if err != nil {
+		if m > 0 {
+			err = withPartial(err, string(b[:m]))
+		}
 		return
 	}
 	return string(b), nil
@@ -31,9 +37,15 @@ func matchByteArray(n int, in *bufio.Reader, ctx *Context) (v interface{}, err e
 		return []byte(nil), nil
 	}
 
+	if err = ctx.alloc(n); err != nil {
+		return
+	}
 	b := make([]byte, n)
-	_, err = io.ReadFull(in, b)
+	m, err := io.ReadFull(in, b)
 	if err != nil {
+		if m > 0 {
+			err = withPartial(err, b[:m])
+		}
 		return
 	}
 	return b, nil
@@ -46,13 +58,84 @@ func matchBaseArray(R BaseType, n int, in *bufio.Reader, ctx *Context) (v interf
 	}
 
 	t := baseTypes[R]
+	if err = ctx.allocn(n, t.sizeOf); err != nil {
+		return
+	}
 	v = t.newn(n)
-	data := (*reflect.SliceHeader)(unsafe.Pointer(reflect.ValueOf(v).UnsafeAddr())).Data
-	b := (*[1 << 30]byte)(unsafe.Pointer(data))
-	_, err = io.ReadFull(in, b[:n*t.sizeOf])
+	b := bytesOf(v, n*t.sizeOf)
+	if _, err = io.ReadFull(in, b); err != nil {
+		return nil, err
+	}
+	order := byteOrderOf(ctx)
+	switch t.sizeOf {
+	case 2:
+		for i := 0; i < len(b); i += 2 {
+			*(*uint16)(unsafe.Pointer(&b[i])) = order.Uint16(b[i:])
+		}
+	case 4:
+		for i := 0; i < len(b); i += 4 {
+			*(*uint32)(unsafe.Pointer(&b[i])) = order.Uint32(b[i:])
+		}
+	case 8:
+		for i := 0; i < len(b); i += 8 {
+			*(*uint64)(unsafe.Pointer(&b[i])) = order.Uint64(b[i:])
+		}
+	}
+	return
+}
+
+// bytesOf returns the memory of slice `v` as a []byte of length `n`, so that
+// an array can be read and decoded in place.
+//
+func bytesOf(v interface{}, n int) (b []byte) {
+
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data = reflect.ValueOf(v).Pointer()
+	h.Len, h.Cap = n, n
 	return
 }
 
+func encodeCharArray(R Ruler, n int, w *bytes.Buffer, dom interface{}) error {
+
+	var s string
+	switch v := dom.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return &EncodeError{R: R, Dom: dom, Msg: "value isn't a string"}
+	}
+	if n >= 0 && len(s) != n {
+		return &EncodeError{R: R, Dom: dom, Msg: fmt.Sprintf("len(value) != %d", n)}
+	}
+	w.WriteString(s)
+	return nil
+}
+
+func encodeByteArray(R Ruler, n int, w *bytes.Buffer, dom interface{}) error {
+
+	b, ok := toBytes(dom)
+	if !ok {
+		return &EncodeError{R: R, Dom: dom, Msg: "value isn't a []byte"}
+	}
+	if n >= 0 && len(b) != n {
+		return &EncodeError{R: R, Dom: dom, Msg: fmt.Sprintf("len(value) != %d", n)}
+	}
+	w.Write(b)
+	return nil
+}
+
+func encodeBaseArray(R BaseType, n int, w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	m, err := encodeArray(R, w, dom, ctx)
+	if err == nil && n >= 0 && m != n {
+		err = &EncodeError{R: R, Dom: dom, Msg: fmt.Sprintf("len(value) != %d", n)}
+	}
+	return err
+}
+
 // -----------------------------------------------------------------------------
 
 type baseArray struct {
@@ -66,6 +149,11 @@ func (p *baseArray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err er
 	return matchBaseArray(p.r, n, in, ctx)
 }
 
+func (p *baseArray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeBaseArray(p.r, p.n, w, dom, ctx)
+}
+
 func (p *baseArray) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
@@ -96,6 +184,11 @@ func (p *baseDynarray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err
 	return matchBaseArray(p.r, n, in, ctx)
 }
 
+func (p *baseDynarray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeBaseArray(p.r, -1, w, dom, ctx)
+}
+
 func (p *baseDynarray) RetType() reflect.Type {
 
 	return reflect.SliceOf(p.r.RetType())
@@ -119,10 +212,15 @@ type byteArray0 int
 
 func (p byteArray0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	v, err = bufiox.ReadAll(in)
+	v, err = ctx.readAll(in)
 	return
 }
 
+func (p byteArray0) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeByteArray(p, -1, w, dom)
+}
+
 func (p byteArray0) RetType() reflect.Type {
 
 	return tyByteSlice
@@ -143,7 +241,7 @@ type byteArray1 int
 
 func (p byteArray1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	ret, err := bufiox.ReadAll(in)
+	ret, err := ctx.readAll(in)
 	if err != nil {
 		return
 	}
@@ -153,6 +251,14 @@ func (p byteArray1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err er
 	return ret, nil
 }
 
+func (p byteArray1) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	if b, _ := toBytes(dom); len(b) == 0 {
+		return &EncodeError{R: p, Dom: dom, Msg: "+byte requires at least one byte"}
+	}
+	return encodeByteArray(p, -1, w, dom)
+}
+
 func (p byteArray1) RetType() reflect.Type {
 
 	return tyByteSlice
@@ -176,6 +282,11 @@ func (p byteArray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return matchByteArray(int(p), in, ctx)
 }
 
+func (p byteArray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeByteArray(p, int(p), w, dom)
+}
+
 func (p byteArray) RetType() reflect.Type {
 
 	return tyByteSlice
@@ -202,6 +313,11 @@ func (p charArray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return matchCharArray(int(p), in, ctx)
 }
 
+func (p charArray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeCharArray(p, int(p), w, dom)
+}
+
 func (p charArray) RetType() reflect.Type {
 
 	return tyString
@@ -229,6 +345,11 @@ func (p byteDynarray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err
 	return matchByteArray(n, in, ctx)
 }
 
+func (p byteDynarray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeByteArray(p, -1, w, dom)
+}
+
 func (p byteDynarray) RetType() reflect.Type {
 
 	return tyByteSlice
@@ -256,6 +377,11 @@ func (p charDynarray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err
 	return matchCharArray(n, in, ctx)
 }
 
+func (p charDynarray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeCharArray(p, -1, w, dom)
+}
+
 func (p charDynarray) RetType() reflect.Type {
 
 	return tyString
@@ -2,8 +2,11 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 	"reflect"
 	"unsafe"
 
@@ -204,12 +207,84 @@ func newFloat64n(n int) interface{} {
 	return make([]float64, n)
 }
 
-// Match is required by a matching unit. see Ruler interface.
+// Match is required by a matching unit. see Ruler interface. It matches in
+// the byte order of `ctx` (see Context.SetByteOrder).
 //
 func (p BaseType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	v, err = baseTypes[p].read(in)
-	return
+	order := byteOrderOf(ctx)
+	if order == binary.LittleEndian {
+		return baseTypes[p].read(in)
+	}
+	u, err := readBits(in, baseTypes[p].sizeOf, order)
+	if err != nil {
+		return
+	}
+	return valueOfBits(reflect.Kind(p), u), nil
+}
+
+// Encode is the counterpart of Match. see Encoder interface.
+//
+func (p BaseType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	val, err := bitsOf(p, reflect.Kind(p), dom)
+	if err != nil {
+		return err
+	}
+	writeBits(w, val, baseTypes[p].sizeOf, byteOrderOf(ctx))
+	return nil
+}
+
+// bitsOf returns the bit pattern of `dom` as a value of type `kind`.
+//
+func bitsOf(r Ruler, kind reflect.Kind, dom interface{}) (uint64, error) {
+
+	switch kind {
+	case reflect.Float32:
+		f, ok := toFloat64(dom)
+		if !ok {
+			return 0, &EncodeError{R: r, Dom: dom, Msg: "value isn't a number"}
+		}
+		return uint64(math.Float32bits(float32(f))), nil
+	case reflect.Float64:
+		f, ok := toFloat64(dom)
+		if !ok {
+			return 0, &EncodeError{R: r, Dom: dom, Msg: "value isn't a number"}
+		}
+		return math.Float64bits(f), nil
+	}
+	u, ok := toUint64(dom)
+	if !ok {
+		return 0, &EncodeError{R: r, Dom: dom, Msg: "value isn't an integer"}
+	}
+	return u, nil
+}
+
+// valueOfBits is the inverse of bitsOf.
+//
+func valueOfBits(kind reflect.Kind, u uint64) interface{} {
+
+	switch kind {
+	case reflect.Int8:
+		return int8(u)
+	case reflect.Int16:
+		return int16(u)
+	case reflect.Int32:
+		return int32(u)
+	case reflect.Int64:
+		return int64(u)
+	case reflect.Uint8:
+		return uint8(u)
+	case reflect.Uint16:
+		return uint16(u)
+	case reflect.Uint32:
+		return uint32(u)
+	case reflect.Float32:
+		return math.Float32frombits(uint32(u))
+	case reflect.Float64:
+		return math.Float64frombits(u)
+	}
+	return u
 }
 
 // RetType returns matching result type.
@@ -226,6 +301,8 @@ func (p BaseType) SizeOf() int {
 	return baseTypes[p].sizeOf
 }
 
+// -----------------------------------------------------------------------------
+
 var (
 	// Int8 is the matching unit for int8
 	Int8 = BaseType(reflect.Int8)
@@ -271,6 +348,17 @@ func (p cstring) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	return string(b[:len(b)-1]), nil
 }
 
+func (p cstring) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	s, ok := dom.(string)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't a string"}
+	}
+	w.WriteString(s)
+	w.WriteByte(0)
+	return nil
+}
+
 func (p cstring) RetType() reflect.Type {
 
 	return tyString
@@ -294,6 +382,15 @@ func (p charType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	return in.ReadByte()
 }
 
+func (p charType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	u, ok := toUint64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't a char"}
+	}
+	return w.WriteByte(byte(u))
+}
+
 func (p charType) RetType() reflect.Type {
 
 	return tyUint8
@@ -328,6 +425,20 @@ func (p *fixedType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err er
 	return val.Interface(), nil
 }
 
+func (p *fixedType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	typ := p.typ
+	v := reflect.ValueOf(dom)
+	if v.Type() != typ {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't a " + typ.String()}
+	}
+	val := reflect.New(typ)
+	val.Elem().Set(v)
+	b := (*[1 << 30]byte)(unsafe.Pointer(val.Pointer()))
+	w.Write(b[:typ.Size()])
+	return nil
+}
+
 func (p *fixedType) RetType() reflect.Type {
 
 	return p.typ
@@ -363,6 +474,18 @@ func (p uintbe) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error)
 	return val, nil
 }
 
+func (p uintbe) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	val, ok := toUint64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+	w.Write(b[8-int(p):])
+	return nil
+}
+
 func (p uintbe) RetType() reflect.Type {
 
 	return tyUint
@@ -402,6 +525,18 @@ func (p uintle) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error)
 	return val, nil
 }
 
+func (p uintle) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	val, ok := toUint64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], val)
+	w.Write(b[:int(p)])
+	return nil
+}
+
 func (p uintle) RetType() reflect.Type {
 
 	return tyUint
@@ -428,6 +563,176 @@ var Uint24 = Uintle(3)
 
 // -----------------------------------------------------------------------------
 
+var (
+	// ErrVarintOverflow is returned when a variable-length integer is too long.
+	ErrVarintOverflow = errors.New("varint overflows")
+)
+
+type varint int
+
+const (
+	vtUvarint varint = iota
+	vtVarint
+	vtZigzag32
+	vtZigzag64
+	vtVLQ
+	vtMQTTLen
+)
+
+func (p varint) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	maxn := 10
+	if p >= vtVLQ {
+		maxn = 4
+	}
+	var val uint64
+	var shift uint
+	for i := 0; ; i++ {
+		if i == maxn {
+			return nil, ErrVarintOverflow
+		}
+		b, err := in.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if p == vtVLQ { // big endian groups
+			val = (val << 7) | uint64(b&0x7f)
+		} else {
+			if i == 9 && !p.lastByteValid(b) {
+				return nil, ErrVarintOverflow
+			}
+			val |= uint64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	switch p {
+	case vtVarint:
+		if shift < 64 && val&(1<<(shift-1)) != 0 { // sign extension
+			val |= ^uint64(0) << shift
+		}
+		return int(int64(val)), nil
+	case vtZigzag32:
+		return int32(uint32(val)>>1) ^ -int32(val&1), nil
+	case vtZigzag64:
+		return int64(val>>1) ^ -int64(val&1), nil
+	}
+	return uint(val), nil
+}
+
+// lastByteValid reports whether `b` is valid as the 10th byte, which holds
+// only bit 63. For signed LEB128, its other bits are the sign extension.
+//
+func (p varint) lastByteValid(b byte) bool {
+
+	if p == vtVarint {
+		return b == 0 || b == 0x7f
+	}
+	return b <= 1
+}
+
+func (p varint) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	var val uint64
+	switch p {
+	case vtVarint, vtZigzag32, vtZigzag64:
+		i, ok := toInt64(dom)
+		if !ok {
+			return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+		}
+		switch p {
+		case vtVarint:
+			for {
+				b := byte(i & 0x7f)
+				i >>= 7
+				if (i == 0 && b&0x40 == 0) || (i == -1 && b&0x40 != 0) {
+					w.WriteByte(b)
+					return nil
+				}
+				w.WriteByte(b | 0x80)
+			}
+		case vtZigzag32:
+			i32 := int32(i)
+			val = uint64(uint32(i32<<1) ^ uint32(i32>>31))
+		default:
+			val = uint64(i<<1) ^ uint64(i>>63)
+		}
+	default:
+		u, ok := toUint64(dom)
+		if !ok {
+			return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+		}
+		val = u
+	}
+	switch p {
+	case vtVLQ:
+		if val >= 1<<28 {
+			return ErrVarintOverflow
+		}
+		var b [4]byte
+		n := 3
+		b[n] = byte(val & 0x7f)
+		for val >>= 7; val != 0; val >>= 7 {
+			n--
+			b[n] = byte(val&0x7f) | 0x80
+		}
+		w.Write(b[n:])
+		return nil
+	case vtMQTTLen:
+		if val >= 1<<28 {
+			return ErrVarintOverflow
+		}
+	}
+	for val >= 0x80 {
+		w.WriteByte(byte(val) | 0x80)
+		val >>= 7
+	}
+	w.WriteByte(byte(val))
+	return nil
+}
+
+func (p varint) RetType() reflect.Type {
+
+	switch p {
+	case vtVarint:
+		return tyInt
+	case vtZigzag32:
+		return tyInt32
+	case vtZigzag64:
+		return tyInt64
+	}
+	return tyUint
+}
+
+func (p varint) SizeOf() int {
+
+	return -1
+}
+
+var (
+	// Uvarint is a matching unit that matches an unsigned LEB128 integer (eg. uint64 of protobuf).
+	Uvarint Ruler = vtUvarint
+
+	// Varint is a matching unit that matches a signed LEB128 integer (eg. sleb128 of DWARF).
+	Varint Ruler = vtVarint
+
+	// Zigzag32 is a matching unit that matches a zigzag encoded LEB128 integer (eg. sint32 of protobuf).
+	Zigzag32 Ruler = vtZigzag32
+
+	// Zigzag64 is a matching unit that matches a zigzag encoded LEB128 integer (eg. sint64 of protobuf).
+	Zigzag64 Ruler = vtZigzag64
+
+	// VLQ is a matching unit that matches a variable-length quantity of MIDI (big endian, up to 4 bytes).
+	VLQ Ruler = vtVLQ
+
+	// MQTTLen is a matching unit that matches a remaining length of MQTT (little endian, up to 4 bytes).
+	MQTTLen Ruler = vtMQTTLen
+)
+
+// -----------------------------------------------------------------------------
+
 func float32frombits(b uint32) float32 { return *(*float32)(unsafe.Pointer(&b)) }
 
 type float32be int
@@ -443,6 +748,18 @@ func (p float32be) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return
 }
 
+func (p float32be) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	f, ok := toFloat64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't a number"}
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+	w.Write(b[:])
+	return nil
+}
+
 func (p float32be) RetType() reflect.Type {
 
 	return tyFloat32
@@ -474,6 +791,18 @@ func (p float64be) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return
 }
 
+func (p float64be) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	f, ok := toFloat64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't a number"}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	w.Write(b[:])
+	return nil
+}
+
 func (p float64be) RetType() reflect.Type {
 
 	return tyFloat64
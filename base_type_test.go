@@ -1,8 +1,10 @@
 package bpl_test
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"math"
 	"reflect"
 	"testing"
 
@@ -78,3 +80,77 @@ func TestUintle(t *testing.T) {
 		t.Fatal("v != 0x030201:", v)
 	}
 }
+
+func TestVarint(t *testing.T) {
+
+	cases := []struct {
+		r bpl.Ruler
+		b []byte
+		v interface{}
+	}{
+		{bpl.Uvarint, []byte{0xe5, 0x8e, 0x26}, uint(624485)},
+		{bpl.Varint, []byte{0xc0, 0xbb, 0x78}, -123456},
+		{bpl.Varint, []byte{0x3f}, 63},
+		{bpl.Zigzag32, []byte{0x03}, int32(-2)},
+		{bpl.Zigzag64, []byte{0xa3, 0x13}, int64(-1234)},
+		{bpl.VLQ, []byte{0x81, 0x80, 0x00}, uint(0x4000)},
+		{bpl.MQTTLen, []byte{0xc1, 0x02}, uint(321)},
+	}
+	for _, c := range cases {
+		v, err := c.r.Match(bufiox.NewReaderBuffer(c.b), nil)
+		if err != nil || v != c.v {
+			t.Fatal("Match:", c.b, v, err)
+		}
+		var w bytes.Buffer
+		err = bpl.Encode(c.r, &w, v, bpl.NewContext())
+		if err != nil || !bytes.Equal(w.Bytes(), c.b) {
+			t.Fatal("Encode:", c.v, w.Bytes(), err)
+		}
+	}
+
+	_, err := bpl.MQTTLen.Match(bufiox.NewReaderBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0x7f}), nil)
+	if err != bpl.ErrVarintOverflow {
+		t.Fatal("MQTTLen.Match:", err)
+	}
+}
+
+func TestVarintLimits(t *testing.T) {
+
+	cases := []struct {
+		r    bpl.Ruler
+		vals []interface{}
+	}{
+		{bpl.Uvarint, []interface{}{uint(0), uint(1), uint(math.MaxInt64), uint(math.MaxUint64)}},
+		{bpl.Varint, []interface{}{0, 1, -1, math.MaxInt64, math.MinInt64}},
+		{bpl.Zigzag32, []interface{}{int32(0), int32(1), int32(-1), int32(math.MaxInt32), int32(math.MinInt32)}},
+		{bpl.Zigzag64, []interface{}{int64(0), int64(1), int64(-1), int64(math.MaxInt64), int64(math.MinInt64)}},
+		{bpl.VLQ, []interface{}{uint(0), uint(1), uint(1<<28 - 1)}},
+		{bpl.MQTTLen, []interface{}{uint(0), uint(1), uint(1<<28 - 1)}},
+	}
+	for _, c := range cases {
+		for _, val := range c.vals {
+			var w bytes.Buffer
+			if err := bpl.Encode(c.r, &w, val, bpl.NewContext()); err != nil {
+				t.Fatal("Encode failed:", val, err)
+			}
+			v, err := c.r.Match(bufiox.NewReaderBuffer(w.Bytes()), nil)
+			if err != nil || v != val {
+				t.Fatal("Match:", w.Bytes(), v, err)
+			}
+		}
+	}
+
+	for _, b := range [][]byte{
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, // bit 63 set, but positive
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7e},
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00},
+	} {
+		if _, err := bpl.Varint.Match(bufiox.NewReaderBuffer(b), nil); err != bpl.ErrVarintOverflow {
+			t.Fatal("Varint.Match:", b, err)
+		}
+	}
+	b := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02}
+	if _, err := bpl.Uvarint.Match(bufiox.NewReaderBuffer(b), nil); err != bpl.ErrVarintOverflow {
+		t.Fatal("Uvarint.Match:", err)
+	}
+}
@@ -0,0 +1,142 @@
+package binary_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/goplus/bpl"
+	"github.com/goplus/bpl/binary"
+)
+
+type ipv4 [4]byte
+
+func (p ipv4) MarshalBinary() ([]byte, error) {
+	return p[:], nil
+}
+
+func (p *ipv4) UnmarshalBinary(b []byte) error {
+	if len(b) != 4 {
+		return errors.New("invalid ipv4")
+	}
+	copy(p[:], b)
+	return nil
+}
+
+type point struct {
+	X, Y int16
+}
+
+type packet struct {
+	Magic  uint32 `bpl:",be"`
+	Flag   bool
+	_      [3]byte
+	Count  uint16
+	Points []point `bpl:",len=Count"`
+	Name   string  `bpl:",size=6"`
+	Addr   ipv4    `bpl:",size=4"`
+	Skip   int     `bpl:"-"`
+	n      uint8
+	Tag    string `bpl:",len=n"`
+	Title  string
+	Rest   []uint16
+}
+
+func TestMarshal(t *testing.T) {
+
+	v := &packet{
+		Magic: 0x01020304, Flag: true, Count: 2, Points: []point{{1, -1}, {2, 3}},
+		Name: "abc", Addr: ipv4{127, 0, 0, 1}, Skip: 9, n: 2, Tag: "hi", Title: "T", Rest: []uint16{5, 256},
+	}
+	b, err := binary.Marshal(v)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	expected := []byte{
+		1, 2, 3, 4, 1, 0, 0, 0, 2, 0, 1, 0, 0xff, 0xff, 2, 0, 3, 0,
+		'a', 'b', 'c', 0, 0, 0, 127, 0, 0, 1, 2, 'h', 'i', 'T', 0, 5, 0, 0, 1,
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatal("Marshal:", b)
+	}
+
+	var ret packet
+	if err = binary.Unmarshal(b, &ret); err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	v.Skip = 0
+	if !reflect.DeepEqual(&ret, v) {
+		t.Fatal("Unmarshal:", ret)
+	}
+
+	v.Count = 3
+	if _, err = binary.Marshal(v); err == nil {
+		t.Fatal("Marshal: no error when len(Points) != Count")
+	}
+	if err = binary.Unmarshal(b[:10], &ret); err == nil {
+		t.Fatal("Unmarshal: no error when input is truncated")
+	}
+	if err = binary.Unmarshal(b, ret); err != binary.ErrNonPointer {
+		t.Fatal("Unmarshal:", err)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+
+	v := struct {
+		A uint16
+		B []int32 `bpl:",le"`
+		C [2]float32
+	}{A: 1, B: []int32{-2}, C: [2]float32{1, 0}}
+	b, err := binary.BigEndian.Marshal(&v)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	if !bytes.Equal(b, []byte{0, 1, 0xfe, 0xff, 0xff, 0xff, 0x3f, 0x80, 0, 0, 0, 0, 0, 0}) {
+		t.Fatal("Marshal:", b)
+	}
+
+	var c [2]float32
+	if err = binary.BigEndian.Unmarshal(b[6:], &c); err != nil || c != v.C {
+		t.Fatal("Unmarshal:", c, err)
+	}
+	var m map[string]int
+	if _, err = binary.Marshal(m); err == nil {
+		t.Fatal("Marshal: no error for map")
+	}
+}
+
+type record struct {
+	Magic uint32 `bpl:",be"`
+	Count uint16
+	_     [2]byte
+	Items []int16  `bpl:"items,len=Count"`
+	Name  string   `bpl:",size=4"`
+	Vals  []uint16 `bpl:",be"`
+}
+
+func TestTypeFrom(t *testing.T) {
+
+	v := record{Magic: 7, Count: 2, Items: []int16{-1, 5}, Name: "abcd", Vals: []uint16{1, 2}}
+	b, err := binary.Marshal(&v)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	r, err := bpl.TypeFrom(reflect.TypeOf(v))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	ctx := bpl.NewContext()
+	dom, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var ret record
+	if err = bpl.Unmarshal(dom, &ret); err != nil {
+		t.Fatal("bpl.Unmarshal failed:", err)
+	}
+	if !reflect.DeepEqual(ret, v) {
+		t.Fatal("bpl.Unmarshal:", ret)
+	}
+}
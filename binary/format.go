@@ -3,13 +3,155 @@ package binary
 import (
 	"bufio"
 	"bytes"
+	"encoding"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
 	"unsafe"
 )
 
 // -----------------------------------------------------------------------------
 
+// A Coder serializes Go values into (and deserializes them from) the layout
+// that bpl.TypeFrom derives from their types:
+//
+//   - a struct is its fields in order;
+//   - int8 ~ int64, uint8 ~ uint64, float32 and float64 are fixed size values
+//     in byte order `Order`, a bool is one byte (0 or 1);
+//   - a string is a cstring;
+//   - an array [N]T is N elements;
+//   - a slice []T is its elements, until EOF when deserializing;
+//   - a pointer is what it points to;
+//   - a type implementing encoding.BinaryMarshaler is the result of its
+//     MarshalBinary, and is deserialized by UnmarshalBinary from as many bytes
+//     as its len or size option says (all remaining bytes without them).
+//
+// A struct field can have a `bpl` tag, in form of `bpl:"[name][,option...]"`,
+// the same as bpl.TypeFrom. `name` is the member name, `-` means the field
+// isn't serialized, and `_` means its bytes are zeros (padding). Options are:
+//
+//   - be, le: byte order of the field (or its elements);
+//   - len=Field: a slice, string or BinaryMarshaler has as many elements (bytes)
+//     as the value of Field, a previous field (named by its Go name or member
+//     name), so it is length-prefixed;
+//   - size=N: a string has N bytes, padded with zeros (trailing zeros are
+//     trimmed when deserializing), or a BinaryMarshaler has N bytes.
+//
+type Coder struct {
+	Order binary.ByteOrder
+}
+
+var (
+	// LittleEndian is the Coder in little endian byte order. It is used by
+	// package functions such as Marshal and Unmarshal.
+	LittleEndian = &Coder{Order: binary.LittleEndian}
+
+	// BigEndian is the Coder in big endian byte order.
+	BigEndian = &Coder{Order: binary.BigEndian}
+)
+
+var (
+	tyMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	tyUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// -----------------------------------------------------------------------------
+
+// A fieldTag is the parsed `bpl` tag of a struct field.
+//
+type fieldTag struct {
+	name  string           // member name, "-" means not serialized, "_" means padding
+	len   string           // `len=Field`: length is the value of Field
+	size  int              // `size=N`: length of a fixed-size string
+	order binary.ByteOrder // `be` or `le`, nil means the Coder's byte order
+}
+
+func parseTag(sf reflect.StructField) (tag fieldTag, err error) {
+
+	parts := strings.Split(sf.Tag.Get("bpl"), ",")
+	tag.name = parts[0]
+	if tag.name == "" {
+		tag.name = strings.ToLower(sf.Name)
+	}
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "be":
+			tag.order = binary.BigEndian
+		case opt == "le":
+			tag.order = binary.LittleEndian
+		case strings.HasPrefix(opt, "len="):
+			tag.len = opt[4:]
+		case strings.HasPrefix(opt, "size="):
+			if tag.size, err = strconv.Atoi(opt[5:]); err != nil || tag.size < 0 {
+				return tag, fmt.Errorf("bpl/binary: invalid tag of field %s - %s", sf.Name, opt)
+			}
+		case opt != "":
+			return tag, fmt.Errorf("bpl/binary: unknown tag option of field %s - %s", sf.Name, opt)
+		}
+	}
+	return
+}
+
+// elemTag returns the tag of elements of a field: only its byte order applies.
+//
+func (p *fieldTag) elemTag() *fieldTag {
+
+	return &fieldTag{order: p.order}
+}
+
+// lenOf returns the value of field `name` (a Go name or member name) of struct
+// v, which is the length of another field.
+//
+func lenOf(v reflect.Value, name string) (n int, err error) {
+
+	t := v.Type()
+	idx := -1
+	if sf, ok := t.FieldByName(name); ok && len(sf.Index) == 1 {
+		idx = sf.Index[0]
+	} else {
+		for i, nf := 0, t.NumField(); i < nf; i++ {
+			if tag, e := parseTag(t.Field(i)); e == nil && tag.name == name {
+				idx = i
+				break
+			}
+		}
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("bpl/binary: length field `%s` not found in %v", name, t)
+	}
+	fv := v.Field(idx)
+	switch kind := fv.Kind(); {
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		n = int(fv.Int())
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		n = int(fv.Uint())
+	default:
+		return 0, fmt.Errorf("bpl/binary: length field `%s` isn't an integer", name)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("bpl/binary: length field `%s` is negative - %d", name, n)
+	}
+	return
+}
+
+// fieldOf returns field i of an addressable struct v. An unexported field is
+// returned as if it were exported, so that its methods (eg. MarshalBinary) can
+// be called and it can be set.
+//
+func fieldOf(v reflect.Value, i int) reflect.Value {
+
+	fv := v.Field(i)
+	if !fv.CanInterface() {
+		fv = reflect.NewAt(fv.Type(), unsafe.Pointer(fv.UnsafeAddr())).Elem()
+	}
+	return fv
+}
+
+// -----------------------------------------------------------------------------
+
 func writeCString(w *bufio.Writer, v string) (err error) {
 
 	_, err = w.WriteString(v)
@@ -19,12 +161,66 @@ func writeCString(w *bufio.Writer, v string) (err error) {
 	return w.WriteByte(0)
 }
 
-func writeStruct(w *bufio.Writer, v reflect.Value) (err error) {
+func writeUint(w *bufio.Writer, val uint64, size int, order binary.ByteOrder) (err error) {
+
+	var b [8]byte
+	switch size {
+	case 1:
+		b[0] = byte(val)
+	case 2:
+		order.PutUint16(b[:], uint16(val))
+	case 4:
+		order.PutUint32(b[:], uint32(val))
+	default:
+		order.PutUint64(b[:], val)
+	}
+	_, err = w.Write(b[:size])
+	return
+}
+
+func marshalerOf(v reflect.Value) (m encoding.BinaryMarshaler, ok bool) {
 
-	n := v.NumField()
+	if !v.CanInterface() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return
+	}
+	if v.Type().Implements(tyMarshaler) {
+		return v.Interface().(encoding.BinaryMarshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(tyMarshaler) {
+		return v.Addr().Interface().(encoding.BinaryMarshaler), true
+	}
+	return
+}
+
+func (p *Coder) writeStruct(w *bufio.Writer, v reflect.Value) (err error) {
+
+	t := v.Type()
+	if !v.CanAddr() { // make fields addressable, see fieldOf
+		nv := reflect.New(t).Elem()
+		nv.Set(v)
+		v = nv
+	}
+	n := t.NumField()
 	for i := 0; i < n; i++ {
-		fv := v.Field(i)
-		err = WriteValue(w, fv)
+		sf := t.Field(i)
+		var tag fieldTag
+		if tag, err = parseTag(sf); err != nil {
+			return
+		}
+		if tag.name == "-" {
+			continue
+		}
+		fv := fieldOf(v, i)
+		if tag.name == "_" { // padding
+			fv = reflect.Zero(sf.Type)
+		}
+		n := -1
+		if tag.len != "" {
+			if n, err = lenOf(v, tag.len); err != nil {
+				return
+			}
+		}
+		err = p.writeValue(w, fv, &tag, n)
 		if err != nil {
 			return
 		}
@@ -32,56 +228,113 @@ func writeStruct(w *bufio.Writer, v reflect.Value) (err error) {
 	return
 }
 
-// WriteValue serializes data into a writer.
-//
-func WriteValue(w *bufio.Writer, v reflect.Value) (err error) {
+func (p *Coder) writeValue(w *bufio.Writer, v reflect.Value, tag *fieldTag, n int) (err error) {
 
-	var val uint64
+	order := p.Order
+	if tag.order != nil {
+		order = tag.order
+	}
 
 retry:
+	if m, ok := marshalerOf(v); ok {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if n < 0 && tag.size > 0 {
+			n = tag.size
+		}
+		if n >= 0 && len(b) != n {
+			return fmt.Errorf("bpl/binary.Write - len(%v) != %d", v.Type(), n)
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
 	kind := v.Kind()
 	switch {
 	case kind == reflect.Struct:
-		return writeStruct(w, v)
+		return p.writeStruct(w, v)
 	case kind >= reflect.Int8 && kind <= reflect.Int64:
-		val = uint64(v.Int())
-		kind -= reflect.Int8
+		return writeUint(w, uint64(v.Int()), 1<<(kind-reflect.Int8), order)
 	case kind >= reflect.Uint8 && kind <= reflect.Uint64:
-		val = v.Uint()
-		kind -= reflect.Uint8
-	case kind == reflect.String:
-		return writeCString(w, v.String())
+		return writeUint(w, v.Uint(), 1<<(kind-reflect.Uint8), order)
 	case kind == reflect.Float64:
-		*(*float64)(unsafe.Pointer(&val)) = v.Float()
-		kind = 3
+		return writeUint(w, math.Float64bits(v.Float()), 8, order)
 	case kind == reflect.Float32:
-		*(*float32)(unsafe.Pointer(&val)) = float32(v.Float())
-		kind = 2
+		return writeUint(w, uint64(math.Float32bits(float32(v.Float()))), 4, order)
+	case kind == reflect.Bool:
+		if v.Bool() {
+			return w.WriteByte(1)
+		}
+		return w.WriteByte(0)
+	case kind == reflect.String:
+		s := v.String()
+		switch {
+		case n >= 0:
+			if len(s) != n {
+				return fmt.Errorf("bpl/binary.Write - len(string) != %d", n)
+			}
+		case tag.size > 0:
+			if len(s) > tag.size {
+				return fmt.Errorf("bpl/binary.Write - len(string) > %d", tag.size)
+			}
+			s += strings.Repeat("\x00", tag.size-len(s))
+		default:
+			return writeCString(w, s)
+		}
+		_, err = w.WriteString(s)
+		return
+	case kind == reflect.Array || kind == reflect.Slice:
+		if n >= 0 && v.Len() != n {
+			return fmt.Errorf("bpl/binary.Write - len(%v) != %d", v.Type(), n)
+		}
+		if kind == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 && !v.Type().Elem().Implements(tyMarshaler) {
+			_, err = w.Write(v.Bytes())
+			return
+		}
+		elemTag := tag.elemTag()
+		for i, nv := 0, v.Len(); i < nv; i++ {
+			if err = p.writeValue(w, v.Index(i), elemTag, -1); err != nil {
+				return
+			}
+		}
+		return
 	case kind == reflect.Ptr:
+		if v.IsNil() {
+			v = reflect.Zero(v.Type().Elem())
+		} else {
+			v = v.Elem()
+		}
+		goto retry
+	case kind == reflect.Interface && !v.IsNil():
 		v = v.Elem()
 		goto retry
-	default:
-		return fmt.Errorf("bpl/binary.Write - unsupported type: %v", v.Type())
 	}
-	b := (*[8]byte)(unsafe.Pointer(&val))
-	_, err = w.Write(b[:1<<kind])
-	return
+	return fmt.Errorf("bpl/binary.Write - unsupported type: %v", v.Type())
+}
+
+// WriteValue serializes data into a writer.
+//
+func (p *Coder) WriteValue(w *bufio.Writer, v reflect.Value) (err error) {
+
+	return p.writeValue(w, v, &fieldTag{}, -1)
 }
 
 // Write serializes data into a writer.
 //
-func Write(w *bufio.Writer, v interface{}) (err error) {
+func (p *Coder) Write(w *bufio.Writer, v interface{}) (err error) {
 
-	return WriteValue(w, reflect.ValueOf(v))
+	return p.WriteValue(w, reflect.ValueOf(v))
 }
 
 // Marshal returns serialization result of a value.
 //
-func Marshal(v interface{}) (b []byte, err error) {
+func (p *Coder) Marshal(v interface{}) (b []byte, err error) {
 
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
-	err = Write(w, v)
+	err = p.Write(w, v)
 	if err != nil {
 		return
 	}
@@ -89,4 +342,25 @@ func Marshal(v interface{}) (b []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+// WriteValue serializes data into a writer in little endian byte order.
+//
+func WriteValue(w *bufio.Writer, v reflect.Value) (err error) {
+
+	return LittleEndian.WriteValue(w, v)
+}
+
+// Write serializes data into a writer in little endian byte order.
+//
+func Write(w *bufio.Writer, v interface{}) (err error) {
+
+	return LittleEndian.Write(w, v)
+}
+
+// Marshal returns serialization result of a value in little endian byte order.
+//
+func Marshal(v interface{}) (b []byte, err error) {
+
+	return LittleEndian.Marshal(v)
+}
+
 // -----------------------------------------------------------------------------
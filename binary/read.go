@@ -0,0 +1,282 @@
+package binary
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+)
+
+var (
+	// ErrNonPointer is returned when the value to deserialize into isn't a
+	// non-nil pointer.
+	ErrNonPointer = errors.New("bpl/binary.Read - non-pointer or nil value")
+)
+
+// -----------------------------------------------------------------------------
+
+func readCString(r *bufio.Reader) (v string, err error) {
+
+	b, err := r.ReadBytes(0)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func readUint(r *bufio.Reader, size int, order binary.ByteOrder) (val uint64, err error) {
+
+	var b [8]byte
+	if _, err = io.ReadFull(r, b[:size]); err != nil {
+		return
+	}
+	switch size {
+	case 1:
+		val = uint64(b[0])
+	case 2:
+		val = uint64(order.Uint16(b[:]))
+	case 4:
+		val = uint64(order.Uint32(b[:]))
+	default:
+		val = order.Uint64(b[:])
+	}
+	return
+}
+
+// readBytes reads n bytes, or all remaining bytes if n < 0.
+//
+func readBytes(r *bufio.Reader, n int) (b []byte, err error) {
+
+	if n < 0 {
+		return ioutil.ReadAll(r)
+	}
+	b = make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return
+}
+
+func atEOF(r *bufio.Reader) bool {
+
+	_, err := r.Peek(1)
+	return err == io.EOF
+}
+
+func (p *Coder) readStruct(r *bufio.Reader, v reflect.Value) (err error) {
+
+	t := v.Type()
+	n := t.NumField()
+	for i := 0; i < n; i++ {
+		sf := t.Field(i)
+		var tag fieldTag
+		if tag, err = parseTag(sf); err != nil {
+			return
+		}
+		if tag.name == "-" {
+			continue
+		}
+		fv := fieldOf(v, i)
+		if tag.name == "_" { // padding
+			fv = reflect.New(sf.Type).Elem()
+		}
+		n := -1
+		if tag.len != "" {
+			if n, err = lenOf(v, tag.len); err != nil {
+				return
+			}
+		}
+		err = p.readValue(r, fv, &tag, n)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (p *Coder) readValue(r *bufio.Reader, v reflect.Value, tag *fieldTag, n int) (err error) {
+
+	order := p.Order
+	if tag.order != nil {
+		order = tag.order
+	}
+
+retry:
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(tyUnmarshaler) {
+		if n < 0 && tag.size > 0 {
+			n = tag.size
+		}
+		b, err := readBytes(r, n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	kind := v.Kind()
+	switch {
+	case kind == reflect.Struct:
+		return p.readStruct(r, v)
+	case kind >= reflect.Int8 && kind <= reflect.Int64:
+		size := 1 << (kind - reflect.Int8)
+		val, err := readUint(r, size, order)
+		if err != nil {
+			return err
+		}
+		switch size {
+		case 1:
+			v.SetInt(int64(int8(val)))
+		case 2:
+			v.SetInt(int64(int16(val)))
+		case 4:
+			v.SetInt(int64(int32(val)))
+		default:
+			v.SetInt(int64(val))
+		}
+		return nil
+	case kind >= reflect.Uint8 && kind <= reflect.Uint64:
+		val, err := readUint(r, 1<<(kind-reflect.Uint8), order)
+		if err == nil {
+			v.SetUint(val)
+		}
+		return err
+	case kind == reflect.Float64:
+		val, err := readUint(r, 8, order)
+		if err == nil {
+			v.SetFloat(math.Float64frombits(val))
+		}
+		return err
+	case kind == reflect.Float32:
+		val, err := readUint(r, 4, order)
+		if err == nil {
+			v.SetFloat(float64(math.Float32frombits(uint32(val))))
+		}
+		return err
+	case kind == reflect.Bool:
+		c, err := r.ReadByte()
+		if err == nil {
+			v.SetBool(c != 0)
+		}
+		return err
+	case kind == reflect.String:
+		var b []byte
+		switch {
+		case n >= 0:
+			b, err = readBytes(r, n)
+		case tag.size > 0:
+			if b, err = readBytes(r, tag.size); err == nil {
+				b = bytes.TrimRight(b, "\x00")
+			}
+		default:
+			var s string
+			if s, err = readCString(r); err == nil {
+				v.SetString(s)
+			}
+			return
+		}
+		if err == nil {
+			v.SetString(string(b))
+		}
+		return
+	case kind == reflect.Array:
+		elemTag := tag.elemTag()
+		for i, nv := 0, v.Len(); i < nv; i++ {
+			if err = p.readValue(r, v.Index(i), elemTag, -1); err != nil {
+				return
+			}
+		}
+		return
+	case kind == reflect.Slice:
+		t := v.Type()
+		if elem := t.Elem(); elem.Kind() == reflect.Uint8 && !reflect.PtrTo(elem).Implements(tyUnmarshaler) {
+			b, err := readBytes(r, n)
+			if err == nil {
+				v.SetBytes(b)
+			}
+			return err
+		}
+		elemTag := tag.elemTag()
+		if n >= 0 {
+			v.Set(reflect.MakeSlice(t, n, n))
+			for i := 0; i < n; i++ {
+				if err = p.readValue(r, v.Index(i), elemTag, -1); err != nil {
+					return
+				}
+			}
+			return
+		}
+		s := reflect.MakeSlice(t, 0, 4)
+		for !atEOF(r) { // until EOF
+			elem := reflect.New(t.Elem()).Elem()
+			if err = p.readValue(r, elem, elemTag, -1); err != nil {
+				return
+			}
+			s = reflect.Append(s, elem)
+		}
+		v.Set(s)
+		return
+	case kind == reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+		goto retry
+	}
+	return fmt.Errorf("bpl/binary.Read - unsupported type: %v", v.Type())
+}
+
+// ReadValue deserializes data from a reader into v, which must be settable.
+//
+func (p *Coder) ReadValue(r *bufio.Reader, v reflect.Value) (err error) {
+
+	return p.readValue(r, v, &fieldTag{}, -1)
+}
+
+// Read deserializes data from a reader into the value pointed to by v.
+//
+func (p *Coder) Read(r *bufio.Reader, v interface{}) (err error) {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrNonPointer
+	}
+	return p.ReadValue(r, rv.Elem())
+}
+
+// Unmarshal deserializes b into the value pointed to by v. It is the inverse of
+// Marshal.
+//
+func (p *Coder) Unmarshal(b []byte, v interface{}) (err error) {
+
+	return p.Read(bufio.NewReader(bytes.NewReader(b)), v)
+}
+
+// ReadValue deserializes data from a reader in little endian byte order.
+//
+func ReadValue(r *bufio.Reader, v reflect.Value) (err error) {
+
+	return LittleEndian.ReadValue(r, v)
+}
+
+// Read deserializes data from a reader in little endian byte order.
+//
+func Read(r *bufio.Reader, v interface{}) (err error) {
+
+	return LittleEndian.Read(r, v)
+}
+
+// Unmarshal deserializes b in little endian byte order.
+//
+func Unmarshal(b []byte, v interface{}) (err error) {
+
+	return LittleEndian.Unmarshal(b, v)
+}
+
+// -----------------------------------------------------------------------------
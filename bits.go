@@ -0,0 +1,268 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	mbits "math/bits"
+	"reflect"
+)
+
+var (
+	// ErrExpGolombOverflow is returned when an Exp-Golomb code has too many leading zero bits.
+	ErrExpGolombOverflow = errors.New("exp-golomb code overflows")
+)
+
+// -----------------------------------------------------------------------------
+
+// A bitCursor holds the bits of a partially consumed byte. Consecutive bit
+// fields share it, so it lives in the Context and is shared by sub contexts.
+//
+type bitCursor struct {
+	in   *bufio.Reader
+	cur  byte
+	left uint // number of unread bits of cur
+}
+
+func (p *bitCursor) reset() {
+
+	p.in, p.left = nil, 0
+}
+
+func (p *bitCursor) readBits(in *bufio.Reader, n uint) (v uint64, err error) {
+
+	if p.in != in { // bits of another input stream are dropped
+		p.in, p.left = in, 0
+	}
+	for n > 0 {
+		if p.left == 0 {
+			p.cur, err = in.ReadByte()
+			if err != nil {
+				return
+			}
+			p.left = 8
+		}
+		m := n
+		if m > p.left {
+			m = p.left
+		}
+		p.left -= m
+		n -= m
+		v = (v << m) | uint64((p.cur>>p.left)&(1<<m-1))
+	}
+	return
+}
+
+// AlignBits drops unread bits of the partially consumed byte, so that next
+// matching starts at a byte boundary.
+//
+func (p *Context) AlignBits() {
+
+	if p.bits != nil {
+		p.bits.reset()
+	}
+	if p.enc != nil {
+		p.enc.bits.reset()
+	}
+}
+
+// ReadBits reads n bits (MSB first) from input stream `in`.
+//
+func (p *Context) ReadBits(in *bufio.Reader, n uint) (v uint64, err error) {
+
+	if p.bits == nil {
+		p.bits = new(bitCursor)
+	}
+	return p.bits.readBits(in, n)
+}
+
+// A bitWriter holds the partially written last byte of an output buffer.
+//
+type bitWriter struct {
+	w    *bytes.Buffer
+	left uint // number of unwritten bits of last byte of w
+}
+
+func (p *bitWriter) reset() {
+
+	p.w, p.left = nil, 0
+}
+
+func (p *bitWriter) writeBits(w *bytes.Buffer, v uint64, n uint) {
+
+	if p.w != w { // bits of another output buffer are dropped
+		p.w, p.left = w, 0
+	}
+	for n > 0 {
+		if p.left == 0 {
+			w.WriteByte(0)
+			p.left = 8
+		}
+		m := n
+		if m > p.left {
+			m = p.left
+		}
+		p.left -= m
+		n -= m
+		b := w.Bytes()
+		b[len(b)-1] |= byte((v>>n)&(1<<m-1)) << p.left
+	}
+}
+
+func isBitRuler(R Ruler) bool {
+
+	for {
+		switch r := R.(type) {
+		case bits, expGolomb:
+			return true
+		case *fileLine:
+			R = r.r
+		case *TypeVar:
+			if r.Elem == nil {
+				return false
+			}
+			R = r.Elem
+		default:
+			return false
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type bits uint
+
+func (p bits) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	val, err := ctx.ReadBits(in, uint(p))
+	if err != nil {
+		return
+	}
+	return uint(val), nil
+}
+
+func (p bits) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	v, ok := toUint64(dom)
+	if !ok {
+		return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+	}
+	ctx.enc.bits.writeBits(w, v, uint(p))
+	return nil
+}
+
+func (p bits) RetType() reflect.Type {
+
+	return tyUint
+}
+
+func (p bits) SizeOf() int {
+
+	return -1
+}
+
+// Bits returns a matching unit that matches a `bits(n)` field (MSB first).
+// Consecutive bit fields share partial bytes. A byte aligned member, or a
+// byte level statement such as skip, read, eval or at, drops the unread bits
+// and starts at the next byte boundary.
+//
+func Bits(n int) Ruler {
+
+	if n < 1 || n > 64 {
+		panic("Bits: invalid argument (n >= 1 && n <= 64)")
+	}
+	return bits(n)
+}
+
+// Bit is a matching unit that matches a `bits(1)` field.
+//
+var Bit = Bits(1)
+
+// -----------------------------------------------------------------------------
+
+type expGolomb bool
+
+func (p expGolomb) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	zeros := uint(0)
+	for {
+		b, err1 := ctx.ReadBits(in, 1)
+		if err1 != nil {
+			return nil, err1
+		}
+		if b != 0 {
+			break
+		}
+		if zeros++; zeros > 63 {
+			return nil, ErrExpGolombOverflow
+		}
+	}
+	val := uint64(0)
+	if zeros > 0 {
+		if val, err = ctx.ReadBits(in, zeros); err != nil {
+			return
+		}
+	}
+	code := (uint64(1)<<zeros - 1) + val
+	if !p {
+		return uint(code), nil
+	}
+	if code&1 != 0 {
+		return int((code + 1) >> 1), nil
+	}
+	return -int(code >> 1), nil
+}
+
+func (p expGolomb) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	var code uint64
+	if p {
+		v, ok := toInt64(dom)
+		if !ok {
+			return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+		}
+		if v > 0 {
+			code = uint64(v)<<1 - 1
+		} else {
+			code = uint64(-v) << 1
+		}
+	} else {
+		v, ok := toUint64(dom)
+		if !ok {
+			return &EncodeError{R: p, Dom: dom, Msg: "value isn't an integer"}
+		}
+		code = v
+	}
+	if code == math.MaxUint64 {
+		return ErrExpGolombOverflow
+	}
+	code++
+	n := uint(mbits.Len64(code))
+	ctx.enc.bits.writeBits(w, 0, n-1)
+	ctx.enc.bits.writeBits(w, code, n)
+	return nil
+}
+
+func (p expGolomb) RetType() reflect.Type {
+
+	if p {
+		return tyInt
+	}
+	return tyUint
+}
+
+func (p expGolomb) SizeOf() int {
+
+	return -1
+}
+
+var (
+	// Ue is a matching unit that matches an unsigned Exp-Golomb code (ue(v) in H.264).
+	Ue Ruler = expGolomb(false)
+
+	// Se is a matching unit that matches a signed Exp-Golomb code (se(v) in H.264).
+	Se Ruler = expGolomb(true)
+)
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,79 @@
+package bpl_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/goplus/bpl"
+	"github.com/qiniu/x/bufiox"
+)
+
+func TestBits(t *testing.T) {
+
+	members := []bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Bits(3)},
+		&bpl.Member{Name: "b", Type: bpl.Bit},
+		&bpl.Member{Name: "c", Type: bpl.Bits(12)},
+		&bpl.Member{Name: "d", Type: bpl.Uint8},
+		&bpl.Member{Name: "e", Type: bpl.Bits(2)},
+		&bpl.Member{Name: "f", Type: bpl.Uint8},
+	}
+	struc := bpl.Struct(members)
+
+	in := bufiox.NewReaderBuffer([]byte{0xb1, 0x23, 0x45, 0xff, 0x67})
+	ret, err := struc.Match(in, bpl.NewContext())
+	if err != nil {
+		t.Fatal("struc.Match failed:", err)
+	}
+	text, err := json.Marshal(ret)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"a":5,"b":1,"c":291,"d":69,"e":3,"f":103}` {
+		t.Fatal("json.Marshal result:", string(text))
+	}
+}
+
+func TestBitsThenStatement(t *testing.T) {
+
+	one := func(ctx *bpl.Context) int { return 1 }
+	members := []bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Bits(3)},
+		bpl.Skip(one),
+		&bpl.Member{Name: "b", Type: bpl.Bits(4)},
+		bpl.Read(one, bpl.Struct([]bpl.Ruler{&bpl.Member{Name: "c", Type: bpl.Uint8}})),
+		&bpl.Member{Name: "d", Type: bpl.Bits(8)},
+	}
+	struc := bpl.Struct(members)
+
+	// skip and read start at a byte boundary, the unread bits are dropped
+	in := bufiox.NewReaderBuffer([]byte{0xb1, 0x23, 0x45, 0x67, 0x89})
+	ret, err := struc.Match(in, bpl.NewContext())
+	if err != nil {
+		t.Fatal("struc.Match failed:", err)
+	}
+	text, err := json.Marshal(ret)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"a":5,"b":4,"c":103,"d":137}` {
+		t.Fatal("json.Marshal result:", string(text))
+	}
+}
+
+func TestExpGolomb(t *testing.T) {
+
+	// 1 010 011 00100 00101
+	in := bufiox.NewReaderBuffer([]byte{0xa6, 0x42, 0x80})
+	ctx := bpl.NewContext()
+	for i, r := range []bpl.Ruler{bpl.Ue, bpl.Ue, bpl.Ue, bpl.Ue, bpl.Se} {
+		v, err := r.Match(in, ctx)
+		if err != nil {
+			t.Fatal("Match failed:", i, err)
+		}
+		want := []interface{}{uint(0), uint(1), uint(2), uint(3), int(-2)}[i]
+		if v != want {
+			t.Fatal("Match result:", i, v, want)
+		}
+	}
+}
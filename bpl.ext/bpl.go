@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -15,7 +16,6 @@ import (
 
 	"github.com/goplus/bpl"
 	"github.com/qiniu/text/tpl/interpreter"
-	"github.com/qiniu/x/bufiox"
 	"github.com/qiniu/x/log"
 
 	qlang "github.com/xushiwei/qlang/spec"
@@ -77,7 +77,28 @@ func writePrefix(b *bytes.Buffer, lvl int) {
 //
 func DumpDom(b *bytes.Buffer, dom interface{}, lvl int) {
 
-	dumpDomValue(b, reflect.ValueOf(dom), lvl)
+	dumpDomValue(b, reflect.ValueOf(dom), nil, lvl)
+}
+
+// DumpDomWithSpan dumps a dom tree, and the span (offset, length and rule name)
+// of each node in form of `<@offset+length rule>`.
+//
+func DumpDomWithSpan(b *bytes.Buffer, dom interface{}, span *bpl.Span, lvl int) {
+
+	writeSpan(b, span)
+	dumpDomValue(b, reflect.ValueOf(dom), span, lvl)
+}
+
+func writeSpan(b *bytes.Buffer, span *bpl.Span) {
+
+	if span != nil {
+		fmt.Fprintf(b, "<@%d+%d", span.Offset, span.Length)
+		if span.Rule != "" {
+			b.WriteByte(' ')
+			b.WriteString(span.Rule)
+		}
+		b.WriteString("> ")
+	}
 }
 
 type stringSlice []reflect.Value
@@ -88,9 +109,25 @@ func (p stringSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 var typeBytes = reflect.TypeOf([]byte(nil))
 
-func dumpDomValue(b *bytes.Buffer, dom reflect.Value, lvl int) {
+var typeMap = reflect.TypeOf((*bpl.Map)(nil))
+
+var typeEnumValue = reflect.TypeOf(bpl.EnumValue{})
+
+func dumpDomValue(b *bytes.Buffer, dom reflect.Value, span *bpl.Span, lvl int) {
 
 retry:
+	if !dom.IsValid() { // eg. DumpDom(b, nil, 0)
+		b.WriteString("<nil>")
+		return
+	}
+	if dom.Type() == typeMap && !dom.IsNil() {
+		dumpMap(b, dom.Interface().(*bpl.Map), span, lvl)
+		return
+	}
+	if dom.Type() == typeEnumValue {
+		b.WriteString(dom.Interface().(bpl.EnumValue).String())
+		return
+	}
 	switch dom.Kind() {
 	case reflect.Slice:
 		if dom.Type() == typeBytes {
@@ -105,7 +142,12 @@ retry:
 		for i := 0; i < n; i++ {
 			b.WriteByte('\n')
 			writePrefix(b, lvl+1)
-			dumpDomValue(b, dom.Index(i), lvl+1)
+			var elem *bpl.Span
+			if span != nil && i < len(span.Elems) {
+				elem = span.Elems[i]
+				writeSpan(b, elem)
+			}
+			dumpDomValue(b, dom.Index(i), elem, lvl+1)
 			b.WriteByte(',')
 		}
 		b.WriteByte('\n')
@@ -131,13 +173,18 @@ retry:
 			item := dom.MapIndex(key)
 			b.WriteByte('\n')
 			writePrefix(b, lvl+1)
+			var member *bpl.Span
 			if fstring {
 				b.WriteString(key.String())
+				if span != nil {
+					member = span.Member(key.String())
+				}
 			} else {
-				dumpDomValue(b, key, lvl+1)
+				dumpDomValue(b, key, nil, lvl+1)
 			}
 			b.WriteString(": ")
-			dumpDomValue(b, item, lvl+1)
+			writeSpan(b, member)
+			dumpDomValue(b, item, member, lvl+1)
 		}
 		b.WriteByte('\n')
 		writePrefix(b, lvl)
@@ -155,6 +202,37 @@ retry:
 	}
 }
 
+// dumpMap dumps matching result of a struct, in the order its members are matched.
+//
+func dumpMap(b *bytes.Buffer, vars *bpl.Map, span *bpl.Span, lvl int) {
+
+	b.WriteByte('{')
+	for _, key := range vars.Keys() {
+		item, _ := vars.Get(key)
+		if strings.HasPrefix(key, "_") {
+			if n, ok := item.(bpl.Padding); ok { // hidden padding
+				b.WriteByte('\n')
+				writePrefix(b, lvl+1)
+				fmt.Fprintf(b, "(%d-byte padding)", n)
+			}
+			continue
+		}
+		b.WriteByte('\n')
+		writePrefix(b, lvl+1)
+		b.WriteString(key)
+		b.WriteString(": ")
+		var member *bpl.Span
+		if span != nil {
+			member = span.Member(key)
+			writeSpan(b, member)
+		}
+		dumpDomValue(b, reflect.ValueOf(item), member, lvl+1)
+	}
+	b.WriteByte('\n')
+	writePrefix(b, lvl)
+	b.WriteByte('}')
+}
+
 // -----------------------------------------------------------------------------
 
 type dump int
@@ -176,6 +254,11 @@ func (p dump) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err erro
 	return
 }
 
+func (p dump) Encode(w *bytes.Buffer, dom interface{}, ctx *bpl.Context) error {
+
+	return nil
+}
+
 func (p dump) RetType() reflect.Type {
 
 	return bpl.TyInterface
@@ -201,7 +284,8 @@ func (p Ruler) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err err
 	return bpl.MatchStream(p.Impl, in, ctx)
 }
 
-// SafeMatch matches input stream `in`, and returns matching result.
+// SafeMatch matches input stream `in`, and returns matching result. If matching
+// fails, v is the partial matching result (see bpl.PartialError).
 //
 func (p Ruler) SafeMatch(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
 
@@ -220,15 +304,19 @@ func (p Ruler) SafeMatch(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err
 		}
 	}()
 
-	return bpl.MatchStream(p.Impl, in, ctx)
+	v, err = bpl.MatchStream(p.Impl, in, ctx)
+	if err != nil {
+		v, _ = bpl.PartialDom(err)
+	}
+	return
 }
 
 // MatchStream matches input stream `r`, and returns matching result.
 //
 func (p Ruler) MatchStream(r io.Reader) (v interface{}, err error) {
 
-	in := bufio.NewReader(r)
-	ctx := bpl.NewContext()
+	ctx := NewContext()
+	in := ctx.NewReader(r)
 	return p.SafeMatch(in, ctx)
 }
 
@@ -236,13 +324,164 @@ func (p Ruler) MatchStream(r io.Reader) (v interface{}, err error) {
 //
 func (p Ruler) MatchBuffer(b []byte) (v interface{}, err error) {
 
-	in := bufiox.NewReaderBuffer(b)
-	ctx := bpl.NewContext()
+	ctx := NewContext()
+	in := ctx.NewReaderBuffer(b)
 	return p.SafeMatch(in, ctx)
 }
 
+// MatchWithSpan matches input stream `r`, and returns matching result and its
+// span tree (see bpl.Context.EnableSpans).
+//
+func (p Ruler) MatchWithSpan(r io.Reader) (v interface{}, span *bpl.Span, err error) {
+
+	ctx := NewContext()
+	in := ctx.NewReader(r)
+	ctx.EnableSpans()
+	v, err = p.SafeMatch(in, ctx)
+	return v, ctx.Span(), err
+}
+
+// ErrRecordsClosed is returned by `Records.Err` after `Records.Close` is called.
+//
+var ErrRecordsClosed = errors.New("records are closed")
+
+// Records iterates records of an input stream in streaming mode (see
+// bpl.Context.SetRecordFunc). Its usage is like this:
+//
+//	rs := ruler.Records(r)
+//	defer rs.Close()
+//	for rs.Next() {
+//		record := rs.Record()
+//		...
+//	}
+//	if err := rs.Err(); err != nil {
+//		...
+//	}
+//
+type Records struct {
+	ch     chan interface{}
+	stop   chan struct{}
+	record interface{}
+	dom    interface{}
+	err    error
+	done   bool
+}
+
+// Records matches input stream `r` in streaming mode, and returns an iterator
+// of the records.
+//
+func (p Ruler) Records(r io.Reader) *Records {
+
+	rs := &Records{ch: make(chan interface{}), stop: make(chan struct{})}
+	go func() {
+		ctx := NewContext()
+		in := ctx.NewReader(r)
+		ctx.SetRecordFunc(func(v interface{}) error {
+			select {
+			case rs.ch <- v:
+				return nil
+			case <-rs.stop:
+				return ErrRecordsClosed
+			}
+		})
+		rs.dom, rs.err = p.SafeMatch(in, ctx)
+		close(rs.ch)
+	}()
+	return rs
+}
+
+// Next advances to the next record. It returns false when no more records
+// are available, or an error occurs.
+//
+func (p *Records) Next() bool {
+
+	v, ok := <-p.ch
+	p.record, p.done = v, !ok
+	return ok
+}
+
+// Record returns current record.
+//
+func (p *Records) Record() interface{} {
+
+	return p.record
+}
+
+// Err returns the error that stopped the iteration. It should be called after
+// `Next` returns false.
+//
+func (p *Records) Err() error {
+
+	return p.err
+}
+
+// Dom returns the matching result without records, or the partial matching
+// result if an error occurs. It should be called after `Next` returns false.
+//
+func (p *Records) Dom() interface{} {
+
+	return p.dom
+}
+
+// Close stops the iteration if it isn't done.
+//
+func (p *Records) Close() {
+
+	if p.done {
+		return
+	}
+	p.done = true
+	close(p.stop)
+	for range p.ch {
+	}
+	p.err = ErrRecordsClosed
+}
+
+// MarshalDOM encodes `dom`, a matching result of this matching unit, back
+// to bytes. It is the counterpart of `MatchBuffer`.
+//
+func (p Ruler) MarshalDOM(dom interface{}) (b []byte, err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch val := e.(type) {
+			case string:
+				err = errors.New(val)
+			case error:
+				err = val
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	var w bytes.Buffer
+	err = bpl.Encode(p.Impl, &w, dom, bpl.NewContext())
+	if err != nil {
+		return
+	}
+	return w.Bytes(), nil
+}
+
 // -----------------------------------------------------------------------------
 
+// compile compiles bpl source code of file `fname`.
+//
+func (p *Compiler) compile(code []byte, fname string) (err error) {
+
+	if p.imp == nil {
+		p.imp = newImporter()
+	}
+	engine, err := interpreter.New(p, interpreter.InsertSemis)
+	if err != nil {
+		return
+	}
+
+	p.ipt = engine
+	p.fname = fname
+	return engine.MatchExactly(code, fname)
+}
+
 // New compiles bpl source code and returns the corresponding matching unit.
 //
 func New(code []byte, fname string) (r Ruler, err error) {
@@ -261,13 +500,7 @@ func New(code []byte, fname string) (r Ruler, err error) {
 	}()
 
 	p := newCompiler()
-	engine, err := interpreter.New(p, interpreter.InsertSemis)
-	if err != nil {
-		return
-	}
-
-	p.ipt = engine
-	err = engine.MatchExactly(code, fname)
+	err = p.compile(code, fname)
 	if err != nil {
 		return
 	}
@@ -296,11 +529,18 @@ func NewFromFile(fname string) (r Ruler, err error) {
 	return New(b, fname)
 }
 
-// NewContext returns a new matching Context.
+// DefaultLimits is the resource limits of Contexts returned by NewContext. It
+// is used by Ruler.MatchStream, Ruler.MatchBuffer and Ruler.Records too.
+//
+var DefaultLimits bpl.Limits
+
+// NewContext returns a new matching Context, with DefaultLimits applied.
 //
 func NewContext() *bpl.Context {
 
-	return bpl.NewContext()
+	ctx := bpl.NewContext()
+	ctx.SetLimits(DefaultLimits)
+	return ctx
 }
 
 // -----------------------------------------------------------------------------
@@ -178,7 +178,7 @@ func TestStruct(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `{"c":3,"d":3.14,"e":"Hello","f":{"f":"foo"},"sub1":{"a":1,"b":2}}` {
+	if string(ret) != `{"sub1":{"a":1,"b":2},"c":3,"d":3.14,"e":"Hello","f":{"f":"foo"}}` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -207,7 +207,7 @@ func TestDump(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `{"_b":3,"a":1}` {
+	if string(ret) != `{"a":1,"_b":3}` {
 		t.Fatal("ret:", string(ret))
 	}
 	var b bytes.Buffer
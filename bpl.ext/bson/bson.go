@@ -2,6 +2,7 @@ package bson
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"io"
@@ -78,6 +79,23 @@ func (p typeImpl) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err
 	return &Document{data: data}, nil
 }
 
+func (p typeImpl) Encode(w *bytes.Buffer, dom interface{}, ctx *bpl.Context) (err error) {
+
+	if doc, ok := dom.(*Document); ok {
+		if doc.data != nil {
+			w.Write(doc.data)
+			return
+		}
+		dom = doc.cache
+	}
+	data, err := bson.Marshal(dom)
+	if err != nil {
+		return
+	}
+	w.Write(data)
+	return
+}
+
 func (p typeImpl) RetType() reflect.Type {
 
 	return tyDocument
@@ -1,8 +1,10 @@
 package bpl
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/goplus/bpl"
 	"github.com/goplus/bpl/bpl.ext/bson"
@@ -12,7 +14,7 @@ import (
 
 const grammar = `
 
-expr = +factor/And
+expr = +ufactor/And % '|'/Alt
 
 term1 = ifactor *(
 	'*' ifactor/mul | '/' ifactor/quo | '%' ifactor/mod |
@@ -30,7 +32,7 @@ iexpr = qexpr/qline
 
 index = '['/istart iexpr ']'/iend
 
-casecond = INT/casei | STRING/cases
+casecond = INT/casei | STRING/cases | (@(IDENT '.') qname)/qcasec | IDENT/casec
 
 casebody = (casecond ':' expr/source) %= ';'/ARITY ?(';' "default" ':' expr)/ARITY
 
@@ -46,6 +48,14 @@ readexpr = "read" exprblock /read
 
 evalexpr = "eval" exprblock /eval
 
+atexpr = "at" exprblock /at
+
+decodeexpr = "decode"! STRING/cases ("do" expr /decodeall | exprblock /decode)
+
+checksumexpr = "checksum"! IDENT/algo "over" factor "expect"/istart iexpr /iend /checksum
+
+recoverexpr = "recover"/istart! iexpr ?("every"! INT/cpushi)/ARITY (@'{' | "do")/iend expr /recover
+
 doexpr = "do"/istart! iexpr /iend /do
 
 letexpr = "let"! IDENT/var % ','/ARITY '='/istart! iexpr /iend /let
@@ -60,28 +70,46 @@ retexpr = "return"/istart! iexpr /iend /return
 
 dumpexpr = "dump"/dump
 
-dynexpr = caseexpr | readexpr | skipexpr | evalexpr | assertexpr | ifexpr | letexpr | doexpr | retexpr | gblexpr | fatalexpr | dumpexpr
+endianexpr = "endian"! (@(IDENT (';' | '}')) IDENT/endian | exprblock /endiando)
+
+alignexpr = "align"/istart! iexpr ?(',' INT/cpushi)/ARITY /iend /align
+
+padexpr = "pad"! "to"/istart iexpr ?(',' INT/cpushi)/ARITY /iend /padto
+
+dynexpr = caseexpr | readexpr | skipexpr | evalexpr | atexpr | decodeexpr | checksumexpr | recoverexpr | assertexpr | ifexpr | letexpr | doexpr | retexpr | gblexpr | fatalexpr | dumpexpr | endianexpr | alignexpr | padexpr
+
+untilexpr =
+	"until"! ("at"/istart! iexpr /iend /untilat | "skip"/istart! iexpr /iend /untilskip | true/istart iexpr /iend /until) |
+	"while"/istart! iexpr /iend /while
+
+targ = true/istart iexpr /iend
+
+qname = IDENT/var ?('.' IDENT/qname)
+
+functype = @(IDENT ?('.' IDENT) '(') qname '('/tstart! targ % ','/ARITY ')'/tend /functype
+
+typename = functype | (@(IDENT '.') qname)/qident | IDENT/ident
 
 basetype =
-	IDENT/ident |
-	(index IDENT/ident)/array
+	typename |
+	(index typename)/array
 
 type =
-	basetype |
+	(basetype ?untilexpr) |
 	('*'! basetype)/array0 |
 	('?'! basetype)/array01 |
 	('+'! basetype)/array1
 
 member = ((IDENT type)/member | dynexpr)/xline
 
-cmember = (IDENT/ident ?(index/array | '*'/array0 | '?'/array01 | '+'/array1) IDENT/member | dynexpr)/xline
+cmember = (typename ?(index/array | '*'/array0 | '?'/array01 | '+'/array1 | untilexpr) IDENT/member | dynexpr)/xline
 
 cstruct = cmember %= ';'/ARITY /struct
 
 struct = member %= ';'/ARITY /struct
 
 factor =
-	IDENT/ident |
+	typename |
 	'{' ('/' "C" ';' cstruct | struct) ?';' '}' |
 	'*' factor/repeat0 |
 	'+' factor/repeat1 |
@@ -90,7 +118,9 @@ factor =
 	'[' +factor/Seq ']' |
 	dynexpr
 
-imember = IDENT | "assert" | "fatal" | "read" | "skip" | "eval" | "let" | "sizeof" | "C" | "global" | "do" | "dump"
+ufactor = factor ?untilexpr
+
+imember = IDENT | "assert" | "fatal" | "read" | "skip" | "eval" | "at" | "decode" | "checksum" | "over" | "expect" | "recover" | "every" | "let" | "sizeof" | "C" | "global" | "do" | "dump" | "import" | "endian" | "until" | "while" | "align" | "pad" | "to"
 
 atom =
 	'('! qexpr %= ','/ARITY ?"..."/ARITY ?',' ')'/call |
@@ -112,9 +142,21 @@ cexpr = INT/cpushi
 
 const = (IDENT '=' cexpr ';')/const
 
+enumitem = IDENT/var '='! cexpr
+
+enumdecl = @(IDENT IDENT) IDENT/enumkind IDENT/var typename '{' enumitem %= ';'/ARITY ?';' '}' /enum
+
+importdecl = "import"! (STRING/import | IDENT/var STRING/importas) ';'
+
+tpldef = @(IDENT '(') IDENT/var '('! IDENT/tparam % ',' ')' '=' expr/xline ';' /assigntpl
+
 doc = +(
+	importdecl |
+	"endian"! IDENT/fileendian ';' |
 	(IDENT '=' expr/xline ';')/assign |
-	"const" '(' *const ')' ';')
+	tpldef |
+	"const" '(' *const ')' ';' |
+	enumdecl ';')
 `
 
 var (
@@ -132,6 +174,18 @@ type Compiler struct {
 	rulers   map[string]bpl.Ruler
 	vars     map[string]*bpl.TypeVar
 	consts   map[string]interface{}
+	enums    map[string]enumItems // items of enums, by enum name
+	items    map[string]string    // enum of an unqualified item name, "" if it's ambiguous
+	tpls     map[string]*template
+	tparams  []string             // parameters of the template being compiled
+	tname    string               // name of the template being compiled
+	targs    int                  // > 0 if compiling arguments of a template
+	insts    []*tplInst           // instantiated templates
+	ctxRefs  []int                // instructions which refer ctxVars, in ascending order
+	imports  map[string]*Compiler // imported files, by namespace
+	imp      *importer
+	fname    string
+	order    binary.ByteOrder // byte order of the file, see `endian big|little`
 	gstk     exec.Stack
 	ipt      interpreter.Engine
 	idxStart int
@@ -142,7 +196,23 @@ func newCompiler() (p *Compiler) {
 	rulers := make(map[string]bpl.Ruler)
 	vars := make(map[string]*bpl.TypeVar)
 	consts := make(map[string]interface{})
-	return &Compiler{rulers: rulers, vars: vars, consts: consts}
+	tpls := make(map[string]*template)
+	imports := make(map[string]*Compiler)
+	enums, items := make(map[string]enumItems), make(map[string]string)
+	return &Compiler{rulers: rulers, vars: vars, consts: consts, enums: enums, items: items, tpls: tpls, imports: imports}
+}
+
+// check checks that all variables are assigned, and all instantiated templates
+// are valid.
+//
+func (p *Compiler) check() (err error) {
+
+	for name, v := range p.vars {
+		if v.Elem == nil {
+			return fmt.Errorf("variable `%s` is not assigned", name)
+		}
+	}
+	return p.checkInsts()
 }
 
 // Ret returns compiling result.
@@ -157,13 +227,10 @@ func (p *Compiler) Ret() (r Ruler, err error) {
 			return Ruler{}, ErrNoDoc
 		}
 	}
-	for name, v := range p.vars {
-		if v.Elem == nil {
-			err = fmt.Errorf("variable `%s` is not assigned", name)
-			return
-		}
+	if err = p.check(); err != nil {
+		return
 	}
-	return Ruler{Impl: root}, nil
+	return Ruler{Impl: p.withOrder(root)}, nil
 }
 
 // Grammar returns the qlang compiler's grammar. It is required by tpl.Interpreter engine.
@@ -185,6 +252,7 @@ func (p *Compiler) Stack() interpreter.Stack {
 var exports = map[string]interface{}{
 	"$And":      (*Compiler).and,
 	"$Seq":      (*Compiler).seq,
+	"$Alt":      (*Compiler).alt,
 	"$istart":   (*Compiler).istart,
 	"$iend":     (*Compiler).iend,
 	"$array":    (*Compiler).array,
@@ -193,7 +261,11 @@ var exports = map[string]interface{}{
 	"$array01":  (*Compiler).repeat01,
 	"$var":      (*Compiler).variable,
 	"$ident":    (*Compiler).ident,
+	"$functype": (*Compiler).functype,
 	"$assign":   (*Compiler).assign,
+	"$tparam":   (*Compiler).tparam,
+	"$tstart":   (*Compiler).tstart,
+	"$tend":     (*Compiler).tend,
 	"$repeat0":  (*Compiler).repeat0,
 	"$repeat1":  (*Compiler).repeat1,
 	"$repeat01": (*Compiler).repeat01,
@@ -219,6 +291,7 @@ var exports = map[string]interface{}{
 	"$do":     (*Compiler).fnDo,
 	"$if":     (*Compiler).fnIf,
 	"$read":   (*Compiler).fnRead,
+	"$at":     (*Compiler).fnAt,
 	"$skip":   (*Compiler).fnSkip,
 	"$return": (*Compiler).fnReturn,
 	"$case":   (*Compiler).fnCase,
@@ -228,12 +301,38 @@ var exports = map[string]interface{}{
 	"$const":  (*Compiler).fnConst,
 	"$casei":  (*Compiler).casei,
 	"$cases":  (*Compiler).cases,
+	"$casec":  (*Compiler).casec,
 	"$source": (*Compiler).source,
 	"$member": (*Compiler).member,
 	"$struct": (*Compiler).gostruct,
 	"$qline":  (*Compiler).codeLine,
 	"$xline":  (*Compiler).xline,
 
+	"$decode":    (*Compiler).fnDecode,
+	"$decodeall": (*Compiler).fnDecodeAll,
+	"$algo":      (*Compiler).algo,
+	"$checksum":  (*Compiler).fnChecksum,
+	"$recover":   (*Compiler).fnRecover,
+	"$enumkind":  (*Compiler).enumkind,
+	"$enum":      (*Compiler).fnEnum,
+	"$assigntpl": (*Compiler).assignTemplate,
+	"$import":    (*Compiler).fnImport,
+	"$importas":  (*Compiler).fnImportAs,
+	"$qname":     (*Compiler).qname,
+	"$qident":    (*Compiler).qident,
+	"$qcasec":    (*Compiler).qcasec,
+
+	"$endian":     (*Compiler).fnEndian,
+	"$endiando":   (*Compiler).fnEndianDo,
+	"$fileendian": (*Compiler).fileEndian,
+
+	"$until":     (*Compiler).fnUntil,
+	"$while":     (*Compiler).fnWhile,
+	"$untilat":   (*Compiler).fnUntilAt,
+	"$untilskip": (*Compiler).fnUntilSkip,
+	"$align":     (*Compiler).fnAlign,
+	"$padto":     (*Compiler).fnPadTo,
+
 	"exit": exit,
 }
 
@@ -253,17 +352,33 @@ var builtins = map[string]bpl.Ruler{
 	"uint24be":  bpl.Uintbe(3),
 	"uint32be":  bpl.Uintbe(4),
 	"uint64be":  bpl.Uintbe(8),
-	"uint16le":  bpl.Uint16,
+	"uint16le":  bpl.BaseTypeLE(reflect.Uint16),
 	"uint24le":  bpl.Uint24,
-	"uint32le":  bpl.Uint32,
-	"uint64le":  bpl.Uint64,
+	"uint32le":  bpl.BaseTypeLE(reflect.Uint32),
+	"uint64le":  bpl.BaseTypeLE(reflect.Uint64),
 	"float32":   bpl.Float32,
 	"float64":   bpl.Float64,
-	"float32le": bpl.Float32,
-	"float64le": bpl.Float64,
+	"float32le": bpl.BaseTypeLE(reflect.Float32),
+	"float64le": bpl.BaseTypeLE(reflect.Float64),
 	"float32be": bpl.Float32be,
 	"float64be": bpl.Float64be,
+	"bit":       bpl.Bit,
+	"ue":        bpl.Ue,
+	"se":        bpl.Se,
+	"uvarint":   bpl.Uvarint,
+	"varint":    bpl.Varint,
+	"zigzag32":  bpl.Zigzag32,
+	"zigzag64":  bpl.Zigzag64,
+	"vlq":       bpl.VLQ,
+	"mqttlen":   bpl.MQTTLen,
 	"cstring":   bpl.CString,
+	"latin1":    &bpl.Text{Enc: bpl.TextEncodings["latin1"]},
+	"utf16":     &bpl.Text{Enc: bpl.TextEncodings["utf16"]},
+	"utf16le":   &bpl.Text{Enc: bpl.TextEncodings["utf16le"]},
+	"utf16be":   &bpl.Text{Enc: bpl.TextEncodings["utf16be"]},
+	"gbk":       &bpl.Text{Enc: bpl.TextEncodings["gbk"]},
+	"gb18030":   &bpl.Text{Enc: bpl.TextEncodings["gb18030"]},
+	"shiftjis":  &bpl.Text{Enc: bpl.TextEncodings["shiftjis"]},
 	"nil":       bpl.Nil,
 	"eof":       bpl.EOF,
 	"done":      bpl.Done,
@@ -271,4 +386,8 @@ var builtins = map[string]bpl.Ruler{
 	"dump":      dump(0),
 }
 
+var funcTypes = map[string]func(n int) bpl.Ruler{
+	"bits": bpl.Bits,
+}
+
 // -----------------------------------------------------------------------------
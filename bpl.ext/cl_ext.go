@@ -1,8 +1,11 @@
 package bpl
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -15,22 +18,85 @@ import (
 
 func (p *Compiler) eval(ctx *bpl.Context, start, end int) interface{} {
 
-	vars, hasDom := ctx.Dom().(map[string]interface{})
+	vars, hasDom := ctx.Dom().(*bpl.Map)
 	if vars == nil {
-		vars = make(map[string]interface{})
+		vars = bpl.NewMap()
 	}
 	code := &p.code
 	stk := ctx.Stack
-	parent := exec.NewSimpleContext(ctx.Globals.Impl, nil, nil, nil)
-	ectx := exec.NewSimpleContext(vars, stk, code, parent)
+	var fns *exec.Context
+	if p.refersCtx(start, end) {
+		fns = exec.NewSimpleContext(map[string]interface{}{ctxKey: ctx}, nil, nil, nil)
+	}
+	parent := exec.NewSimpleContext(ctx.Globals.Impl, nil, nil, fns)
+	if env := ctx.Env(); env != nil { // arguments of template instances
+		parent = exec.NewSimpleContext(env, nil, nil, parent)
+	}
+	ectx := exec.NewSimpleContext(vars.Vals(), stk, code, parent)
 	code.Exec(start, end, stk, ectx)
-	if !hasDom && len(vars) > 0 { // update dom
+	if !hasDom && vars.Len() > 0 { // update dom
 		ctx.SetDom(vars)
 	}
 	v, _ := stk.Pop()
 	return v
 }
 
+// refersCtx returns if instructions in [start, end) refer ctxVars.
+//
+func (p *Compiler) refersCtx(start, end int) bool {
+
+	i := sort.SearchInts(p.ctxRefs, start)
+	return i < len(p.ctxRefs) && p.ctxRefs[i] < end
+}
+
+// ctxKey is the variable name of current bpl.Context, see iCtxVar.
+//
+const ctxKey = "$ctx"
+
+// ctxVars are variables about current matching state, eg. `_offset`. They are
+// evaluated only when they are referred.
+//
+var ctxVars = map[string]func(ctx *bpl.Context) interface{}{
+	"tell": func(ctx *bpl.Context) interface{} {
+		return func() int {
+			return int(ctx.Tell())
+		}
+	},
+	"_offset": func(ctx *bpl.Context) interface{} {
+		return int(ctx.Tell())
+	},
+	"_start": func(ctx *bpl.Context) interface{} {
+		return int(ctx.Start())
+	},
+	"_consumed": func(ctx *bpl.Context) interface{} {
+		return int(ctx.Consumed())
+	},
+	"_index": func(ctx *bpl.Context) interface{} {
+		return ctx.Index()
+	},
+	"_parent": func(ctx *bpl.Context) interface{} {
+		return ctx.ParentDom()
+	},
+	"_root": func(ctx *bpl.Context) interface{} {
+		return ctx.RootDom()
+	},
+}
+
+// iCtxVar refers a variable in ctxVars.
+//
+type iCtxVar struct {
+	fn func(ctx *bpl.Context) interface{}
+}
+
+var ctxRef = exec.Ref(ctxKey)
+
+func (p *iCtxVar) Exec(stk *exec.Stack, ctx *exec.Context) {
+
+	ctxRef.Exec(stk, ctx)
+	v, _ := stk.Pop()
+	stk.Push(p.fn(v.(*bpl.Context)))
+}
+
 // -----------------------------------------------------------------------------
 
 type exprBlock struct {
@@ -101,6 +167,33 @@ func (p *Compiler) cases(lit string) {
 	p.gstk.Push(v)
 }
 
+func (p *Compiler) casec(name string) {
+
+	v, ok := p.constOf(name)
+	if !ok {
+		panic("case: constant `" + name + "` not found")
+	}
+	p.gstk.Push(v)
+}
+
+// constOf returns the value of a (qualified) constant, eg. `N`, `amf.N` or an
+// enum item `Kind.A`.
+//
+func (p *Compiler) constOf(name string) (v interface{}, ok bool) {
+
+	if pos := strings.IndexByte(name, '.'); pos >= 0 {
+		if items, ok := p.enums[name[:pos]]; ok {
+			v, ok = items[name[pos+1:]]
+			return v, ok
+		}
+	} else if enum, ok := p.items[name]; ok && enum == "" {
+		panic(fmt.Errorf("enum item `%s` is ambiguous, qualify it by its enum, eg. `<Enum>.%s`", name, name))
+	}
+	c, local := p.nsOf(name)
+	v, ok = c.consts[local]
+	return
+}
+
 func (p *Compiler) source(v interface{}) {
 
 	p.gstk.Push(v)
@@ -358,6 +451,109 @@ func (p *Compiler) fnRead() {
 	stk[i] = bpl.Read(n, stk[i].(bpl.Ruler))
 }
 
+func (p *Compiler) fnAt() {
+
+	e := p.popExpr()
+	stk := p.stk
+	i := len(stk) - 1
+	off := func(ctx *bpl.Context) int64 {
+		v := p.eval(ctx, e.start, e.end)
+		return int64(toInt(v, "at offset isn't an integer expression"))
+	}
+	stk[i] = bpl.At(off, stk[i].(bpl.Ruler))
+}
+
+func (p *Compiler) popCodec() bpl.Codec {
+
+	v, _ := p.gstk.Pop()
+	name := v.(string)
+	codec, ok := bpl.Codecs[name]
+	if !ok {
+		panic("decode: unknown codec `" + name + "`")
+	}
+	return codec
+}
+
+func (p *Compiler) fnDecode() {
+
+	e := p.popExpr()
+	codec := p.popCodec()
+	stk := p.stk
+	i := len(stk) - 1
+	n := func(ctx *bpl.Context) int {
+		v := p.eval(ctx, e.start, e.end)
+		return toInt(v, "decode bytes isn't an integer expression")
+	}
+	stk[i] = bpl.Decode(codec, n, stk[i].(bpl.Ruler))
+}
+
+func (p *Compiler) fnDecodeAll() {
+
+	codec := p.popCodec()
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Decode(codec, nil, stk[i].(bpl.Ruler))
+}
+
+func (p *Compiler) algo(name string) {
+
+	if _, ok := bpl.Checksums[name]; !ok {
+		panic("checksum: unknown algorithm `" + name + "`")
+	}
+	p.gstk.Push(name)
+}
+
+func (p *Compiler) fnChecksum() {
+
+	e := p.popExpr()
+	algo, _ := p.gstk.Pop()
+	stk := p.stk
+	i := len(stk) - 1
+	expect := func(ctx *bpl.Context) uint64 {
+		v := p.eval(ctx, e.start, e.end)
+		return uint64(toInt(v, "checksum expect isn't an integer expression"))
+	}
+	stk[i] = bpl.Checksum(algo.(string), stk[i].(bpl.Ruler), expect)
+}
+
+func toPattern(v interface{}) []byte {
+
+	switch val := v.(type) {
+	case string:
+		return []byte(val)
+	case []byte:
+		return val
+	}
+	if c, ok := castInt(v); ok {
+		return []byte{byte(c)}
+	}
+	panic("pattern isn't a string, []byte or byte expression")
+}
+
+func (p *Compiler) fnRecover() {
+
+	e := p.popExpr()
+	period := 0
+	if p.popArity() != 0 {
+		period = p.popConstInt()
+	}
+	var sync bpl.SyncFunc
+	if e.end-e.start == 1 {
+		if v, ok := p.code.CheckConst(e.start); ok {
+			sync = bpl.SyncPattern(toPattern(v), period)
+		}
+	}
+	if sync == nil {
+		sync = func(in *bufio.Reader, ctx *bpl.Context) (bool, error) {
+			v := p.eval(ctx, e.start, e.end)
+			return bpl.SyncPattern(toPattern(v), period)(in, ctx)
+		}
+	}
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Sync(sync, stk[i].(bpl.Ruler))
+}
+
 func (p *Compiler) fnSkip() {
 
 	e := p.popExpr()
@@ -397,3 +593,313 @@ func (p *Compiler) gostruct() {
 }
 
 // -----------------------------------------------------------------------------
+
+func (p *Compiler) enumkind(kind string) {
+
+	if kind != "enum" && kind != "flags" {
+		panic("unknown declaration `" + kind + "`, require `enum` or `flags`")
+	}
+	p.gstk.Push(kind)
+}
+
+// enumItems are values of items of an enum, by item name.
+//
+type enumItems = map[string]interface{}
+
+// enumVal converts the value of an enum item to uint64.
+//
+func enumVal(v interface{}) (uint64, bool) {
+
+	switch val := v.(type) {
+	case int:
+		return uint64(val), val >= 0
+	case int64:
+		return uint64(val), val >= 0
+	case uint:
+		return uint64(val), true
+	case uint64:
+		return val, true
+	}
+	return 0, false
+}
+
+func (p *Compiler) fnEnum() {
+
+	arity := p.popArity()
+	vals := p.gstk.PopNArgs(arity)
+	kind, _ := p.gstk.Pop()
+	stk := p.stk
+	n := len(stk) - arity
+	name := stk[n-2].(string)
+	e := &bpl.Enum{Name: name, Base: stk[n-1].(bpl.Ruler), Flags: kind == "flags"}
+	items := make(enumItems, len(vals))
+	for i, v := range vals {
+		item := bpl.EnumItem{Name: stk[n+i].(string)}
+		val, ok := enumVal(v)
+		if !ok {
+			panic(fmt.Errorf("%s %s: value of `%s` isn't a non-negative integer: %v", kind, name, item.Name, v))
+		}
+		item.Val = val
+		if _, ok := items[item.Name]; ok {
+			panic(fmt.Errorf("%s %s: item `%s` exists", kind, name, item.Name))
+		}
+		items[item.Name] = v
+		e.Items = append(e.Items, item)
+		if _, ok := p.items[item.Name]; ok { // an item of another enum, it must be qualified then
+			p.items[item.Name] = ""
+			delete(p.consts, item.Name)
+		} else if _, ok := p.consts[item.Name]; ok {
+			panic(fmt.Errorf("%s %s: constant `%s` exists", kind, name, item.Name))
+		} else {
+			p.items[item.Name] = name
+			p.consts[item.Name] = v
+		}
+	}
+	p.enums[name] = items
+	p.stk = append(stk[:0], e)
+	p.assign(name)
+}
+
+// -----------------------------------------------------------------------------
+
+// byteOrders are names of byte orders. `MM` and `II` are how TIFF files mark
+// their byte orders.
+//
+var byteOrders = map[string]binary.ByteOrder{
+	"big":    binary.BigEndian,
+	"be":     binary.BigEndian,
+	"MM":     binary.BigEndian,
+	"little": binary.LittleEndian,
+	"le":     binary.LittleEndian,
+	"II":     binary.LittleEndian,
+}
+
+func byteOrder(name string) binary.ByteOrder {
+
+	order, ok := byteOrders[name]
+	if !ok {
+		panic("unknown byte order `" + name + "`, require `big` or `little`")
+	}
+	return order
+}
+
+// toByteOrder converts value of `endian <expr>` to a byte order: it is a name
+// of byte order, or a boolean (true means big endian).
+//
+func toByteOrder(v interface{}) binary.ByteOrder {
+
+	switch val := v.(type) {
+	case string:
+		return byteOrder(val)
+	case bool:
+		if val {
+			return binary.BigEndian
+		}
+		return binary.LittleEndian
+	}
+	panic(fmt.Errorf("endian <expr>: `%v` isn't a byte order", v))
+}
+
+// fileEndian is the file-level `endian big|little` directive.
+//
+func (p *Compiler) fileEndian(name string) {
+
+	if p.order != nil {
+		panic("endian: byte order of the file is set already")
+	}
+	p.order = byteOrder(name)
+}
+
+// withOrder returns r which matches in byte order of the file (if it is set).
+//
+func (p *Compiler) withOrder(r bpl.Ruler) bpl.Ruler {
+
+	order := p.order
+	if order == nil {
+		return r
+	}
+	return bpl.Endian(func(ctx *bpl.Context) binary.ByteOrder {
+		return order
+	}, r)
+}
+
+// fnEndian is the `endian big|little` directive in a struct.
+//
+func (p *Compiler) fnEndian(name string) {
+
+	order := byteOrder(name)
+	fn := func(ctx *bpl.Context) error {
+		ctx.SetByteOrder(order)
+		return nil
+	}
+	p.stk = append(p.stk, bpl.Do(fn))
+}
+
+func (p *Compiler) fnEndianDo() {
+
+	e := p.popExpr()
+	stk := p.stk
+	i := len(stk) - 1
+	order := func(ctx *bpl.Context) binary.ByteOrder {
+		return toByteOrder(p.eval(ctx, e.start, e.end))
+	}
+	stk[i] = bpl.Endian(order, stk[i].(bpl.Ruler))
+}
+
+// -----------------------------------------------------------------------------
+
+// textOf returns the encoding of a string type, eg. `cstring` or `utf16le`.
+//
+func textOf(name string) (enc *bpl.TextEncoding, ok bool) {
+
+	if name == "cstring" {
+		return nil, true
+	}
+	if t, ok := builtins[name].(*bpl.Text); ok {
+		return t.Enc, true
+	}
+	return
+}
+
+// textArray compiles a fixed-width string, eg. `cstring(32)` or `utf16le(n)`.
+//
+func (p *Compiler) textArray(enc *bpl.TextEncoding, e *exprBlock) bpl.Ruler {
+
+	if v, ok := p.code.CheckConst(e.start); ok && e.end-e.start == 1 {
+		return bpl.TextArray(enc, toInt(v, "string width isn't an integer"))
+	}
+	n := func(ctx *bpl.Context) int {
+		v := p.eval(scopeOf(ctx), e.start, e.end)
+		return toInt(v, "string width isn't an integer expression")
+	}
+	return bpl.TextDynarray(enc, n)
+}
+
+// pstringOf returns `pstring(T [, encoding])`, a string prefixed with its
+// length (matched by T), eg. `pstring(uint8)` or `pstring(uint16be, utf16be)`.
+//
+func pstringOf(args []interface{}) (bpl.Ruler, error) {
+
+	n, ok := args[0].(bpl.Ruler)
+	if !ok {
+		return nil, fmt.Errorf("pstring: length type `%v` isn't a rule", args[0])
+	}
+	var enc *bpl.TextEncoding
+	if len(args) > 1 {
+		t, ok := args[1].(*bpl.Text)
+		if !ok && args[1] != bpl.CString {
+			return nil, fmt.Errorf("pstring: `%v` isn't a string type", args[1])
+		}
+		if ok {
+			enc = t.Enc
+		}
+	}
+	return bpl.PString(n, enc), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// elemScope returns a Context to evaluate the condition of `R until <cond>` for
+// an element `v`: members of `v` (if it's a struct) and `_elem` (v itself) are
+// visible.
+//
+func elemScope(ctx *bpl.Context, v interface{}) *bpl.Context {
+
+	vars := bpl.NewMap()
+	if dom, ok := v.(*bpl.Map); ok {
+		for _, k := range dom.Keys() {
+			val, _ := dom.Get(k)
+			vars.Set(k, val)
+		}
+	}
+	vars.Set("_elem", v)
+	sub := ctx.NewSub()
+	sub.SetDom(vars)
+	return sub
+}
+
+func (p *Compiler) elemCond(e *exprBlock, not bool) func(ctx *bpl.Context, v interface{}) bool {
+
+	return func(ctx *bpl.Context, v interface{}) bool {
+		val := p.eval(elemScope(ctx, v), e.start, e.end)
+		return toBool(val, "until/while condition isn't a boolean expression") != not
+	}
+}
+
+func (p *Compiler) fnUntil() {
+
+	e := p.popExpr()
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Until(stk[i].(bpl.Ruler), p.elemCond(e, false), true)
+}
+
+func (p *Compiler) fnWhile() {
+
+	e := p.popExpr()
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Until(stk[i].(bpl.Ruler), p.elemCond(e, true), false)
+}
+
+func (p *Compiler) untilPattern(inclusive bool) {
+
+	e := p.popExpr()
+	var pattern func(ctx *bpl.Context) []byte
+	if e.end-e.start == 1 {
+		if v, ok := p.code.CheckConst(e.start); ok {
+			b := toPattern(v)
+			pattern = func(ctx *bpl.Context) []byte {
+				return b
+			}
+		}
+	}
+	if pattern == nil {
+		pattern = func(ctx *bpl.Context) []byte {
+			return toPattern(p.eval(scopeOf(ctx), e.start, e.end))
+		}
+	}
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.UntilPattern(stk[i].(bpl.Ruler), pattern, inclusive)
+}
+
+func (p *Compiler) fnUntilAt() {
+
+	p.untilPattern(false)
+}
+
+func (p *Compiler) fnUntilSkip() {
+
+	p.untilPattern(true)
+}
+
+// -----------------------------------------------------------------------------
+
+func (p *Compiler) padding(fn func(n func(ctx *bpl.Context) int, fill int) bpl.Ruler) {
+
+	e := p.popExpr()
+	fill := -1
+	if p.popArity() != 0 {
+		if fill = p.popConstInt(); fill > 0xff {
+			panic(fmt.Errorf("padding byte %d is out of range", fill))
+		}
+	}
+	n := func(ctx *bpl.Context) int {
+		v := p.eval(ctx, e.start, e.end)
+		return toInt(v, "alignment isn't an integer expression")
+	}
+	p.stk = append(p.stk, fn(n, fill))
+}
+
+func (p *Compiler) fnAlign() {
+
+	p.padding(bpl.Align)
+}
+
+func (p *Compiler) fnPadTo() {
+
+	p.padding(bpl.PadTo)
+}
+
+// -----------------------------------------------------------------------------
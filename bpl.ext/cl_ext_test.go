@@ -1,9 +1,21 @@
 package bpl
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/goplus/bpl"
 	"github.com/goplus/bpl/binary"
 	"github.com/qiniu/x/bufiox"
 )
@@ -155,7 +167,7 @@ func TestArray2(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `[2,{"array":["hello","world","bpl"],"h":{"m":2,"n":1,"type":1}},{"array":["foo","bar"],"h":{"m":1,"n":1,"type":2}}]` {
+	if string(ret) != `[2,{"h":{"type":1,"n":1,"m":2},"array":["hello","world","bpl"]},{"h":{"type":2,"n":1,"m":1},"array":["foo","bar"]}]` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -227,7 +239,7 @@ func TestCase(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `[2,{"h":{"m":2,"n":1,"type":1},"t1":["hello","world","bpl"]},{"h":{"m":1,"n":1,"type":2},"t2":["foo","bar"]}]` {
+	if string(ret) != `[2,{"h":{"type":1,"n":1,"m":2},"t1":["hello","world","bpl"]},{"h":{"type":2,"n":1,"m":1},"t2":["foo","bar"]}]` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -303,7 +315,7 @@ func TestCase2(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `[2,{"h":{"m":2,"n":1,"type":1},"t1":["hello","world","bpl"]},{"h":{"m":1,"n":1,"type":2},"t2":["foo","bar"]}]` {
+	if string(ret) != `[2,{"h":{"type":1,"n":1,"m":2},"t1":["hello","world","bpl"]},{"h":{"type":2,"n":1,"m":1},"t2":["foo","bar"]}]` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -377,7 +389,7 @@ func TestRead(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `[2,{"h":{"len":32,"type":1},"t1":["hello","world"]},{"h":{"len":24,"type":2},"t2":["foo"]}]` {
+	if string(ret) != `[2,{"h":{"type":1,"len":32},"t1":["hello","world"]},{"h":{"type":2,"len":24},"t2":["foo"]}]` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -453,7 +465,7 @@ func TestIf(t *testing.T) {
 	if err != nil {
 		t.Fatal("json.Marshal failed:", err)
 	}
-	if string(ret) != `[2,{"h":{"len":32,"type":1},"t1":["hello","world"]},{"h":{"len":24,"type":2},"t2":["foo"]}]` {
+	if string(ret) != `[2,{"h":{"type":1,"len":32},"t1":["hello","world"]},{"h":{"type":2,"len":24},"t2":["foo"]}]` {
 		t.Fatal("ret:", string(ret))
 	}
 }
@@ -713,3 +725,1263 @@ func TestUnset(t *testing.T) {
 }
 
 // -----------------------------------------------------------------------------
+
+const codeBits = `
+
+header = {
+	sync     uint8
+	tei      bit
+	pusi     bit
+	priority bit
+	pid      bits(13)
+	scramble bits(2)
+	adapt    bits(2)
+	counter  bits(4)
+}
+
+cheader = {/C
+	bits(4) version;
+	bits(4) ihl;
+	uint8   tos;
+	ue      n;
+	se      delta;
+}
+
+doc = [header cheader]
+`
+
+func TestBits(t *testing.T) {
+
+	b := []byte{0x47, 0x40, 0x11, 0x1a, 0x45, 0x10, 0x4c}
+
+	r, err := NewFromString(codeBits, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `[{"sync":71,"tei":0,"pusi":1,"priority":0,"pid":17,"scramble":0,"adapt":1,"counter":10},{"version":4,"ihl":5,"tos":16,"n":1,"delta":-1}]` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeAlt = `
+
+tagA = {
+	tag uint8
+	assert tag == 1
+	a   uint16
+}
+
+tagB = {
+	tag uint8
+	assert tag == 2
+	b   cstring
+}
+
+item = tagA | tagB | {unknown uint8}
+
+doc = {
+	let n = 1
+	assert false
+} | {
+	items *item
+	let m = 2
+}
+`
+
+func TestAlt(t *testing.T) {
+
+	b := []byte{1, 3, 0, 2, 'b', 'p', 'l', 0, 3}
+
+	r, err := NewFromString(codeAlt, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"items":[{"tag":1,"a":3},{"tag":2,"b":"bpl"},{"unknown":3}],"m":2}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeAt = `
+
+entry = {
+	off uint8
+	n   uint8
+	at off do {
+		name [n]char
+	}
+}
+
+doc = {
+	count   uint8
+	entries [count]entry
+	let pos = tell()
+	skip 2
+	tail uint8
+}
+`
+
+func TestAt(t *testing.T) {
+
+	b := []byte{2, 8, 3, 11, 2, 0xaa, 0xbb, 0x42, 'b', 'p', 'l', 'g', 'o'}
+
+	r, err := NewFromString(codeAt, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"count":2,"entries":[{"off":8,"n":3,"name":"bpl"},{"off":11,"n":2,"name":"go"}],"pos":5,"tail":66}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeMarshalDOM = `
+
+item1 = {
+	a uint16le
+}
+
+item2 = {
+	n uint8
+	b [n]char
+	let n = len(b)
+}
+
+item = {
+	tag uint8
+	case tag {
+		1: item1
+		2: item2
+	}
+}
+
+doc = {
+	size  uint32le
+	count uint8
+	items [count]item
+	if count > 1 {
+		extra uint8
+	}
+	let size = count + 5
+}
+`
+
+func TestMarshalDOM(t *testing.T) {
+
+	r, err := NewFromString(codeMarshalDOM, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	SetCaseType = false
+	var dom interface{}
+	err = json.Unmarshal([]byte(`{"count":2,"items":[{"a":3,"tag":1},{"b":"bpl","tag":2}],"extra":7}`), &dom)
+	if err != nil {
+		t.Fatal("json.Unmarshal failed:", err)
+	}
+	b, err := r.MarshalDOM(dom)
+	if err != nil {
+		t.Fatal("MarshalDOM failed:", err)
+	}
+	if !bytes.Equal(b, []byte{7, 0, 0, 0, 2, 1, 3, 0, 2, 3, 'b', 'p', 'l', 7}) {
+		t.Fatal("MarshalDOM:", b)
+	}
+
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"size":7,"count":2,"items":[{"tag":1,"a":3},{"tag":2,"n":3,"b":"bpl"}],"extra":7}` {
+		t.Fatal("ret:", string(ret))
+	}
+	if b2, err := r.MarshalDOM(v); err != nil || !bytes.Equal(b2, b) {
+		t.Fatal("MarshalDOM(Match):", b2, err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeVarint = `
+
+doc = {
+	n     uvarint
+	items [n]zigzag32
+	len   mqttlen
+	data  [len]byte
+	delta vlq
+}
+`
+
+func TestVarint(t *testing.T) {
+
+	b := []byte{2, 0x03, 0x04, 0x02, 'h', 'i', 0x81, 0x00}
+
+	r, err := NewFromString(codeVarint, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"n":2,"items":[-2,2],"len":2,"data":"aGk=","delta":128}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeDecode = `
+
+body = {
+	n    uint8
+	name [n]char
+}
+
+doc = {
+	len uint16le
+	decode "gzip" len do {
+		zip body
+	}
+	decode "deflate" do {
+		rest *uint8
+	}
+}
+`
+
+func TestDecode(t *testing.T) {
+
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	zw.Write([]byte{3, 'b', 'p', 'l'})
+	zw.Close()
+
+	var fb bytes.Buffer
+	fw, _ := flate.NewWriter(&fb, flate.BestCompression)
+	fw.Write([]byte{1, 1, 1, 1, 1})
+	fw.Close()
+
+	b := []byte{byte(zb.Len()), byte(zb.Len() >> 8)}
+	b = append(b, zb.Bytes()...)
+	b = append(b, fb.Bytes()...)
+
+	r, err := NewFromString(codeDecode, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"len":`+strconv.Itoa(zb.Len())+`,"zip":{"n":3,"name":"bpl"},"rest":"AQEBAQE="}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeChecksum = `
+
+chunk = {
+	length uint32be
+	checksum crc32 over {
+		type [4]char
+		data [length]byte
+	} expect crc
+	crc uint32be
+	let sum = adler32(data)
+}
+
+doc = {
+	chunk chunk
+}
+`
+
+func TestChecksum(t *testing.T) {
+
+	b := []byte{0, 0, 0, 3, 'I', 'D', 'A', 'T', 1, 2, 3}
+	crc := crc32.ChecksumIEEE(b[4:])
+	b = append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	r, err := NewFromString(codeChecksum, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"chunk":{"length":3,"type":"IDAT","data":"AQID","crc":`+strconv.Itoa(int(crc))+`,"sum":851975}}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	b[8] = 0
+	_, err = r.MatchBuffer(b)
+	if err == nil || !strings.Contains(err.Error(), "checksum crc32 mismatch") {
+		t.Fatal("Match:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeRecords = `
+
+record = {
+	n    uint8
+	data [n]char
+}
+
+doc = {
+	magic   uint8
+	records *record
+}
+`
+
+func TestRecords(t *testing.T) {
+
+	b := []byte{0xff, 2, 'h', 'i', 3, 'b', 'p', 'l', 0}
+
+	r, err := NewFromString(codeRecords, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var records []string
+	rs := r.Records(bytes.NewReader(b))
+	defer rs.Close()
+	for rs.Next() {
+		records = append(records, rs.Record().(*bpl.Map).Vals()["data"].(string))
+	}
+	if err = rs.Err(); err != nil {
+		t.Fatal("Records failed:", err)
+	}
+	if strings.Join(records, ",") != "hi,bpl," {
+		t.Fatal("records:", records)
+	}
+	ret, err := json.Marshal(rs.Dom())
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"magic":255,"records":null}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	rs = r.Records(bytes.NewReader(b))
+	if !rs.Next() {
+		t.Fatal("Records.Next failed:", rs.Err())
+	}
+	rs.Close()
+	if rs.Err() != ErrRecordsClosed {
+		t.Fatal("Records.Err:", rs.Err())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeRecover = `
+
+packet = {
+	sync uint8
+	assert sync == 0x47
+	data [3]char
+}
+
+item = recover 0x47 every 4 do packet
+
+doc = {
+	packets *item
+}
+`
+
+func TestRecover(t *testing.T) {
+
+	b := []byte("GabcX12GGdefGghi")
+
+	r, err := NewFromString(codeRecover, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	packets := v.(*bpl.Map).Vals()["packets"].([]interface{})
+	if len(packets) != 4 {
+		t.Fatal("packets:", packets)
+	}
+	var data []string
+	for _, pkt := range packets {
+		if d, ok := pkt.(*bpl.Map).Vals()["data"]; ok {
+			data = append(data, d.(string))
+		}
+	}
+	if strings.Join(data, ",") != "abc,def,ghi" {
+		t.Fatal("data:", data)
+	}
+	bad := packets[1].(*bpl.Map).Vals()
+	if bad["_offset"] != int64(4) || bad["_skipped"] != 3 || !strings.Contains(bad["_error"].(string), "assert") {
+		t.Fatal("bad packet:", bad)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func TestPartial(t *testing.T) {
+
+	b := []byte{0xff, 2, 'h', 'i', 3, 'b', 'p'}
+
+	r, err := NewFromString(codeRecords, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if _, ok := err.(*bpl.PartialError); !ok {
+		t.Fatal("Match:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"magic":255,"records":[{"n":2,"data":"hi"},{"n":3,"data":"bp"}]}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	rs := r.Records(bytes.NewReader(b))
+	for rs.Next() {
+	}
+	ret, _ = json.Marshal(rs.Dom())
+	if rs.Err() == nil || string(ret) != `{"magic":255,"records":{"n":3,"data":"bp"}}` {
+		t.Fatal("Records:", rs.Err(), string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeMatchError = `
+
+Query = {
+	flags uint32
+	query cstring
+	n     uint8
+	assert n < 10
+}
+
+Message = {
+	opCode uint8
+	case opCode {
+		1: {body Query}
+	}
+}
+
+doc = {
+	magic uint8
+	msgs  *Message
+}
+`
+
+func TestMatchError(t *testing.T) {
+
+	b := []byte{0xff, 1, 0, 0, 0, 0, 'a', 0, 1, 1, 0, 0, 0, 0, 'b', 0, 20}
+
+	r, err := NewFromString(codeMatchError, "test.bpl")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	_, err = r.MatchBuffer(b)
+	var e *bpl.MatchError
+	if !errors.As(err, &e) {
+		t.Fatal("Match:", err)
+	}
+	if e.Path != "doc/msgs/Message[1]/body/Query" || e.Offset != 17 || e.File != "test.bpl" || e.Line != 7 {
+		t.Fatal("MatchError:", e.Path, e.Offset, e.File, e.Line)
+	}
+	if !bytes.Equal(e.Window, b[1:]) || e.WindowOffset != 1 {
+		t.Fatal("MatchError.Window:", e.Window, e.WindowOffset)
+	}
+	if !strings.HasPrefix(err.Error(), "test.bpl:7: doc/msgs/Message[1]/body/Query: offset 17 (0x11): ") {
+		t.Fatal("MatchError.Error:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codePosition = `
+Item = {
+	len uint8
+	tag uint8
+	let idx = _index
+	let start = _start
+	let pos = _offset
+	let magic = _root.magic
+	let ver = _parent.ver
+	skip len - _consumed
+}
+
+doc = {
+	magic uint8
+	ver   uint8
+	items *Item
+}
+`
+
+func TestPosition(t *testing.T) {
+
+	b := []byte{0xaa, 7, 4, 1, 0, 0, 3, 2, 0}
+
+	r, err := NewFromString(codePosition, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	items := v.(*bpl.Map).Vals()["items"].([]interface{})
+	if len(items) != 2 {
+		t.Fatal("items:", items)
+	}
+	for i, start := range []int{2, 6} {
+		item := items[i].(*bpl.Map).Vals()
+		if item["idx"] != i || item["start"] != start || item["pos"] != start+2 ||
+			item["magic"] != uint8(0xaa) || item["ver"] != uint8(7) {
+			t.Fatal("item:", i, item)
+		}
+	}
+
+	// bodies of if and case are matched in the Context of the enclosing struct
+	for _, code := range []string{
+		"doc = { a uint8; if a == 1 { b uint8 }; let c = _consumed; let s = _start }",
+		"doc = { a uint8; case a { 1: { b uint8 }; default: nil }; let c = _consumed; let s = _start }",
+	} {
+		r, err = NewFromString(code, "")
+		if err != nil {
+			t.Fatal("New failed:", err)
+		}
+		v, err = r.MatchBuffer([]byte{1, 2, 3})
+		if err != nil {
+			t.Fatal("Match failed:", err)
+		}
+		if vars := v.(*bpl.Map).Vals(); vars["c"] != 2 || vars["s"] != 0 {
+			t.Fatal("position:", code, vars)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeSpan = `
+Item = {
+	len  uint8
+	data [len]byte
+}
+
+doc = {
+	magic uint32
+	items *Item
+}
+`
+
+func TestSpan(t *testing.T) {
+
+	b := []byte{1, 2, 3, 4, 2, 'a', 'b', 1, 'c'}
+
+	r, err := NewFromString(codeSpan, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, span, err := r.MatchWithSpan(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if span.Offset != 0 || span.Length != 9 || span.Rule != "doc" {
+		t.Fatal("span:", *span)
+	}
+	items := span.Member("items")
+	if len(items.Elems) != 2 {
+		t.Fatal("items:", *items)
+	}
+	item := items.Elems[1]
+	if item.Offset != 7 || item.Length != 2 || item.Rule != "Item" {
+		t.Fatal("items[1]:", *item)
+	}
+	if data := item.Member("data"); data.Offset != 8 || data.Length != 1 {
+		t.Fatal("items[1].data:", *data)
+	}
+
+	var w bytes.Buffer
+	DumpDomWithSpan(&w, v, span, 0)
+	if !strings.HasPrefix(w.String(), "<@0+9 doc> {\n  magic: <@0+4> 67305985\n  items: <@4+5> [\n    <@4+3 Item> {\n      len: <@4+1> 2\n      data: <@5+2> \n") {
+		t.Fatal("DumpDomWithSpan:", w.String())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeOrder = `
+Header = {
+	size uint8
+	kind uint8
+}
+
+doc = {
+	hdr   Header
+	let k = hdr["kind"] + hdr.size
+	zeta  uint8
+	alpha uint8
+}
+`
+
+func TestOrder(t *testing.T) {
+
+	r, err := NewFromString(codeOrder, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var b bytes.Buffer
+	DumpDom(&b, v, 0)
+	if b.String() != "{\n  hdr: {\n    size: 1\n    kind: 2\n  }\n  k: 3\n  zeta: 3\n  alpha: 4\n}" {
+		t.Fatal("DumpDom:", b.String())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeEnum = `
+enum Kind uint8 {
+	A = 1
+	B = 2
+}
+
+flags Attr uint16be {
+	READONLY = 0x1; HIDDEN = 0x4
+}
+
+doc = {
+	kind  Kind
+	attr  Attr
+	kinds [2]Kind
+	if kind == B && kinds[1] == A {
+		let ok = 1
+	}
+	let hidden = attr & HIDDEN
+	case kind {
+		A: {a uint8}
+		2: {b uint8}
+	}
+	last Attr
+}
+`
+
+func TestEnum(t *testing.T) {
+
+	SetCaseType = false
+	r, err := NewFromString(codeEnum, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer([]byte{2, 0, 5, 2, 1, 9, 0, 0x12})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var b bytes.Buffer
+	DumpDom(&b, v, 0)
+	if b.String() != "{\n  kind: 2 (B)\n  attr: 0x5 (READONLY|HIDDEN)\n  kinds: [\n    2 (B),\n    1 (A),\n  ]\n  ok: 1\n  hidden: 4\n  b: 9\n  last: 0x12\n}" {
+		t.Fatal("DumpDom:", b.String())
+	}
+	text, err := json.Marshal(v)
+	if err != nil || string(text) != `{"kind":2,"attr":5,"kinds":[2,1],"ok":1,"hidden":4,"b":9,"last":18}` {
+		t.Fatal("json.Marshal:", string(text), err)
+	}
+	if kind, _ := v.(*bpl.Map).Get("kind"); kind.(bpl.EnumValue).Name() != "B" {
+		t.Fatal("kind:", kind)
+	}
+
+	// items of different enums can have the same name, they are qualified then
+	code := "enum K uint8 { None = 1; B = 3 }\nflags F uint8 { None = 2 }\n" +
+		"doc = { k K; f F; let a = k == K.None && f == F.None; let b = k == B; case k { K.None: {x uint8}; default: nil } }"
+	r, err = NewFromString(code, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{1, 2, 7})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if text, _ = json.Marshal(v); string(text) != `{"k":1,"f":2,"a":true,"b":false,"x":7}` {
+		t.Fatal("json.Marshal:", string(text))
+	}
+	for _, code := range []string{
+		"enum K uint8 { A = 1 }\nflags F uint8 { A = 2 }\ndoc = { k K; let a = k == A }",
+		"enum K uint8 { A = 1 }\nflags F uint8 { A = 2 }\ndoc = { k K; case k { A: nil } }",
+		"enum K uint8 { A = 1; A = 2 }\ndoc = K",
+		"const (\n\tA = 1;\n);\nenum K uint8 { A = 1 }\ndoc = K",
+	} {
+		if _, err = NewFromString(code, ""); err == nil {
+			t.Fatal("NewFromString: no error -", code)
+		}
+	}
+	if _, ok := enumVal(-1); ok {
+		t.Fatal("enumVal: negative value accepted")
+	}
+	if _, ok := enumVal("1"); ok {
+		t.Fatal("enumVal: string value accepted")
+	}
+	if val, ok := enumVal(uint64(1 << 63)); !ok || val != 1<<63 {
+		t.Fatal("enumVal:", val, ok)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeTemplate = `
+lpstring(T) = {
+	n T
+	s [n]char
+	return s
+}
+
+box(kind, Body) = {
+	size uint8
+	typ  [4]char
+	assert typ == kind
+	body Body
+}
+
+pair(A, B) = [A B]
+
+Item = {
+	a uint8
+}
+
+doc = {
+	n     uint8
+	name  lpstring(uint16be)
+	tags  [n]lpstring(uint8)
+	hdr   box("hdr ", pair(lpstring(uint8), Item))
+	x     bits(3)
+}
+`
+
+func TestTemplate(t *testing.T) {
+
+	r, err := NewFromString(codeTemplate, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{
+		2, 0, 2, 'h', 'i', 1, 'a', 2, 'b', 'c',
+		9, 'h', 'd', 'r', ' ', 1, 'x', 7, 0xe0,
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"n":2,"name":"hi","tags":["a","bc"],"hdr":{"size":9,"typ":"hdr ","body":["x",{"a":7}]},"x":7}` {
+		t.Fatal("ret:", string(text))
+	}
+
+	_, err = r.MatchBuffer([]byte{0, 0, 0, 9, 'b', 'o', 'x', ' '})
+	if err == nil || !strings.Contains(err.Error(), "typ == kind") {
+		t.Fatal("Match:", err)
+	}
+
+	r, err = NewFromString("lpstring(T) = {n T; s [n]char; return s}\ndoc = {/C; lpstring(uint8) a; lpstring(uint8)[2] b}", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{1, 'a', 1, 'b', 2, 'c', 'd'})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if text, _ = json.Marshal(v); string(text) != `{"a":"a","b":["b","cd"]}` {
+		t.Fatal("ret:", string(text))
+	}
+
+	for _, code := range []string{
+		"f(T) = T\ndoc = f(uint8, uint8)",
+		"doc = g(uint8)",
+		"f(T) = T\nf(T) = T\ndoc = f(uint8)",
+	} {
+		if _, err = NewFromString(code, ""); err == nil {
+			t.Fatal("NewFromString: no error -", code)
+		}
+	}
+
+	// arguments of a template are visible only to its body
+	r, err = NewFromString("Inner = {n uint8}\nbox(n) = {a [n]int8; inner Inner; m [n]int8}\ndoc = {x box(2); y box(1)}", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if text, _ = json.Marshal(v); string(text) != `{"x":{"a":[1,2],"inner":{"n":3},"m":[4,5]},"y":{"a":[6],"inner":{"n":7},"m":[8]}}` {
+		t.Fatal("ret:", string(text))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeImportLib = `
+const (
+	N = 2
+)
+
+enum Kind uint8 {
+	STR = 1
+	NUM = 2
+}
+
+Value = {
+	n uint8
+	s [n]char
+	return s
+}
+
+lpstring(T) = {
+	n T
+	s [n]char
+	return s
+}
+`
+
+const codeImport = `
+import "amf.bpl"
+import x "amf.bpl"
+
+CValue = {/C; amf.Value a}
+
+doc = {
+	k   amf.Kind
+	tag [amf.N]char
+	v   x.Value
+	w   amf.lpstring(uint16be)
+	assert k == amf.STR
+	case k {
+		amf.STR: {c uint8}
+		default: nil
+	}
+	l   CValue
+}
+`
+
+func TestImport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bpl")
+	if err != nil {
+		t.Fatal("TempDir failed:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"amf.bpl":      codeImportLib,
+		"main.bpl":     codeImport,
+		"a.bpl":        "import \"b.bpl\"\ndoc = b.doc",
+		"b.bpl":        "import \"a.bpl\"\ndoc = uint8",
+		"1935.bpl":     "import \"amf.bpl\"\ndoc = amf.Value",
+		"bad.bpl":      "import \"1935.bpl\"\ndoc = uint8",
+		"notfound.bpl": "import \"amf.bpl\"\ndoc = amf.Foo",
+	}
+	for name, code := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(code), 0666); err != nil {
+			t.Fatal("WriteFile failed:", err)
+		}
+	}
+
+	SetCaseType = false
+	r, err := NewFromFile(filepath.Join(dir, "main.bpl"))
+	if err != nil {
+		t.Fatal("NewFromFile failed:", err)
+	}
+	b := []byte{1, 'a', 'b', 1, 'v', 0, 2, 'w', 'w', 9, 1, 'l'}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"k":1,"tag":"ab","v":"v","w":"ww","c":9,"l":{"a":"l"}}` {
+		t.Fatal("ret:", string(text))
+	}
+
+	r, err = NewFromFile(filepath.Join(dir, "1935.bpl"))
+	if err != nil {
+		t.Fatal("NewFromFile failed:", err)
+	}
+	if v, err = r.MatchBuffer([]byte{1, 'x'}); err != nil || v != "x" {
+		t.Fatal("Match:", v, err)
+	}
+
+	for name, msg := range map[string]string{
+		"a.bpl":        "import cycle",
+		"bad.bpl":      "requires a namespace",
+		"notfound.bpl": "`amf.Foo` not found",
+	} {
+		_, err = NewFromFile(filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatal("NewFromFile:", name, err)
+		}
+	}
+	_, err = NewFromString("import \"nothing.bpl\"\ndoc = uint8", "")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatal("NewFromString:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeEndian = `
+Body = {
+	a uint16
+	b uint32
+	c uint16le
+}
+
+Tiff = {
+	order [2]char
+	endian order do Body
+	d uint16
+}
+
+Fixed = {
+	endian big
+	e uint16
+	f float32
+}
+
+doc = {
+	t1 Tiff
+	t2 Tiff
+	x  Fixed
+	g  uint16
+	endian g == 7 do {h uint16}
+}
+`
+
+func TestEndian(t *testing.T) {
+
+	r, err := NewFromString(codeEndian, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{
+		'M', 'M', 1, 2, 0, 0, 0, 3, 4, 0, 5, 0,
+		'I', 'I', 2, 1, 3, 0, 0, 0, 4, 0, 5, 0,
+		0, 6, 0x3f, 0x80, 0, 0,
+		7, 0, 0, 8,
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	tiff := `{"order":"%s","a":258,"b":3,"c":4,"d":5}`
+	if string(text) != `{"t1":`+fmt.Sprintf(tiff, "MM")+`,"t2":`+fmt.Sprintf(tiff, "II")+`,"x":{"e":6,"f":1},"g":7,"h":8}` {
+		t.Fatal("ret:", string(text))
+	}
+
+	r, err = NewFromString("endian big\ndoc = [uint16 uint16le]", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{1, 0, 1, 0})
+	if text, _ = json.Marshal(v); err != nil || string(text) != `[256,1]` {
+		t.Fatal("Match:", string(text), err)
+	}
+
+	for _, code := range []string{
+		"endian middle\ndoc = uint8",
+		"endian big\nendian little\ndoc = uint8",
+		"doc = {endian middle; a uint8}",
+	} {
+		if _, err = NewFromString(code, ""); err == nil {
+			t.Fatal("NewFromString: no error -", code)
+		}
+	}
+	r, err = NewFromString("doc = {a uint8; endian a do uint16}", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	if _, err = r.MatchBuffer([]byte{1, 0, 1}); err == nil || !strings.Contains(err.Error(), "isn't a byte order") {
+		t.Fatal("Match:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeText = `
+doc = {
+	a cstring(8)
+	b utf16le(6)
+	n uint8
+	c gbk(n)
+	d pstring(uint8)
+	e pstring(uint16be, utf16be)
+	f utf16
+	g latin1
+	h shiftjis
+	i [2]cstring
+}
+`
+
+func TestText(t *testing.T) {
+
+	r, err := NewFromString(codeText, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{
+		'h', 'i', 0, 0, 0, 0, 0, 0,
+		'o', 0, 'k', 0, 0, 0,
+		4, 0xd6, 0xd0, 0xce, 0xc4,
+		3, 'a', 'b', 'c',
+		0, 4, 0, 'x', 0, 'y',
+		0xfe, 0xff, 0, 'z', 0, 0,
+		0xe9, 0,
+		0x93, 0xfa, 0x96, 0x7b, 0,
+		'p', 0, 'q', 0,
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"a":"hi","b":"ok","n":4,"c":"中文","d":"abc","e":"xy","f":"z","g":"é","h":"日本","i":["p","q"]}` {
+		t.Fatal("ret:", string(text))
+	}
+	ret, err := r.MarshalDOM(v)
+	if err != nil {
+		t.Fatal("MarshalDOM failed:", err)
+	}
+	if !bytes.Equal(ret, b) {
+		t.Fatal("MarshalDOM:", ret)
+	}
+
+	for _, code := range []string{
+		"doc = cstring(1, 2)",
+		"doc = pstring(uint8, 2, 3)",
+		"cstring(n) = uint8\ndoc = uint8",
+	} {
+		if _, err = NewFromString(code, ""); err == nil {
+			t.Fatal("NewFromString: no error -", code)
+		}
+	}
+	r, err = NewFromString("doc = pstring(uint8, uint8)", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	if _, err = r.MatchBuffer([]byte{1, 'a'}); err == nil || !strings.Contains(err.Error(), "isn't a string type") {
+		t.Fatal("Match:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeUntil = `
+block = {
+	len  uint8
+	data [len]char
+}
+
+cblock = {/C; block until len == 0 blocks; int8 while _elem != 0 vals}
+
+doc = {
+	blocks block until len == 0
+	vals   int8 while _elem >= 0
+	tag    uint8
+	names  cstring until skip 0
+	items  uint16be until at "\xff\xff"
+	end    uint16be
+	cblock cblock
+	tail   int8 until _elem == 3
+}
+`
+
+func TestUntil(t *testing.T) {
+
+	r, err := NewFromString(codeUntil, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{
+		2, 'a', 'b', 0,
+		1, 2, 0x90,
+		'x', 0, 'y', 0, 0,
+		0, 1, 0, 2, 0xff, 0xff,
+		0, 1, 1, 0,
+		1, 2, 3,
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"blocks":[{"len":2,"data":"ab"},{"len":0,"data":""}],"vals":[1,2],"tag":144,"names":["x","y"],"items":[1,2],"end":65535,"cblock":{"blocks":[{"len":0,"data":""}],"vals":[1,1]},"tail":[0,1,2,3]}` {
+		t.Fatal("ret:", string(text))
+	}
+	ret, err := r.MarshalDOM(v)
+	if err != nil {
+		t.Fatal("MarshalDOM failed:", err)
+	}
+	if !bytes.Equal(ret, b) {
+		t.Fatal("MarshalDOM:", ret)
+	}
+
+	r, err = NewFromString("doc = int8 until skip 0xff", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{1, 2, 0xff})
+	if err != nil || fmt.Sprint(v) != "[1 2]" {
+		t.Fatal("Match:", v, err)
+	}
+	for _, in := range [][]byte{
+		{2, 'a', 'b', 1, 'c'},
+		{0, 1, 2, 'x', 0},
+	} {
+		if _, err = r.MatchBuffer(in); err == nil {
+			t.Fatal("Match: no error -", in)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codePadding = `
+hdr = {/C; uint8 tag; align 4, 0; uint32 size; pad to 12}
+
+body = read 4 do {
+	c uint8
+	align 2
+	d uint16
+}
+
+doc = {
+	h hdr
+	n uint8
+	b body
+	pad to 4
+}
+`
+
+func TestPadding(t *testing.T) {
+
+	r, err := NewFromString(codePadding, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{
+		1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0,
+		7,
+		3, 0, 5, 6,
+		0, 0, 0,
+	}
+	v, err := r.MatchBuffer(b)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(text) != `{"h":{"tag":1,"_pad0":3,"size":2,"_pad1":4},"n":7,"b":{"c":3,"_pad0":1,"d":1541},"_pad0":3}` {
+		t.Fatal("ret:", string(text))
+	}
+	ret, err := r.MarshalDOM(v)
+	if err != nil {
+		t.Fatal("MarshalDOM failed:", err)
+	}
+	if !bytes.Equal(ret, b) {
+		t.Fatal("MarshalDOM:", ret)
+	}
+
+	var w bytes.Buffer
+	DumpDom(&w, v, 0)
+	if !strings.Contains(w.String(), "    tag: 1\n    (3-byte padding)\n") {
+		t.Fatal("DumpDom:", w.String())
+	}
+
+	b[1] = 0xff
+	if _, err = r.MatchBuffer(b); err == nil {
+		t.Fatal("Match: no error")
+	}
+
+	// a conditional body doesn't move the start of the struct
+	r, err = NewFromString("Y = {a uint8; if a == 1 { b uint8 }; pad to 4; z uint8}\ndoc = {x uint8; y Y}", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err = r.MatchBuffer([]byte{9, 1, 2, 0, 0, 7})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if text, _ = json.Marshal(v); string(text) != `{"x":9,"y":{"a":1,"b":2,"_pad0":2,"z":7}}` {
+		t.Fatal("ret:", string(text))
+	}
+}
+
+// -----------------------------------------------------------------------------
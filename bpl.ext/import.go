@@ -0,0 +1,187 @@
+package bpl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FormatsDir is the directory where an imported file is searched for if it
+// isn't found in the directory of the importing file.
+//
+var FormatsDir = filepath.Join(os.Getenv("HOME"), ".qbpl", "formats")
+
+// -----------------------------------------------------------------------------
+
+// An importer compiles imported files. It is shared by a Compiler and the
+// Compilers of all files it imports (directly or indirectly), so that each file
+// is compiled only once.
+//
+type importer struct {
+	files   map[string]*Compiler // compiled files, by absolute path
+	loading []string             // files being compiled, to detect import cycles
+}
+
+func newImporter() *importer {
+
+	return &importer{files: make(map[string]*Compiler)}
+}
+
+func (p *importer) load(path string) (c *Compiler, err error) {
+
+	if c, ok := p.files[path]; ok {
+		return c, nil
+	}
+	for i, file := range p.loading {
+		if file == path {
+			cycle := append(p.loading[i:], path)
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	p.loading = append(p.loading, path)
+	defer func() {
+		p.loading = p.loading[:len(p.loading)-1]
+	}()
+
+	c = newCompiler()
+	c.imp = p
+	if err = c.compile(b, path); err != nil {
+		return
+	}
+	if err = c.check(); err != nil {
+		return
+	}
+	p.files[path] = c
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// findImport returns absolute path of an imported file. A relative path is
+// relative to the importing file, or FormatsDir.
+//
+func (p *Compiler) findImport(file string) (path string, err error) {
+
+	if filepath.IsAbs(file) {
+		return file, nil
+	}
+	for _, dir := range []string{filepath.Dir(p.fname), FormatsDir} {
+		path = filepath.Join(dir, file)
+		if _, err = os.Stat(path); err == nil {
+			return filepath.Abs(path)
+		}
+	}
+	return "", fmt.Errorf("import: file `%s` not found", file)
+}
+
+func (p *Compiler) importFile(name string, lit string) {
+
+	file, err := strconv.Unquote(lit)
+	if err != nil {
+		panic("invalid string `" + lit + "`: " + err.Error())
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if !isIdent(name) {
+			panic(fmt.Errorf("import: `%s` requires a namespace, eg. `import x %s`", file, lit))
+		}
+	}
+	if _, ok := p.imports[name]; ok {
+		panic(fmt.Errorf("import: namespace `%s` already exists", name))
+	}
+	path, err := p.findImport(file)
+	if err != nil {
+		panic(err)
+	}
+	c, err := p.imp.load(path)
+	if err != nil {
+		panic(err)
+	}
+	p.imports[name] = c
+}
+
+func (p *Compiler) fnImport(lit string) {
+
+	p.importFile("", lit)
+}
+
+func (p *Compiler) fnImportAs(lit string) {
+
+	name := p.stk[len(p.stk)-1].(string)
+	p.stk = p.stk[:len(p.stk)-1]
+	p.importFile(name, lit)
+}
+
+func isIdent(name string) bool {
+
+	for i, c := range name {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && (i == 0 || !(c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// -----------------------------------------------------------------------------
+
+// qname makes a qualified name, eg. `amf.Value`.
+//
+func (p *Compiler) qname(name string) {
+
+	i := len(p.stk) - 1
+	p.stk[i] = p.stk[i].(string) + "." + name
+}
+
+// nsOf returns the Compiler of the file where a (qualified) name is defined,
+// and the name in that file.
+//
+func (p *Compiler) nsOf(name string) (c *Compiler, local string) {
+
+	pos := strings.IndexByte(name, '.')
+	if pos < 0 {
+		return p, name
+	}
+	c, ok := p.imports[name[:pos]]
+	if !ok {
+		panic(fmt.Errorf("namespace `%s` not found", name[:pos]))
+	}
+	return c, name[pos+1:]
+}
+
+// qident refers a rule defined in an imported file, eg. `amf.Value`.
+//
+func (p *Compiler) qident() {
+
+	i := len(p.stk) - 1
+	name := p.stk[i].(string)
+	c, local := p.nsOf(name)
+	r, ok := c.rulers[local]
+	if !ok {
+		if r, ok = c.vars[local]; !ok {
+			panic(fmt.Errorf("ruler `%s` not found", name))
+		}
+	}
+	p.stk[i] = c.withOrder(r)
+}
+
+// -----------------------------------------------------------------------------
+
+// qcasec is a case condition which is a constant defined in an imported file,
+// eg. `amf.NUMBER`.
+//
+func (p *Compiler) qcasec() {
+
+	i := len(p.stk) - 1
+	name := p.stk[i].(string)
+	p.stk = p.stk[:i]
+	p.casec(name)
+}
+
+// -----------------------------------------------------------------------------
@@ -1,11 +1,14 @@
 package bpl
 
 import (
+	"fmt"
+	"hash"
 	"io/ioutil"
 	"net/http"
 	"reflect"
 	"strconv"
 
+	"github.com/goplus/bpl"
 	"github.com/xushiwei/qlang/exec"
 	"github.com/xushiwei/qlang/lib/bytes"
 	"github.com/xushiwei/qlang/lib/crypto/hmac"
@@ -31,6 +34,19 @@ func exit(code int) {
 	panic(code)
 }
 
+func checksumOf(newh func() hash.Hash) func(b interface{}) uint {
+
+	return func(b interface{}) uint {
+		switch v := b.(type) {
+		case []byte:
+			return uint(bpl.SumOf(newh(), v))
+		case string:
+			return uint(bpl.SumOf(newh(), []byte(v)))
+		}
+		panic("checksum: invalid argument type, require []byte or string")
+	}
+}
+
 func init() {
 
 	osExports := map[string]interface{}{
@@ -48,6 +64,12 @@ func init() {
 		"discard":   ioutil.Discard,
 	}
 
+	for name, newh := range bpl.Checksums {
+		exports[name] = checksumOf(newh)
+	}
+
+	qlang.SetDontTyNormalize(tyTplFunc) // arguments of a template can be rules, eg. uint8
+
 	qlang.Import("", exports)
 	qlang.Import("bytes", bytes.Exports)
 	qlang.Import("md5", md5.Exports)
@@ -97,6 +119,8 @@ func castInt(a interface{}) (int, bool) {
 		return int(a1), true
 	case uint8:
 		return int(a1), true
+	case bpl.EnumValue:
+		return castInt(a1.Val)
 	}
 	return 0, false
 }
@@ -209,17 +233,113 @@ func (p *Compiler) call() {
 func (p *Compiler) ref(name string) {
 
 	var instr exec.Instr
-	if v, ok := p.consts[name]; ok {
+	if p.isParam(name) {
+		instr = &iRef{exec.Ref(tplVar(p.tname, name))}
+	} else if v, ok := p.consts[name]; ok {
 		instr = exec.Push(v)
+	} else if c, ok := p.imports[name]; ok { // a namespace, eg. `amf.N`
+		instr = exec.Push(c.consts)
+	} else if items, ok := p.enums[name]; ok { // an enum, eg. `Kind.A`
+		instr = exec.Push(items)
+	} else if enum, ok := p.items[name]; ok && enum == "" {
+		panic(fmt.Errorf("enum item `%s` is ambiguous, qualify it by its enum, eg. `<Enum>.%s`", name, name))
+	} else if fn, ok := ctxVars[name]; ok {
+		p.ctxRefs = append(p.ctxRefs, p.code.Len())
+		instr = &iCtxVar{fn}
+	} else if p.targs > 0 { // in arguments of a template
+		instr = &iRef{&iRuleRef{cl: p, name: name, ref: exec.Ref(name)}}
 	} else {
-		instr = exec.Ref(name)
+		instr = &iRef{exec.Ref(name)}
 	}
 	p.code.Block(instr)
 }
 
+// unwrapEnum returns the base value of an enum value, so that it is an integer
+// in expressions.
+//
+func unwrapEnum(v interface{}) interface{} {
+
+	if e, ok := v.(bpl.EnumValue); ok {
+		return e.Val
+	}
+	return v
+}
+
+func unwrapTop(stk *exec.Stack) {
+
+	if v, ok := stk.Top(); ok {
+		if e, ok := v.(bpl.EnumValue); ok {
+			stk.Pop()
+			stk.Push(e.Val)
+		}
+	}
+}
+
+// iRef is exec.Ref, which unwraps enum values.
+//
+type iRef struct {
+	ref exec.Instr
+}
+
+func (p *iRef) Exec(stk *exec.Stack, ctx *exec.Context) {
+
+	p.ref.Exec(stk, ctx)
+	unwrapTop(stk)
+}
+
+// iMemberRef is exec.MemberRef, which also supports members of a *bpl.Map
+// (matching result of a struct).
+//
+type iMemberRef struct {
+	name string
+	ref  exec.Instr
+}
+
+func (p *iMemberRef) Exec(stk *exec.Stack, ctx *exec.Context) {
+
+	if v, ok := stk.Top(); ok {
+		if vars, ok := v.(*bpl.Map); ok {
+			stk.Pop()
+			val, ok := vars.Get(p.name)
+			if !ok {
+				panic(fmt.Errorf("member `%s` not found", p.name))
+			}
+			stk.Push(unwrapEnum(val))
+			return
+		}
+	}
+	p.ref.Exec(stk, ctx)
+	unwrapTop(stk)
+}
+
 func (p *Compiler) mref(name string) {
 
-	p.code.Block(exec.MemberRef(name))
+	p.code.Block(&iMemberRef{name: name, ref: exec.MemberRef(name)})
+}
+
+// iGet is exec.Get (the index operator, eg. `msgs["a"]`), which also supports
+// *bpl.Map (matching result of a struct) and unwraps enum values.
+//
+type iGet struct{}
+
+func (p iGet) Exec(stk *exec.Stack, ctx *exec.Context) {
+
+	key, _ := stk.Pop()
+	m, _ := stk.Pop()
+	if vars, ok := m.(*bpl.Map); ok {
+		var v interface{} = qlang.Undefined
+		if name, ok := key.(string); ok {
+			if val, ok := vars.Get(name); ok {
+				v = unwrapEnum(val)
+			}
+		}
+		stk.Push(v)
+		return
+	}
+	stk.Push(m)
+	stk.Push(key)
+	exec.Get.Exec(stk, ctx)
+	unwrapTop(stk) // eg. `kinds[i]` where kinds is an array of enum values
 }
 
 func (p *Compiler) pushi(v int) {
@@ -282,7 +402,7 @@ func (p *Compiler) index() {
 		if arity1 == 0 {
 			panic("call operator[] without index")
 		}
-		p.code.Block(exec.Get)
+		p.code.Block(iGet{})
 	} else {
 		p.code.Block(exec.Op3(qlang.SubSlice, arity1 != 0, arity2 != 0))
 	}
@@ -0,0 +1,32 @@
+//go:build go1.23
+// +build go1.23
+
+package bpl
+
+import (
+	"io"
+	"iter"
+)
+
+// -----------------------------------------------------------------------------
+
+// AllRecords matches input stream `r` in streaming mode, and returns an iterator
+// of the records. If an error occurs, it is yielded with a nil record at last.
+//
+func (p Ruler) AllRecords(r io.Reader) iter.Seq2[any, error] {
+
+	return func(yield func(any, error) bool) {
+		rs := p.Records(r)
+		defer rs.Close()
+		for rs.Next() {
+			if !yield(rs.Record(), nil) {
+				return
+			}
+		}
+		if err := rs.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -38,6 +38,17 @@ func (p *Compiler) and(m int) {
 	p.stk = stk[:n-m+1]
 }
 
+func (p *Compiler) alt(m int) {
+
+	if m == 1 {
+		return
+	}
+	stk := p.stk
+	n := len(stk)
+	stk[n-m] = bpl.Alt(clone(stk[n-m:])...)
+	p.stk = stk[:n-m+1]
+}
+
 func (p *Compiler) seq(m int) {
 
 	stk := p.stk
@@ -79,6 +90,10 @@ func (p *Compiler) sizeof(name string) {
 
 func (p *Compiler) ident(name string) {
 
+	if p.isParam(name) {
+		p.stk = append(p.stk, &tplParam{key: tplVar(p.tname, name), name: name})
+		return
+	}
 	r, ok := p.ruleOf(name)
 	if !ok {
 		v := &bpl.TypeVar{Name: name}
@@ -90,7 +105,7 @@ func (p *Compiler) ident(name string) {
 
 func (p *Compiler) assign(name string) {
 
-	a := p.stk[0].(bpl.Ruler)
+	a := bpl.Named(name, p.stk[0].(bpl.Ruler))
 	if v, ok := p.vars[name]; ok {
 		if err := v.Assign(a); err != nil {
 			panic(err)
@@ -0,0 +1,313 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/goplus/bpl"
+	"github.com/xushiwei/qlang/exec"
+)
+
+// -----------------------------------------------------------------------------
+
+// A template is a parameterized rule, eg. `lpstring(T) = {n T; s [n]char; return s}`.
+// Its arguments are bound to its parameters in a scope of the instance (see
+// `Context.BindEnv`), which is visible only to expressions in its body.
+//
+type template struct {
+	name   string
+	params []string
+	body   bpl.Ruler
+}
+
+// tplVar returns the name of variable to which the argument of parameter
+// `param` of template `tpl` is bound.
+//
+func tplVar(tpl, param string) string {
+
+	return "$" + tpl + "." + param
+}
+
+func (p *Compiler) tparam(name string) {
+
+	p.tname = p.stk[0].(string)
+	for _, param := range p.tparams {
+		if param == name {
+			panic("duplicated template parameter `" + name + "`")
+		}
+	}
+	p.tparams = append(p.tparams, name)
+}
+
+func (p *Compiler) isParam(name string) bool {
+
+	for _, param := range p.tparams {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Compiler) assignTemplate() {
+
+	stk := p.stk
+	name := stk[0].(string)
+	if _, ok := p.tpls[name]; ok {
+		panic("template already exists: " + name)
+	}
+	if _, ok := p.ruleOf(name); ok {
+		panic("ruler already exists: " + name)
+	}
+	if _, ok := textOf(name); ok || name == "pstring" || funcTypes[name] != nil {
+		panic("template name is reserved: " + name)
+	}
+	body := bpl.Named(name, stk[1].(bpl.Ruler))
+	p.tpls[name] = &template{name: name, params: p.tparams, body: body}
+	p.tparams, p.tname = nil, ""
+	p.stk = stk[:0]
+}
+
+// -----------------------------------------------------------------------------
+
+func (p *Compiler) tstart() {
+
+	p.targs++
+}
+
+func (p *Compiler) tend() {
+
+	p.targs--
+}
+
+func (p *Compiler) functype() {
+
+	arity := p.popArity()
+	args := p.gstk.PopNArgs(arity)
+	stk := p.stk
+	i := len(stk) - 1
+	name := stk[i].(string)
+	if fn, ok := funcTypes[name]; ok {
+		if arity != 1 {
+			panic(fmt.Errorf("type `%s(n)` requires 1 argument", name))
+		}
+		e := args[0].(*exprBlock)
+		n, ok := p.code.CheckConst(e.start)
+		if !ok || e.end-e.start != 1 {
+			panic(fmt.Errorf("type `%s(n)`: n isn't a constant", name))
+		}
+		stk[i] = fn(toInt(n, "type `"+name+"(n)`: n isn't an integer"))
+		return
+	}
+	if enc, ok := textOf(name); ok {
+		if arity != 1 {
+			panic(fmt.Errorf("type `%s(n)` requires 1 argument", name))
+		}
+		stk[i] = p.textArray(enc, args[0].(*exprBlock))
+		return
+	}
+	exprs := make([]*exprBlock, arity)
+	for j, arg := range args {
+		exprs[j] = arg.(*exprBlock)
+	}
+	argsOf := func(ctx *bpl.Context) []interface{} {
+		ctx = scopeOf(ctx)
+		vals := make([]interface{}, len(exprs))
+		for j, e := range exprs {
+			vals[j] = p.eval(ctx, e.start, e.end)
+		}
+		return vals
+	}
+	if name == "pstring" {
+		if arity != 1 && arity != 2 {
+			panic("type `pstring(T [, encoding])` requires 1 or 2 arguments")
+		}
+		stk[i] = bpl.Dyntype(func(ctx *bpl.Context) (bpl.Ruler, error) {
+			return pstringOf(argsOf(ctx))
+		})
+		return
+	}
+	cl, local := p.nsOf(name)
+	inst := &tplInst{cl: cl, name: local, args: argsOf, arity: arity}
+	p.insts = append(p.insts, inst)
+	stk[i] = inst
+}
+
+// scopeOf returns the Context in which arguments of a template are evaluated:
+// the nearest one which has a matching result (eg. the enclosing struct of a
+// member).
+//
+func scopeOf(ctx *bpl.Context) *bpl.Context {
+
+	for ctx.Dom() == nil && ctx.Parent != nil {
+		ctx = ctx.Parent
+	}
+	return ctx
+}
+
+// checkInsts checks that all instantiated templates exist, and are called with
+// correct number of arguments.
+//
+func (p *Compiler) checkInsts() error {
+
+	for _, inst := range p.insts {
+		tpl, ok := inst.cl.tpls[inst.name]
+		if !ok {
+			return fmt.Errorf("template `%s` not found", inst.name)
+		}
+		if len(tpl.params) != inst.arity {
+			return fmt.Errorf("template `%s` requires %d arguments, but we got %d", inst.name, len(tpl.params), inst.arity)
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// tplInst is an instance of a template, eg. `lpstring(uint16be)`.
+//
+type tplInst struct {
+	cl    *Compiler
+	name  string
+	args  func(ctx *bpl.Context) []interface{}
+	arity int
+}
+
+func (p *tplInst) bind(ctx *bpl.Context) (tpl *template, restore func()) {
+
+	tpl, ok := p.cl.tpls[p.name]
+	if !ok {
+		panic(fmt.Errorf("template `%s` not found", p.name))
+	}
+	args := p.args(ctx)
+	if len(args) != len(tpl.params) {
+		panic(fmt.Errorf("template `%s` requires %d arguments, but we got %d", p.name, len(tpl.params), len(args)))
+	}
+	vars := make(map[string]interface{}, len(args))
+	for i, name := range tpl.params {
+		vars[tplVar(tpl.name, name)] = args[i]
+	}
+	return tpl, ctx.BindEnv(vars)
+}
+
+func (p *tplInst) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
+
+	tpl, restore := p.bind(ctx)
+	defer restore()
+	return tpl.body.Match(in, ctx)
+}
+
+func (p *tplInst) Encode(w *bytes.Buffer, dom interface{}, ctx *bpl.Context) error {
+
+	tpl, restore := p.bind(ctx)
+	defer restore()
+	return bpl.Encode(tpl.body, w, dom, ctx)
+}
+
+func (p *tplInst) RetType() reflect.Type {
+
+	return bpl.TyInterface
+}
+
+func (p *tplInst) SizeOf() int {
+
+	return -1
+}
+
+// A tplFunc instantiates a template with constant arguments. It is how a
+// template is called in an expression, eg. the argument of
+// `array(lpstring(uint8), 3)`. It is a callable object (not a func), so that
+// rules passed to it aren't normalized to integers.
+//
+type tplFunc struct {
+	cl   *Compiler
+	name string
+}
+
+var tyTplFunc = reflect.TypeOf((*tplFunc)(nil))
+
+// Call instantiates the template.
+//
+func (p *tplFunc) Call(args ...interface{}) bpl.Ruler {
+
+	return &tplInst{cl: p.cl, name: p.name, args: func(ctx *bpl.Context) []interface{} {
+		return args
+	}, arity: len(args)}
+}
+
+// -----------------------------------------------------------------------------
+
+// tplParam is a parameter of a template used as a rule, eg. T in
+// `lpstring(T) = {n T; s [n]char; return s}`.
+//
+type tplParam struct {
+	key  string // see tplVar
+	name string
+}
+
+func (p *tplParam) ruler(ctx *bpl.Context) bpl.Ruler {
+
+	v := ctx.Env()[p.key]
+	r, ok := v.(bpl.Ruler)
+	if !ok {
+		panic(fmt.Errorf("template argument `%s` isn't a rule (value: %v)", p.name, v))
+	}
+	return r
+}
+
+func (p *tplParam) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
+
+	return p.ruler(ctx).Match(in, ctx)
+}
+
+func (p *tplParam) Encode(w *bytes.Buffer, dom interface{}, ctx *bpl.Context) error {
+
+	return bpl.Encode(p.ruler(ctx), w, dom, ctx)
+}
+
+func (p *tplParam) RetType() reflect.Type {
+
+	return bpl.TyInterface
+}
+
+func (p *tplParam) SizeOf() int {
+
+	return -1
+}
+
+// -----------------------------------------------------------------------------
+
+// iRuleRef refers a name in arguments of a template: it is a rule (or a
+// template) if there is one named `name`, otherwise it is a variable.
+//
+type iRuleRef struct {
+	cl   *Compiler
+	name string
+	ref  exec.Instr
+}
+
+func (p *iRuleRef) Exec(stk *exec.Stack, ctx *exec.Context) {
+
+	cl := p.cl
+	if r, ok := cl.rulers[p.name]; ok {
+		stk.Push(r)
+		return
+	}
+	if v, ok := cl.vars[p.name]; ok {
+		stk.Push(v)
+		return
+	}
+	if r, ok := builtins[p.name]; ok {
+		stk.Push(r)
+		return
+	}
+	if _, ok := cl.tpls[p.name]; ok {
+		stk.Push(&tplFunc{cl: cl, name: p.name})
+		return
+	}
+	p.ref.Exec(stk, ctx)
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package bpl
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/goplus/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+// MatchInto matches input stream `r`, and stores matching result in a value of
+// type T (see bpl.Unmarshal). If matching fails, v holds the partial matching
+// result as far as it can be stored, and err is the matching error. If storing
+// the partial result fails too, err also mentions it, but it still wraps the
+// matching error (see errors.Is and errors.As).
+//
+func MatchInto[T any](p Ruler, r io.Reader) (v T, err error) {
+
+	dom, err := p.MatchStream(r)
+	if err != nil {
+		if e := bpl.Unmarshal(dom, &v); e != nil {
+			err = fmt.Errorf("%w (storing the partial result: %v)", err, e)
+		}
+		return
+	}
+	err = bpl.Unmarshal(dom, &v)
+	return
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,61 @@
+//go:build go1.18
+// +build go1.18
+
+package bpl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+const codeMatchInto = `
+Item = {
+	len  uint8
+	data [len]byte
+}
+
+doc = {
+	magic uint32
+	items *Item
+}
+`
+
+type matchIntoDoc struct {
+	Magic uint32 `bpl:"magic"`
+	Items []struct {
+		Data string `bpl:"data"`
+	} `bpl:"items"`
+}
+
+func TestMatchInto(t *testing.T) {
+
+	r, err := NewFromString(codeMatchInto, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	b := []byte{1, 0, 0, 0, 2, 'h', 'i', 3, 'b', 'p', 'l'}
+	doc, err := MatchInto[matchIntoDoc](r, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("MatchInto failed:", err)
+	}
+	if doc.Magic != 1 || len(doc.Items) != 2 || doc.Items[0].Data != "hi" || doc.Items[1].Data != "bpl" {
+		t.Fatal("MatchInto:", doc)
+	}
+
+	doc, err = MatchInto[matchIntoDoc](r, bytes.NewReader(b[:9]))
+	if err == nil || doc.Magic != 1 || len(doc.Items) != 2 || doc.Items[0].Data != "hi" {
+		t.Fatal("MatchInto:", doc, err)
+	}
+
+	// both the matching error and the error of storing the partial result
+	_, err = MatchInto[struct{ Magic string }](r, bytes.NewReader(b[:9]))
+	var e *bpl.UnmarshalError
+	if !errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &e) || !strings.Contains(err.Error(), "storing the partial result") {
+		t.Fatal("MatchInto:", err)
+	}
+}
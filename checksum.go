@@ -0,0 +1,352 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"reflect"
+
+	"github.com/qiniu/x/log"
+)
+
+// -----------------------------------------------------------------------------
+
+// A crcModel is a CRC algorithm in the Rocksoft^tm model (refin == refout).
+//
+type crcModel struct {
+	width  uint
+	poly   uint64
+	init   uint64
+	refin  bool
+	xorout uint64
+	table  [256]uint64
+}
+
+func newCRCModel(width uint, poly, init uint64, refin bool, xorout uint64) *crcModel {
+
+	p := &crcModel{width: width, poly: poly, init: init, refin: refin, xorout: xorout}
+	mask := uint64(1)<<width - 1
+	if refin {
+		rpoly := uint64(0)
+		for i := uint(0); i < width; i++ {
+			if poly&(1<<i) != 0 {
+				rpoly |= 1 << (width - 1 - i)
+			}
+		}
+		for i := range p.table {
+			crc := uint64(i)
+			for k := 0; k < 8; k++ {
+				if crc&1 != 0 {
+					crc = (crc >> 1) ^ rpoly
+				} else {
+					crc >>= 1
+				}
+			}
+			p.table[i] = crc
+		}
+	} else {
+		top := uint64(1) << (width - 1)
+		for i := range p.table {
+			crc := uint64(i) << (width - 8)
+			for k := 0; k < 8; k++ {
+				if crc&top != 0 {
+					crc = (crc << 1) ^ poly
+				} else {
+					crc <<= 1
+				}
+			}
+			p.table[i] = crc & mask
+		}
+	}
+	return p
+}
+
+func (p *crcModel) New() hash.Hash {
+
+	return &crcHash{m: p, crc: p.init}
+}
+
+type crcHash struct {
+	m   *crcModel
+	crc uint64
+}
+
+func (p *crcHash) Write(b []byte) (n int, err error) {
+
+	m, crc := p.m, p.crc
+	if m.refin {
+		for _, c := range b {
+			crc = (crc >> 8) ^ m.table[byte(crc)^c]
+		}
+	} else {
+		mask := uint64(1)<<m.width - 1
+		for _, c := range b {
+			crc = ((crc << 8) ^ m.table[byte(crc>>(m.width-8))^c]) & mask
+		}
+	}
+	p.crc = crc
+	return len(b), nil
+}
+
+func (p *crcHash) Sum(b []byte) []byte {
+
+	return appendUintbe(b, p.crc^p.m.xorout, p.Size())
+}
+
+func (p *crcHash) Reset()         { p.crc = p.m.init }
+func (p *crcHash) Size() int      { return int(p.m.width >> 3) }
+func (p *crcHash) BlockSize() int { return 1 }
+
+// -----------------------------------------------------------------------------
+
+// fletcherHash implements Fletcher-16 (over bytes) and Fletcher-32 (over
+// little endian 16-bit words, the odd byte is padded with zero).
+//
+type fletcherHash struct {
+	size       int
+	sum1, sum2 uint32
+	odd        int // a pending byte of Fletcher-32, or -1
+}
+
+func newFletcher16() hash.Hash {
+
+	return &fletcherHash{size: 2, odd: -1}
+}
+
+func newFletcher32() hash.Hash {
+
+	return &fletcherHash{size: 4, odd: -1}
+}
+
+func (p *fletcherHash) add(v uint32) {
+
+	mod := uint32(255)
+	if p.size == 4 {
+		mod = 65535
+	}
+	p.sum1 = (p.sum1 + v) % mod
+	p.sum2 = (p.sum2 + p.sum1) % mod
+}
+
+func (p *fletcherHash) Write(b []byte) (n int, err error) {
+
+	for _, c := range b {
+		if p.size == 2 {
+			p.add(uint32(c))
+		} else if p.odd < 0 {
+			p.odd = int(c)
+		} else {
+			p.add(uint32(p.odd) | uint32(c)<<8)
+			p.odd = -1
+		}
+	}
+	return len(b), nil
+}
+
+func (p *fletcherHash) Sum(b []byte) []byte {
+
+	sum1, sum2 := p.sum1, p.sum2
+	if p.odd >= 0 {
+		q := *p
+		q.add(uint32(p.odd))
+		sum1, sum2 = q.sum1, q.sum2
+	}
+	shift := uint(p.size) << 2
+	return appendUintbe(b, uint64(sum2)<<shift|uint64(sum1), p.size)
+}
+
+func (p *fletcherHash) Reset()         { p.sum1, p.sum2, p.odd = 0, 0, -1 }
+func (p *fletcherHash) Size() int      { return p.size }
+func (p *fletcherHash) BlockSize() int { return 1 }
+
+func appendUintbe(b []byte, v uint64, n int) []byte {
+
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(uint(i)<<3)))
+	}
+	return b
+}
+
+// -----------------------------------------------------------------------------
+
+// Checksums holds all checksum algorithms known by name. It is used by `Checksum`,
+// and can be extended by users.
+//
+var Checksums = map[string]func() hash.Hash{
+	"crc8":        newCRCModel(8, 0x07, 0, false, 0).New,
+	"crc16":       newCRCModel(16, 0x8005, 0, true, 0).New,
+	"crc16ccitt":  newCRCModel(16, 0x1021, 0xffff, false, 0).New,
+	"crc16xmodem": newCRCModel(16, 0x1021, 0, false, 0).New,
+	"crc16modbus": newCRCModel(16, 0x8005, 0xffff, true, 0).New,
+	"crc16kermit": newCRCModel(16, 0x1021, 0, true, 0).New,
+	"crc32":       func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c":      func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"crc32mpeg2":  newCRCModel(32, 0x04c11db7, 0xffffffff, false, 0).New,
+	"adler32":     func() hash.Hash { return adler32.New() },
+	"fletcher16":  newFletcher16,
+	"fletcher32":  newFletcher32,
+}
+
+// SumOf returns the checksum of data `b` as an integer.
+//
+func SumOf(h hash.Hash, b []byte) uint64 {
+
+	h.Write(b)
+	return sumOf(h)
+}
+
+func sumOf(h hash.Hash) (v uint64) {
+
+	for _, c := range h.Sum(nil) {
+		v = (v << 8) | uint64(c)
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// SetChecksumWarnOnly controls how a checksum mismatch is reported in current
+// Context, and the Contexts created from it later: it is logged as a warning if
+// warnOnly is true, or returned as a *ChecksumError (by default).
+//
+func (p *Context) SetChecksumWarnOnly(warnOnly bool) {
+
+	p.sumWarn = warnOnly
+}
+
+// A ChecksumError is returned when a checksum mismatches.
+//
+type ChecksumError struct {
+	Algo   string
+	Expect uint64
+	Actual uint64
+}
+
+func (p *ChecksumError) Error() string {
+
+	return fmt.Sprintf("checksum %s mismatch: expect 0x%x, actual 0x%x", p.Algo, p.Expect, p.Actual)
+}
+
+// A hashReader reads from `in` without consuming it, and consumes bytes only
+// after `sub` (the buffered reader of hashReader) consumed them. So it knows
+// exactly which bytes are consumed.
+//
+type hashReader struct {
+	in    *bufio.Reader
+	sub   *bufio.Reader
+	h     hash.Hash
+	given int // number of bytes given to sub but not consumed from in
+}
+
+func (p *hashReader) commit() (err error) {
+
+	n := p.given - p.sub.Buffered()
+	b, err := p.in.Peek(n)
+	if err != nil {
+		return
+	}
+	p.h.Write(b)
+	p.given -= n
+	_, err = p.in.Discard(n)
+	return
+}
+
+func (p *hashReader) Read(b []byte) (n int, err error) {
+
+	if err = p.commit(); err != nil {
+		return
+	}
+	t, err := peekAt(p.in, p.given, len(b))
+	if len(t) > 0 {
+		n = copy(b, t)
+		p.given += n
+		return n, nil
+	}
+	return
+}
+
+type checksum struct {
+	algo   string
+	newh   func() hash.Hash
+	r      Ruler
+	expect func(ctx *Context) uint64
+}
+
+func (p *checksum) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	hr := &hashReader{in: in, h: p.newh()}
+	if src := ctx.src; src != nil && src.in == in {
+		ctx.src = newSource(hr, src.tell())
+		ctx.src.ra, ctx.src.origin = src.ra, src.origin
+		hr.sub = ctx.src.in
+		defer func() {
+			ctx.src = src
+		}()
+	} else {
+		hr.sub = bufio.NewReaderSize(hr, in.Size())
+	}
+
+	v, err = MatchStream(p.r, hr.sub, ctx)
+	if err != nil {
+		return
+	}
+	if err = hr.commit(); err != nil {
+		return
+	}
+
+	actual := sumOf(hr.h)
+	check := func() error {
+		if expect := p.expect(ctx); expect != actual {
+			err := &ChecksumError{Algo: p.algo, Expect: expect, Actual: actual}
+			if !ctx.sumWarn {
+				return err
+			}
+			log.Warn(err)
+		}
+		return nil
+	}
+	if ctx.checks != nil { // check it after the enclosing struct is matched
+		*ctx.checks = append(*ctx.checks, check)
+		return
+	}
+	return v, check()
+}
+
+// Encode encodes R only: the checksum isn't computed.
+//
+func (p *checksum) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return Encode(p.r, w, dom, ctx)
+}
+
+func (p *checksum) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *checksum) SizeOf() int {
+
+	return p.r.SizeOf()
+}
+
+// Checksum returns a matching unit that matches R, and verifies the checksum of
+// the bytes consumed by R with expect(ctx). Here `algo` is a name in Checksums.
+// If it is a statement of a struct (including one in an alternative of `Alt`),
+// expect(ctx) is evaluated after the struct is matched, so that it can refer to
+// a checksum member following R. Otherwise, eg. an element of a repetition, it
+// is evaluated at once.
+//
+func Checksum(algo string, r Ruler, expect func(ctx *Context) uint64) Ruler {
+
+	newh, ok := Checksums[algo]
+	if !ok {
+		panic("Checksum: unknown algorithm - " + algo)
+	}
+	return &checksum{algo: algo, newh: newh, r: r, expect: expect}
+}
+
+// -----------------------------------------------------------------------------
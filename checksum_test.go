@@ -0,0 +1,106 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestChecksums(t *testing.T) {
+
+	check := []byte("123456789")
+	for algo, v := range map[string]uint64{
+		"crc8":        0xf4,
+		"crc16":       0xbb3d,
+		"crc16ccitt":  0x29b1,
+		"crc16xmodem": 0x31c3,
+		"crc16modbus": 0x4b37,
+		"crc16kermit": 0x2189,
+		"crc32":       0xcbf43926,
+		"crc32c":      0xe3069283,
+		"crc32mpeg2":  0x0376e6e7,
+		"adler32":     0x091e01de,
+	} {
+		if ret := bpl.SumOf(bpl.Checksums[algo](), check); ret != v {
+			t.Fatalf("%s: 0x%x", algo, ret)
+		}
+	}
+	if ret := bpl.SumOf(bpl.Checksums["fletcher16"](), []byte("abcde")); ret != 0xc8f0 {
+		t.Fatalf("fletcher16: 0x%x", ret)
+	}
+	if ret := bpl.SumOf(bpl.Checksums["fletcher32"](), []byte("abcde")); ret != 0xf04fc729 {
+		t.Fatalf("fletcher32: 0x%x", ret)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+
+	data := bytes.Repeat([]byte("bpl"), 3000)
+	b := append([]byte{}, data...)
+	b = append(b, 0, 0, 0, 0, 0x42)
+	binary.BigEndian.PutUint32(b[len(data):], crc32.ChecksumIEEE(data))
+
+	expect := func(ctx *bpl.Context) uint64 {
+		v, _ := ctx.Var("crc")
+		return uint64(v.(uint))
+	}
+	r := bpl.Struct([]bpl.Ruler{
+		bpl.Checksum("crc32", &bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Uint8, func(ctx *bpl.Context) int { return len(data) })}, expect),
+		&bpl.Member{Name: "crc", Type: bpl.Uintbe(4)},
+		&bpl.Member{Name: "tail", Type: bpl.Uint8},
+	})
+
+	ctx := bpl.NewContext()
+	in := ctx.NewReaderBuffer(b)
+	_, err := r.Match(in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if v, _ := ctx.Var("tail"); v != uint8(0x42) || ctx.Tell() != int64(len(b)) {
+		t.Fatal("tail:", v, ctx.Tell())
+	}
+
+	ctx = bpl.NewContext()
+	_, err = r.Match(bufio.NewReaderSize(bytes.NewReader(b), 16), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+
+	b[0] = 'x'
+	ctx = bpl.NewContext()
+	_, err = r.Match(ctx.NewReaderBuffer(b), ctx)
+	var e *bpl.ChecksumError
+	if !errors.As(err, &e) {
+		t.Fatal("Match:", err)
+	}
+
+	ctx = bpl.NewContext()
+	ctx.SetChecksumWarnOnly(true)
+	_, err = r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	// checks of a failed alternative are dropped
+	n := func(ctx *bpl.Context) int { return len(data) }
+	r = bpl.Struct([]bpl.Ruler{
+		bpl.Alt(
+			bpl.And(
+				bpl.Checksum("crc32", &bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Uint8, n)}, func(ctx *bpl.Context) uint64 { return 0 }),
+				bpl.Assert(func(ctx *bpl.Context) bool { return false }, "no"),
+			),
+			&bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Uint8, n)},
+		),
+		&bpl.Member{Name: "crc", Type: bpl.Uintbe(4)},
+		&bpl.Member{Name: "tail", Type: bpl.Uint8},
+	})
+	b[0] = 'b'
+	ctx = bpl.NewContext()
+	if _, err = r.Match(ctx.NewReaderBuffer(b), ctx); err != nil {
+		t.Fatal("Match failed:", err)
+	}
+}
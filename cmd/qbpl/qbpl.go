@@ -1,9 +1,12 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -15,16 +18,96 @@ var (
 	protocol = flag.String("p", "", "protocol file in BPL syntax. default is guessed by extension.")
 	output   = flag.String("o", "", "output log file, default is stderr.")
 	logmode  = flag.String("l", "", "log mode: short (default) or long.")
+	encode   = flag.Bool("e", false, "encode mode: read JSON from <file> (default is stdin), write binary to <output> (default is stdout).")
+	span     = flag.Bool("span", false, "dump the matching result with the span (offset, length, rule) of each node, instead of matching in streaming mode.")
 )
 
+var (
+	maxAlloc  = flag.Int("maxalloc", 64<<20, "max bytes of a single allocation, 0 means unlimited.")
+	maxTotal  = flag.Int64("maxtotal", 0, "max bytes of all allocations, 0 means unlimited.")
+	maxDepth  = flag.Int("maxdepth", 1000, "max recursion depth of named rules, 0 means unlimited.")
+	maxRepeat = flag.Int("maxrepeat", 0, "max element count of a repetition, 0 means unlimited.")
+	timeout   = flag.Duration("timeout", 0, "max time of matching, 0 means unlimited.")
+)
+
+func setLimits() {
+
+	l := &bpl.DefaultLimits
+	l.MaxAlloc, l.MaxTotalAlloc, l.MaxDepth, l.MaxRepeat = *maxAlloc, *maxTotal, *maxDepth, *maxRepeat
+}
+
+// qbpl -e -p <protocol>.bpl [-o <output>] <file>.json
+//
+func encodeJSON(args []string) {
+
+	if *protocol == "" {
+		fmt.Fprintln(os.Stderr, "Usage: qbpl -e -p <protocol>.bpl [-o <output>] <file>.json")
+		flag.PrintDefaults()
+		return
+	}
+
+	r := os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalln("Open failed:", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var dom interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err := dec.Decode(&dom)
+	if err != nil {
+		log.Fatalln("json.Decode failed:", err)
+	}
+
+	ruler, err := bpl.NewFromFile(*protocol)
+	if err != nil {
+		log.Fatalln("bpl.NewFromFile failed:", err)
+	}
+
+	b, err := ruler.MarshalDOM(dom)
+	if err != nil {
+		log.Fatalln("MarshalDOM failed:", err)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln("Create output file failed:", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Fatalln("Write failed:", err)
+	}
+}
+
 // qbpl [-p <protocol>.bpl -o <output>.log -l <logmode>] <file>
 //
 func main() {
 
 	flag.Parse()
 	bpl.SetDumpCode(os.Getenv("BPL_DUMPCODE"))
+	setLimits()
+	if *timeout > 0 {
+		c, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		bpl.DefaultLimits.Context = c
+	}
 
-	var in *bufio.Reader
+	if *encode {
+		encodeJSON(flag.Args())
+		return
+	}
+
+	var in io.Reader
 	args := flag.Args()
 	if len(args) > 0 {
 		file := args[0]
@@ -33,9 +116,9 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Open failed:", file)
 		}
 		defer f.Close()
-		in = bufio.NewReader(f)
+		in = f
 	} else {
-		in = bufio.NewReader(os.Stdin)
+		in = os.Stdin
 	}
 
 	if *protocol == "" {
@@ -71,10 +154,40 @@ func main() {
 		log.Fatalln("bpl.NewFromFile failed:", err)
 	}
 
-	ctx := bpl.NewContext()
-	_, err = ruler.SafeMatch(in, ctx)
-	if err != nil {
+	if *span {
+		dom, sp, err := ruler.MatchWithSpan(in)
+		var b bytes.Buffer
+		bpl.DumpDomWithSpan(&b, dom, sp, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Partial result:", b.String())
+			fmt.Fprintln(os.Stderr, "Match failed:", err)
+			return
+		}
+		bpl.Dumper.Info(b.String())
+		return
+	}
+
+	if err = matchStream(ruler, in, os.Stderr); err != nil {
 		fmt.Fprintln(os.Stderr, "Match failed:", err)
 		return
 	}
 }
+
+// matchStream matches `in` in streaming mode, and writes the partial result to
+// `errw` if matching fails.
+//
+func matchStream(ruler bpl.Ruler, in io.Reader, errw io.Writer) error {
+
+	rs := ruler.Records(in)
+	for rs.Next() {
+	}
+	err := rs.Err()
+	if err != nil {
+		if dom := rs.Dom(); dom != nil {
+			var b bytes.Buffer
+			bpl.DumpDom(&b, dom, 0)
+			fmt.Fprintln(errw, "Partial result:", b.String())
+		}
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	bpl "github.com/goplus/bpl/bpl.ext"
+)
+
+func TestMatchStreamLines(t *testing.T) {
+
+	ruler, err := bpl.NewFromFile("../../formats/lines.bpl")
+	if err != nil {
+		t.Fatal("NewFromFile failed:", err)
+	}
+
+	var log, errw bytes.Buffer
+	old := bpl.Dumper
+	bpl.SetDumper(&log, 0)
+	defer func() {
+		bpl.Dumper = old
+	}()
+
+	// `dump` follows the repetition, so it isn't streamed
+	if err = matchStream(ruler, strings.NewReader("hello\nworld\n"), &errw); err != nil {
+		t.Fatal("matchStream failed:", err, errw.String())
+	}
+	if !strings.Contains(log.String(), "[\n  \"hello\\n\",\n  \"world\\n\",\n]") {
+		t.Fatal("dump:", log.String())
+	}
+
+	var b bytes.Buffer
+	bpl.DumpDom(&b, nil, 0)
+	if b.String() != "<nil>" {
+		t.Fatal("DumpDom(nil):", b.String())
+	}
+}
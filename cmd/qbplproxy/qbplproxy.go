@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
@@ -131,6 +130,19 @@ var (
 	logmode  = flag.String("l", "", "log mode: short (default) or long.")
 )
 
+var (
+	maxAlloc  = flag.Int("maxalloc", 64<<20, "max bytes of a single allocation, 0 means unlimited.")
+	maxTotal  = flag.Int64("maxtotal", 0, "max bytes of all allocations, 0 means unlimited.")
+	maxDepth  = flag.Int("maxdepth", 1000, "max recursion depth of named rules, 0 means unlimited.")
+	maxRepeat = flag.Int("maxrepeat", 0, "max element count of a repetition, 0 means unlimited.")
+)
+
+func setLimits() {
+
+	l := &bpl.DefaultLimits
+	l.MaxAlloc, l.MaxTotalAlloc, l.MaxDepth, l.MaxRepeat = *maxAlloc, *maxTotal, *maxDepth, *maxRepeat
+}
+
 var (
 	baseDir string // $HOME/.qbpl/formats/
 )
@@ -153,6 +165,32 @@ func guessProtocol(host string) string {
 	return ""
 }
 
+// newOnBpl returns a callback that matches messages of a connection by `ruler`.
+// Resynchronisation after a malformed message is up to the protocol file (see
+// `recover..do` in formats/mongo.bpl), and the rest of the connection is just
+// proxied if matching fails.
+//
+func newOnBpl(ruler bpl.Ruler, filterCond map[string]interface{}, flong bool) func(r io.Reader, env *Env) error {
+
+	return func(r io.Reader, env *Env) (err error) {
+		ctx := bpl.NewContext()
+		in := ctx.NewReader(r)
+		ctx.Globals.SetVar("BPL_FILTER", filterCond)
+		ctx.Globals.SetVar("BPL_DIRECTION", env.Direction)
+		if flong {
+			ctx.Globals.SetVar("BPL_DUMP_PREFIX", "[CONN:"+env.Conn+"]["+env.Direction+"]")
+		} else {
+			ctx.Globals.SetVar("BPL_DUMP_PREFIX", "["+env.Direction+"]")
+		}
+		_, err = ruler.SafeMatch(in, ctx)
+		if err != nil {
+			log.Error("Match failed:", err)
+		}
+		in.WriteTo(ioutil.Discard)
+		return
+	}
+}
+
 // qbplproxy -h <listenIp:port> -b <backendIp:port> [-p <protocol>.bpl -f <filter> -o <output>.log -l <logmode>]
 //
 func main() {
@@ -167,6 +205,7 @@ func main() {
 	}
 	bpl.SetDumpCode(os.Getenv("BPL_DUMPCODE"))
 	qlang.DumpStack = true
+	setLimits()
 
 	baseDir = os.Getenv("HOME") + "/.qbpl/formats/"
 	if *protocol == "" {
@@ -214,23 +253,7 @@ func main() {
 		if err != nil {
 			log.Fatalln("bpl.NewFromFile failed:", err)
 		}
-		onBpl = func(r io.Reader, env *Env) (err error) {
-			in := bufio.NewReader(r)
-			ctx := bpl.NewContext()
-			ctx.Globals.SetVar("BPL_FILTER", filterCond)
-			ctx.Globals.SetVar("BPL_DIRECTION", env.Direction)
-			if flong {
-				ctx.Globals.SetVar("BPL_DUMP_PREFIX", "[CONN:"+env.Conn+"]["+env.Direction+"]")
-			} else {
-				ctx.Globals.SetVar("BPL_DUMP_PREFIX", "["+env.Direction+"]")
-			}
-			_, err = ruler.SafeMatch(in, ctx)
-			if err != nil {
-				log.Error("Match failed:", err)
-			}
-			in.WriteTo(ioutil.Discard)
-			return
-		}
+		onBpl = newOnBpl(ruler, filterCond, flong)
 	}
 	log.Std = bpl.Dumper
 
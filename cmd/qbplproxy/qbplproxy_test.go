@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	bpl "github.com/goplus/bpl/bpl.ext"
+)
+
+func mongoMsg(requestID, opCode int32, body string) []byte {
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []int32{int32(16 + len(body)), requestID, 0, opCode})
+	b.WriteString(body)
+	return b.Bytes()
+}
+
+func TestOnBplRecover(t *testing.T) {
+
+	for _, file := range []string{"../../formats/mongo.bpl", "../../formats/rtmp.bpl"} {
+		if _, err := bpl.NewFromFile(file); err != nil {
+			t.Fatal("NewFromFile failed:", file, err)
+		}
+	}
+	ruler, err := bpl.NewFromFile("../../formats/mongo.bpl")
+	if err != nil {
+		t.Fatal("NewFromFile failed:", err)
+	}
+
+	var log bytes.Buffer
+	old := bpl.Dumper
+	bpl.SetDumper(&log, 0)
+	defer func() {
+		bpl.Dumper = old
+	}()
+
+	// OP_REQ (2010) without the terminating zero of dbName is malformed
+	b := append(mongoMsg(1, 2010, "ab"), mongoMsg(2, 9999, "xyz")...)
+	onBpl := newOnBpl(ruler, map[string]interface{}{}, false)
+	if err = onBpl(bytes.NewReader(b), &Env{Direction: "REQ"}); err != nil {
+		t.Fatal("onBpl failed:", err)
+	}
+	if out := log.String(); !strings.Contains(out, "requestID: 2\n") || strings.Contains(out, "requestID: 1\n") {
+		t.Fatal("dump:", out)
+	}
+}
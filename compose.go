@@ -2,7 +2,9 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"reflect"
@@ -19,6 +21,11 @@ var (
 
 	// ErrNotEOF is returned when current position is not at EOF.
 	ErrNotEOF = errors.New("current position is not at EOF")
+
+	// ErrLookaheadTooLong is returned when an alternative of `Alt`, or an element
+	// of an exclusive `Until`, requires more lookahead bytes than the buffer of
+	// input stream.
+	ErrLookaheadTooLong = errors.New("lookahead is too long")
 )
 
 // -----------------------------------------------------------------------------
@@ -30,6 +37,11 @@ func (p nilType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	return nil, nil
 }
 
+func (p nilType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return nil
+}
+
 func (p nilType) RetType() reflect.Type {
 
 	return TyInterface
@@ -57,6 +69,11 @@ func (p eof) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 	return nil, ErrNotEOF
 }
 
+func (p eof) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return nil
+}
+
 func (p eof) RetType() reflect.Type {
 
 	return TyInterface
@@ -81,6 +98,11 @@ func (p done) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 	return
 }
 
+func (p done) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return nil
+}
+
 func (p done) RetType() reflect.Type {
 
 	return TyInterface
@@ -103,15 +125,31 @@ type and struct {
 
 func (p *and) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	for _, r := range p.rs {
+	follows, last := ctx.follows, len(p.rs)-1
+	defer func() {
+		ctx.follows = follows
+	}()
+	for i, r := range p.rs {
+		ctx.follows = follows || i < last
 		_, err = r.Match(in, ctx)
 		if err != nil {
-			return
+			return nil, withPartial(err, ctx.Dom())
 		}
 	}
 	return ctx.Dom(), nil
 }
 
+func (p *and) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	for _, r := range p.rs {
+		err = Encode(r, w, dom, ctx)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (p *and) RetType() reflect.Type {
 
 	return TyInterface
@@ -144,10 +182,18 @@ type seq struct {
 func (p *seq) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
 	ret := ctx.requireVarSlice()
-	for _, r := range p.rs {
+	follows, last := ctx.follows, len(p.rs)-1
+	defer func() {
+		ctx.follows = follows
+	}()
+	for i, r := range p.rs {
+		if !isBitRuler(r) {
+			ctx.AlignBits()
+		}
+		ctx.follows = follows || i < last
 		v, err = r.Match(in, ctx.NewSub())
 		if err != nil {
-			return
+			return nil, partialSlice(err, reflect.ValueOf(ret))
 		}
 		ret = append(ret, v)
 	}
@@ -155,6 +201,24 @@ func (p *seq) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 	return ret, nil
 }
 
+func (p *seq) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	vals, ok := dom.([]interface{})
+	if !ok || len(vals) != len(p.rs) {
+		return &EncodeError{R: p, Dom: dom, Msg: fmt.Sprintf("value isn't a []interface{} of length %d", len(p.rs))}
+	}
+	for i, r := range p.rs {
+		if !isBitRuler(r) {
+			ctx.AlignBits()
+		}
+		err = Encode(r, w, vals[i], ctx.NewSub())
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (p *seq) RetType() reflect.Type {
 
 	return tyInterfaceSlice
@@ -174,6 +238,154 @@ func Seq(rs ...Ruler) Ruler {
 
 // -----------------------------------------------------------------------------
 
+type peekReader struct {
+	in  *bufio.Reader
+	off int
+}
+
+func (p *peekReader) Read(b []byte) (n int, err error) {
+
+	t, err := peekAt(p.in, p.off, len(b))
+	if len(t) > 0 {
+		n = copy(b, t)
+		p.off += n
+		return n, nil
+	}
+	if err == bufio.ErrBufferFull {
+		err = ErrLookaheadTooLong
+	}
+	return
+}
+
+// peekAt returns at most n bytes at offset off of `in` without consuming them.
+// It doesn't fill `in` if `in` is a memory buffer, because filling moves data
+// of the buffer, which is owned by the caller of bufiox.NewReaderBuffer.
+//
+func peekAt(in *bufio.Reader, off, n int) (b []byte, err error) {
+
+	size := off + n
+	if buffered := in.Buffered(); size > buffered {
+		if buffered > off {
+			size = buffered // use buffered data first
+		} else if bufiox.IsReaderBuffer(in) {
+			return nil, io.EOF
+		}
+	}
+	b, err = in.Peek(size)
+	if len(b) > off {
+		return b[off:], nil
+	}
+	return nil, err
+}
+
+func tryMatch(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	old := ctx.save()
+	peek := &peekReader{in: in}
+	var sub *bufio.Reader
+	if src := ctx.src; src != nil && src.in == in {
+		ctx.src = newSource(peek, src.tell())
+		ctx.src.ra, ctx.src.origin = src.ra, src.origin
+		sub = ctx.src.in
+		defer func() {
+			ctx.src = src
+		}()
+	} else {
+		sub = bufio.NewReader(peek)
+	}
+
+	glbs := ctx.Globals
+	oldIn, ok := glbs.GetAndSetVar("BPL_IN", sub)
+	v, err = doMatch(R, sub, ctx)
+	if err != nil {
+		ctx.restore(old)
+		return
+	}
+	if ok {
+		glbs.SetVar("BPL_IN", oldIn)
+	} else {
+		glbs.Unset("BPL_IN")
+	}
+	ctx.commit()
+	_, err = in.Discard(peek.off - sub.Buffered())
+	return
+}
+
+type alt struct {
+	rs []Ruler
+}
+
+func (p *alt) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	n := len(p.rs) - 1
+	for _, r := range p.rs[:n] {
+		if v, err = tryMatch(r, in, ctx); err == nil {
+			return
+		}
+	}
+	return p.rs[n].Match(in, ctx)
+}
+
+func (p *alt) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	for _, r := range p.rs {
+		old := ctx.save()
+		var b bytes.Buffer
+		ctx.enc.bases[&b] = ctx.enc.tell(w)
+		err = doEncode(r, &b, dom, ctx)
+		delete(ctx.enc.bases, &b)
+		if err == nil {
+			ctx.commit()
+			ctx.enc.rebase(&b, w, w.Len())
+			w.Write(b.Bytes())
+			return
+		}
+		ctx.restore(old)
+	}
+	return
+}
+
+func (p *alt) RetType() reflect.Type {
+
+	t := p.rs[0].RetType()
+	for _, r := range p.rs[1:] {
+		if r.RetType() != t {
+			return TyInterface
+		}
+	}
+	return t
+}
+
+func (p *alt) SizeOf() int {
+
+	size := p.rs[0].SizeOf()
+	for _, r := range p.rs[1:] {
+		if r.SizeOf() != size {
+			return -1
+		}
+	}
+	return size
+}
+
+// Alt returns a matching unit that matches R1 | R2 | ... | RN (ordered choice).
+// It tries each alternative against buffered lookahead of the input stream, and
+// rolls back both the input and variables set by the alternative if it fails.
+// So lookahead of an alternative (except the last one) is limited by the
+// buffer size of the input stream.
+//
+func Alt(rs ...Ruler) Ruler {
+
+	if len(rs) <= 1 {
+		if len(rs) == 1 {
+			return rs[0]
+		}
+		return Nil
+	}
+	return &alt{rs: rs}
+}
+
+// -----------------------------------------------------------------------------
+
 type act struct {
 	fn func(ctx *Context) error
 }
@@ -187,6 +399,11 @@ func (p *act) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 	return ctx.Dom(), nil
 }
 
+func (p *act) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return p.fn(ctx)
+}
+
 func (p *act) RetType() reflect.Type {
 
 	return TyInterface
@@ -222,6 +439,18 @@ func (p *dyntype) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	return
 }
 
+func (p *dyntype) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	r, err := p.r(ctx)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		return Encode(r, w, dom, ctx)
+	}
+	return nil
+}
+
 func (p *dyntype) RetType() reflect.Type {
 
 	return TyInterface
@@ -248,16 +477,45 @@ type read struct {
 
 func (p *read) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	ctx.AlignBits()
 	n := p.n(ctx)
+	base := ctx.Tell()
+	if err = ctx.alloc(n); err != nil {
+		return
+	}
 	b := make([]byte, n)
 	_, err = io.ReadFull(in, b)
 	if err != nil {
 		return
 	}
-	in = bufiox.NewReaderBuffer(b)
+	if old := ctx.src; old != nil {
+		src := newSourceBuffer(b, base)
+		src.ra, src.origin = old.ra, base
+		ctx.src = src
+		defer func() {
+			ctx.src = old
+		}()
+		in = src.in
+	} else {
+		in = bufiox.NewReaderBuffer(b)
+	}
 	return MatchStream(p.r, in, ctx)
 }
 
+func (p *read) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	ctx.AlignBits()
+	if ctx.enc == nil {
+		return Encode(p.r, w, dom, ctx)
+	}
+	old := ctx.enc.origin
+	ctx.enc.origin = ctx.enc.tell(w)
+	defer func() {
+		ctx.enc.origin = old
+	}()
+	return Encode(p.r, w, dom, ctx)
+}
+
 func (p *read) RetType() reflect.Type {
 
 	return p.r.RetType()
@@ -283,11 +541,23 @@ type skip struct {
 
 func (p *skip) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	ctx.AlignBits()
 	n := p.n(ctx)
-	v, err = in.Discard(n)
+	v, err = ctx.skip(in, n)
 	return
 }
 
+// Encode writes n(ctx) zero bytes.
+//
+func (p *skip) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	ctx.AlignBits()
+	if n := p.n(ctx); n > 0 {
+		w.Write(make([]byte, n))
+	}
+	return nil
+}
+
 func (p *skip) RetType() reflect.Type {
 
 	return tyInt
@@ -298,7 +568,8 @@ func (p *skip) SizeOf() int {
 	return -1
 }
 
-// Skip returns a matching unit that skips n(ctx) bytes.
+// Skip returns a matching unit that skips n(ctx) bytes. It seeks instead of
+// reading and discarding if the input stream supports it.
 //
 func Skip(n func(ctx *Context) int) Ruler {
 
@@ -320,6 +591,14 @@ func (p *ifType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	return
 }
 
+func (p *ifType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	if p.cond(ctx) {
+		return Encode(p.r, w, dom, ctx)
+	}
+	return nil
+}
+
 func (p *ifType) RetType() reflect.Type {
 
 	return TyInterface
@@ -346,18 +625,24 @@ type eval struct {
 
 func (p *eval) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	ctx.AlignBits()
 	fclose := false
+	old := ctx.src
 	val := p.expr(ctx)
 	switch v := val.(type) {
 	case []byte:
-		in = bufiox.NewReaderBuffer(v)
+		ctx.src = newSourceBuffer(v, 0)
+		ctx.src.ra = bytes.NewReader(v)
 	case io.Reader:
-		in = bufio.NewReader(v)
+		ctx.src = newSource(v, 0)
 		fclose = true
 	default:
 		panic("eval <expr> must return []byte or io.Reader")
 	}
-	v, err = MatchStream(p.r, in, ctx)
+	defer func() {
+		ctx.src = old
+	}()
+	v, err = MatchStream(p.r, ctx.src.in, ctx)
 	if fclose {
 		if v, ok := val.(io.Closer); ok {
 			v.Close()
@@ -398,6 +683,13 @@ func (p *assert) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	panic(p.msg)
 }
 
+// Encode does nothing: assertions aren't checked while encoding.
+//
+func (p *assert) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return nil
+}
+
 func (p *assert) RetType() reflect.Type {
 
 	return TyInterface
@@ -443,9 +735,26 @@ func (p *TypeVar) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	if r == nil {
 		return 0, ErrVarNotAssigned
 	}
+	if named, ok := r.(*fileLine); !ok || named.name == "" { // or it's counted by the named rule
+		if err = ctx.enter(); err != nil {
+			return
+		}
+		defer ctx.leave()
+	}
 	return r.Match(in, ctx)
 }
 
+// Encode is the counterpart of Match. see Encoder interface.
+//
+func (p *TypeVar) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	r := p.Elem
+	if r == nil {
+		return ErrVarNotAssigned
+	}
+	return Encode(r, w, dom, ctx)
+}
+
 // RetType returns matching result type.
 //
 func (p *TypeVar) RetType() reflect.Type {
@@ -3,22 +3,38 @@ package bpl
 import (
 	"bufio"
 	"bytes"
-	"encoding/hex"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"reflect"
 	"runtime/debug"
 
-	"github.com/qiniu/x/bufiox"
 	"github.com/xushiwei/qlang/exec"
 )
 
 // -----------------------------------------------------------------------------
 
-// A Globals represents global variables.
+// A Globals represents global variables. They should be changed by its methods
+// (rather than Impl directly), so that the changes made by a failed alternative
+// of `Alt` can be undone.
 //
 type Globals struct {
 	Impl map[string]interface{}
+	undo *undoLog
+}
+
+// An undoLog records old values of global variables changed since the oldest
+// active save point (see `Context.save`).
+//
+type undoLog struct {
+	entries []undoEntry
+	saves   int // number of active save points
+}
+
+type undoEntry struct {
+	name   string
+	old    interface{}
+	exists bool
 }
 
 // NewGlobals returns a `Globals` instance.
@@ -27,6 +43,15 @@ func NewGlobals() Globals {
 
 	return Globals{
 		Impl: make(map[string]interface{}),
+		undo: new(undoLog),
+	}
+}
+
+func (p Globals) record(name string) {
+
+	if u := p.undo; u != nil && u.saves > 0 {
+		old, ok := p.Impl[name]
+		u.entries = append(u.entries, undoEntry{name: name, old: old, exists: ok})
 	}
 }
 
@@ -34,6 +59,7 @@ func NewGlobals() Globals {
 //
 func (p Globals) GetAndSetVar(name string, v interface{}) (old interface{}, ok bool) {
 
+	p.record(name)
 	old, ok = p.Impl[name]
 	p.Impl[name] = v
 	return
@@ -43,9 +69,18 @@ func (p Globals) GetAndSetVar(name string, v interface{}) (old interface{}, ok b
 //
 func (p Globals) SetVar(name string, v interface{}) {
 
+	p.record(name)
 	p.Impl[name] = v
 }
 
+// Unset deletes a global variable.
+//
+func (p Globals) Unset(name string) {
+
+	p.record(name)
+	delete(p.Impl, name)
+}
+
 // Var returns value of a global variable.
 //
 func (p Globals) Var(name string) (v interface{}, ok bool) {
@@ -63,6 +98,20 @@ type Context struct {
 	Stack   *exec.Stack
 	Parent  *Context
 	Globals Globals
+	bits    *bitCursor
+	src     *source
+	enc     *encodeState
+	checks  *[]func() error // deferred checks of current struct
+	frame   bool            // if it's the Context of a struct, see `ParentDom`
+	follows bool            // if more units follow current one in its struct or sequence, see `streaming`
+	stream  *streamState
+	limits  *limitState
+	start   int64                  // start offset of current struct
+	index   int                    // index of current element of a repetition, -1 if none
+	span    *Span                  // span of current node, see `EnableSpans`
+	order   binary.ByteOrder       // byte order of BaseType, see `SetByteOrder`
+	env     map[string]interface{} // variables bound by `BindEnv`
+	sumWarn bool                   // see `SetChecksumWarnOnly`
 }
 
 // NewContext returns a new matching Context.
@@ -71,14 +120,53 @@ func NewContext() *Context {
 
 	gbl := NewGlobals()
 	stk := exec.NewStack()
-	return &Context{Globals: gbl, Stack: stk}
+	return &Context{Globals: gbl, Stack: stk, bits: new(bitCursor), index: -1}
 }
 
 // NewSub returns a new sub Context.
 //
 func (p *Context) NewSub() *Context {
 
-	return &Context{Parent: p, Globals: p.Globals, Stack: p.Stack}
+	return &Context{
+		Parent: p, Globals: p.Globals, Stack: p.Stack, bits: p.bits, src: p.src, enc: p.enc, stream: p.stream, limits: p.limits,
+		start: p.start, index: p.index, span: p.span, order: p.order, env: p.env, sumWarn: p.sumWarn,
+	}
+}
+
+// Env returns the variables bound to this Context by BindEnv.
+//
+func (p *Context) Env() map[string]interface{} {
+
+	return p.env
+}
+
+// BindEnv binds variables `vars` to this Context (in addition to the ones
+// already bound), until the returned function is called. Unlike Globals, they
+// are visible only to this Context and the Contexts created from it, eg. the
+// arguments of a template instance while its body is matched.
+//
+func (p *Context) BindEnv(vars map[string]interface{}) (restore func()) {
+
+	old := p.env
+	env := make(map[string]interface{}, len(old)+len(vars))
+	for k, v := range old {
+		env[k] = v
+	}
+	for k, v := range vars {
+		env[k] = v
+	}
+	p.env = env
+	return func() {
+		p.env = old
+	}
+}
+
+func (p *Context) newElem(i int) *Context {
+
+	sub := p.NewSub()
+	sub.index = i
+	sub.span = p.elemSpan()
+	return sub
 }
 
 func (p *Context) requireVarSlice() []interface{} {
@@ -102,19 +190,24 @@ func (p *Context) SetVar(name string, v interface{}) {
 		panic(fmt.Errorf("variable `%s` exists globally", name))
 	}
 
-	var vars map[string]interface{}
+	vars := p.requireVars()
+	if _, ok := vars.Get(name); ok {
+		panic(fmt.Errorf("variable `%s` exists in dom", name))
+	}
+	vars.Set(name, v)
+}
+
+func (p *Context) requireVars() *Map {
+
 	if p.dom == nil {
-		vars = make(map[string]interface{})
+		vars := NewMap()
 		p.dom = vars
-	} else if domv, ok := p.dom.(map[string]interface{}); ok {
-		if _, ok = domv[name]; ok {
-			panic(fmt.Errorf("variable `%s` exists in dom", name))
-		}
-		vars = domv
-	} else {
-		panic("dom type isn't map[string]interface{}")
+		return vars
 	}
-	vars[name] = v
+	if vars, ok := p.dom.(*Map); ok {
+		return vars
+	}
+	panic("dom type isn't *bpl.Map")
 }
 
 // LetVar sets a variable to matching context.
@@ -126,31 +219,115 @@ func (p *Context) LetVar(name string, v interface{}) {
 		return
 	}
 
-	var vars map[string]interface{}
-	if p.dom == nil {
-		vars = make(map[string]interface{})
-		p.dom = vars
-	} else if domv, ok := p.dom.(map[string]interface{}); ok {
-		vars = domv
-	} else {
-		panic("dom type isn't map[string]interface{}")
+	p.requireVars().Set(name, v)
+	if p.enc != nil {
+		p.patch(name, v)
 	}
-	vars[name] = v
 }
 
 // Var gets a variable from matching context.
 //
 func (p *Context) Var(name string) (v interface{}, ok bool) {
 
-	vars, ok := p.dom.(map[string]interface{})
+	vars, ok := p.dom.(*Map)
 	if ok {
-		v, ok = vars[name]
+		v, ok = vars.Get(name)
 	} else {
-		panic("dom type isn't map[string]interface{}")
+		panic("dom type isn't *bpl.Map")
 	}
 	return
 }
 
+type ctxState struct {
+	dom     interface{}
+	globals map[string]interface{} // all global variables, if they aren't in undo log
+	undo    int                    // position in undo log of Globals
+	bits    bitCursor
+	frame   int
+	span    spanState
+	order   binary.ByteOrder
+	checks  int // number of deferred checks
+}
+
+func (p *Context) save() (s ctxState) {
+
+	if vars, ok := p.dom.(*Map); ok {
+		s.dom = vars.clone()
+	} else {
+		s.dom = p.dom
+	}
+	if u := p.Globals.undo; u != nil {
+		s.undo = len(u.entries)
+		u.saves++
+	} else {
+		s.globals = make(map[string]interface{}, len(p.Globals.Impl))
+		for k, v := range p.Globals.Impl {
+			s.globals[k] = v
+		}
+	}
+	if p.bits != nil {
+		s.bits = *p.bits
+	}
+	s.frame = p.Stack.BaseFrame()
+	s.span = p.saveSpan()
+	s.order = p.order
+	if p.checks != nil {
+		s.checks = len(*p.checks)
+	}
+	return
+}
+
+func (p *Context) restore(s ctxState) {
+
+	p.dom = s.dom
+	gbls := p.Globals.Impl
+	if u := p.Globals.undo; u != nil {
+		for i := len(u.entries) - 1; i >= s.undo; i-- {
+			e := u.entries[i]
+			if e.exists {
+				gbls[e.name] = e.old
+			} else {
+				delete(gbls, e.name)
+			}
+		}
+		u.entries = u.entries[:s.undo]
+		p.release()
+	} else {
+		for k := range gbls {
+			delete(gbls, k)
+		}
+		for k, v := range s.globals {
+			gbls[k] = v
+		}
+	}
+	if p.bits != nil {
+		*p.bits = s.bits
+	}
+	p.Stack.SetFrame(s.frame)
+	p.restoreSpan(s.span)
+	p.order = s.order
+	if p.checks != nil { // drop checks of a failed alternative
+		*p.checks = (*p.checks)[:s.checks]
+	}
+}
+
+// commit releases the save point of an alternative after it succeeds.
+//
+func (p *Context) commit() {
+
+	if p.Globals.undo != nil {
+		p.release()
+	}
+}
+
+func (p *Context) release() {
+
+	u := p.Globals.undo
+	if u.saves--; u.saves == 0 { // no one can undo them
+		u.entries = u.entries[:0]
+	}
+}
+
 // SetDom set matching result of matching result.
 //
 func (p *Context) SetDom(v interface{}) {
@@ -169,6 +346,71 @@ func (p *Context) Dom() interface{} {
 	return p.dom
 }
 
+// Start returns the absolute offset where current struct starts. It returns -1
+// if the input stream isn't tracked (see `Context.Tell`).
+//
+func (p *Context) Start() int64 {
+
+	if p.src == nil {
+		return -1
+	}
+	return p.start
+}
+
+// Consumed returns how many bytes current struct has consumed so far. It
+// returns -1 if the input stream isn't tracked.
+//
+func (p *Context) Consumed() int64 {
+
+	if p.src == nil {
+		return -1
+	}
+	return p.Tell() - p.start
+}
+
+// Index returns the index of current element in the innermost repetition. It
+// returns -1 if not in a repetition.
+//
+func (p *Context) Index() int {
+
+	return p.index
+}
+
+// ParentDom returns matching result of the struct which contains current
+// struct, or nil if there isn't one.
+//
+func (p *Context) ParentDom() interface{} {
+
+	q := p.structFrame()
+	if q == nil || q.Parent == nil {
+		return nil
+	}
+	if q = q.Parent.structFrame(); q != nil {
+		return q.dom
+	}
+	return nil
+}
+
+// structFrame returns the Context of current struct, or nil if not in a struct.
+//
+func (p *Context) structFrame() *Context {
+
+	for p != nil && !p.frame {
+		p = p.Parent
+	}
+	return p
+}
+
+// RootDom returns matching result of the outermost Context.
+//
+func (p *Context) RootDom() interface{} {
+
+	for p.Parent != nil {
+		p = p.Parent
+	}
+	return p.dom
+}
+
 // -----------------------------------------------------------------------------
 
 // A Ruler interface is required to a matching unit.
@@ -194,6 +436,7 @@ func MatchStream(r Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err er
 	if ok {
 		glbs.SetVar("BPL_IN", old)
 	}
+	ctx.endSpan()
 	return
 }
 
@@ -203,33 +446,53 @@ type fileLine struct {
 	r    Ruler
 	file string
 	line int
+	name string // name of the rule, see `Named`
 }
 
-type errorAt struct {
-	Err error
-	Buf []byte
+// causeOf returns the original error of err wrapped by MatchError or PartialError.
+//
+func causeOf(err error) error {
+
+	for {
+		switch e := err.(type) {
+		case *exec.Error:
+			err = e.Err
+		case *MatchError:
+			err = e.Err
+		case *PartialError:
+			err = e.Err
+		default:
+			return err
+		}
+	}
 }
 
-func (p *errorAt) Error() string {
-
-	b := make([]byte, 0, 32)
-	b = append(b, p.Err.Error()...)
-	b = append(b, '\n')
+func (p *fileLine) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	w := bytes.NewBuffer(b)
-	d := hex.Dumper(w)
-	d.Write(p.Buf)
-	d.Close()
-	return string(w.Bytes())
+	if p.name != "" { // a named rule, eg. a rule or a template of bpl.ext
+		if err = ctx.enter(); err != nil {
+			return
+		}
+		defer ctx.leave()
+		ctx.setSpanRule(p.name)
+	}
+	v, err = doMatch(p.r, in, ctx)
+	if err != nil {
+		err = matchError(err, pathElem{name: p.name, rule: true}, in, ctx)
+		if e := matchErrorOf(err); e.File == "" {
+			e.File, e.Line = p.file, p.line
+		}
+	}
+	return
 }
 
-func (p *fileLine) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+func (p *fileLine) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
 
-	v, err = doMatch(p.r, in, ctx)
+	err = doEncode(p.r, w, dom, ctx)
 	if err != nil {
 		if _, ok := err.(*exec.Error); !ok {
 			err = &exec.Error{
-				Err:   &errorAt{Err: err, Buf: bufiox.Buffer(in)},
+				Err:   err,
 				File:  p.file,
 				Line:  p.line,
 				Stack: debug.Stack(),
@@ -277,4 +540,16 @@ func FileLine(file string, line int, R Ruler) Ruler {
 	return &fileLine{r: R, file: file, line: line}
 }
 
+// Named gives matching unit R a name, which is used in rule path of MatchError.
+//
+func Named(name string, R Ruler) Ruler {
+
+	if r, ok := R.(*fileLine); ok {
+		named := *r
+		named.name = name
+		return &named
+	}
+	return &fileLine{r: R, name: name}
+}
+
 // -----------------------------------------------------------------------------
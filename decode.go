@@ -0,0 +1,219 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+)
+
+var (
+	// ErrDecodedTooLarge is returned when decoded data exceeds Limits.MaxDecodedSize.
+	ErrDecodedTooLarge = errors.New("decoded data is too large")
+
+	// ErrSnappyCorrupt is returned when snappy compressed data is corrupt.
+	ErrSnappyCorrupt = errors.New("snappy: corrupt input")
+)
+
+// -----------------------------------------------------------------------------
+
+// A Codec returns a reader that decodes (eg. decompresses) input stream r.
+// maxSize is the max bytes of decoded data (see Limits.MaxDecodedSize), the
+// reader needn't enforce it, but a codec can bound its input by it.
+//
+type Codec func(r io.Reader, maxSize int) (io.Reader, error)
+
+// Codecs holds all codecs known by name. It is used by `decode "<codec>"`
+// of bpl.ext, and can be extended by users.
+//
+var Codecs = map[string]Codec{
+	"zlib":    newZlibReader,
+	"deflate": newFlateReader,
+	"gzip":    newGzipReader,
+	"snappy":  newSnappyReader,
+}
+
+func newZlibReader(r io.Reader, maxSize int) (io.Reader, error) {
+
+	return zlib.NewReader(r)
+}
+
+func newFlateReader(r io.Reader, maxSize int) (io.Reader, error) {
+
+	return flate.NewReader(r), nil
+}
+
+func newGzipReader(r io.Reader, maxSize int) (io.Reader, error) {
+
+	return gzip.NewReader(r)
+}
+
+// newSnappyReader decodes data in snappy block format (without stream framing).
+// The input is limited to the max encoded size of maxSize bytes.
+//
+func newSnappyReader(r io.Reader, maxSize int) (io.Reader, error) {
+
+	max := snappyMaxEncodedLen(maxSize)
+	src, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(src) > max {
+		return nil, ErrDecodedTooLarge
+	}
+	dst, err := snappyDecode(src, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(dst), nil
+}
+
+// snappyMaxEncodedLen returns the max size of snappy compressed data of n bytes.
+//
+func snappyMaxEncodedLen(n int) int {
+
+	return 32 + n + n/6
+}
+
+func snappyDecode(src []byte, maxSize int) ([]byte, error) {
+
+	n, i := binary.Uvarint(src)
+	if i <= 0 || n > 0xffffffff {
+		return nil, ErrSnappyCorrupt
+	}
+	if n > uint64(maxSize) {
+		return nil, ErrDecodedTooLarge
+	}
+	dst := make([]byte, 0, int(n))
+	for i < len(src) {
+		tag := src[i]
+		i++
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag >> 2)
+			if length >= 60 {
+				m := length - 59
+				if i+m > len(src) {
+					return nil, ErrSnappyCorrupt
+				}
+				length = 0
+				for k := m - 1; k >= 0; k-- {
+					length = (length << 8) | int(src[i+k])
+				}
+				i += m
+			}
+			length++
+			if length <= 0 || i+length > len(src) || len(dst)+length > int(n) {
+				return nil, ErrSnappyCorrupt
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+			continue
+		case 1: // copy with 1-byte offset
+			if i >= len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 4 + int((tag>>2)&7)
+			offset = int(tag&0xe0)<<3 | int(src[i])
+			i++
+		case 2: // copy with 2-byte offset
+			if i+2 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[i:]))
+			i += 2
+		default: // copy with 4-byte offset
+			if i+4 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[i:]))
+			i += 4
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, ErrSnappyCorrupt
+		}
+		for k := 0; k < length; k++ { // regions may overlap
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, ErrSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// -----------------------------------------------------------------------------
+
+type decode struct {
+	codec Codec
+	n     func(ctx *Context) int
+	r     Ruler
+}
+
+func (p *decode) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	var r io.Reader = in
+	if p.n != nil {
+		r = io.LimitReader(in, int64(p.n(ctx)))
+	}
+	max := ctx.maxDecodedSize()
+	dr, err := p.codec(r, max)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadAll(&allocReader{r: io.LimitReader(dr, int64(max)+1), ctx: ctx})
+	if c, ok := dr.(io.Closer); ok {
+		c.Close()
+	}
+	if err != nil {
+		return
+	}
+	if len(b) > max {
+		return nil, ErrDecodedTooLarge
+	}
+	if p.n != nil { // skip the rest of n bytes
+		_, err = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return
+		}
+	}
+
+	old := ctx.src
+	ctx.src = newSourceBuffer(b, 0)
+	ctx.src.ra = bytes.NewReader(b)
+	defer func() {
+		ctx.src = old
+	}()
+	return MatchStream(p.r, ctx.src.in, ctx)
+}
+
+func (p *decode) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *decode) SizeOf() int {
+
+	return -1
+}
+
+// Decode returns a matching unit that decodes next n(ctx) bytes (or the rest
+// of input stream if n is nil) with codec, and matches the decoded data with R.
+// The size of decoded data is limited by Limits.MaxDecodedSize.
+//
+func Decode(codec Codec, n func(ctx *Context) int, r Ruler) Ruler {
+
+	return &decode{codec: codec, n: n, r: r}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,78 @@
+package bpl_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestDecode(t *testing.T) {
+
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write([]byte("hello, bpl"))
+	zw.Close()
+	n := b.Len()
+	b.Write([]byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}) // snappy: "abcabcabcabc"
+
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Decode(bpl.Codecs["zlib"], func(ctx *bpl.Context) int { return n }, bpl.Dynarray(bpl.Char, func(ctx *bpl.Context) int { return 10 }))},
+		&bpl.Member{Name: "b", Type: bpl.Decode(bpl.Codecs["snappy"], nil, bpl.Dynarray(bpl.Char, func(ctx *bpl.Context) int { return 12 }))},
+	})
+	ctx := bpl.NewContext()
+	_, err := r.Match(ctx.NewReaderBuffer(b.Bytes()), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if v, _ := ctx.Var("a"); v != "hello, bpl" {
+		t.Fatal("a:", v)
+	}
+	if v, _ := ctx.Var("b"); v != "abcabcabcabc" {
+		t.Fatal("b:", v)
+	}
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDecodedSize: 8})
+	_, err = r.Match(ctx.NewReaderBuffer(b.Bytes()), ctx)
+	if !errors.Is(err, bpl.ErrDecodedTooLarge) {
+		t.Fatal("Match:", err)
+	}
+
+	// snappy input larger than the max encoded size of maxSize bytes
+	_, err = bpl.Codecs["snappy"](bytes.NewReader(make([]byte, 64)), 8)
+	if err != bpl.ErrDecodedTooLarge {
+		t.Fatal("snappy:", err)
+	}
+}
+
+type zeroReader struct {
+	n int // bytes read so far
+}
+
+func (p *zeroReader) Read(b []byte) (int, error) {
+
+	for i := range b {
+		b[i] = 0
+	}
+	p.n += len(b)
+	return len(b), nil
+}
+
+func TestDecodeMaxAlloc(t *testing.T) {
+
+	zr := new(zeroReader)
+	codec := func(r io.Reader, maxSize int) (io.Reader, error) {
+		return zr, nil
+	}
+	ctx := bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 1000})
+	_, err := bpl.Decode(codec, nil, bpl.ByteArray0).Match(ctx.NewReaderBuffer(nil), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+	if zr.n > 64<<10 { // decoding stops soon, rather than at DefaultMaxDecodedSize
+		t.Fatal("decoded:", zr.n)
+	}
+}
@@ -0,0 +1,268 @@
+package bpl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+
+// An Encoder interface is implemented by a matching unit that can encode a
+// matching result back to bytes.
+//
+type Encoder interface {
+	// Encode encodes `dom`, a matching result of this matching unit, and writes it to `w`.
+	Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error
+}
+
+// An EncodeError is returned when a matching unit can't encode a value.
+//
+type EncodeError struct {
+	R   Ruler
+	Dom interface{}
+	Msg string
+}
+
+func (p *EncodeError) Error() string {
+
+	return fmt.Sprintf("bpl.Encode %T: %s (dom: %v)", p.R, p.Msg, p.Dom)
+}
+
+// Encode encodes `dom`, a matching result of R, and writes it to `w`. It is
+// the counterpart of `R.Match`.
+//
+// Members missing in `dom` which have a fixed size are written as zero bytes,
+// and can be back-patched later by `let <member> = <expr>`.
+//
+func Encode(R Ruler, w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	if ctx.enc == nil {
+		ctx.enc = &encodeState{pending: make(map[pendingKey]*pendingVar), bases: make(map[*bytes.Buffer]int)}
+	}
+	if e, ok := R.(Encoder); ok {
+		return e.Encode(w, dom, ctx)
+	}
+	return &EncodeError{R: R, Dom: dom, Msg: "unsupported matching unit"}
+}
+
+// -----------------------------------------------------------------------------
+
+type pendingKey struct {
+	ctx  *Context
+	name string
+}
+
+type pendingVar struct {
+	r   Ruler
+	w   *bytes.Buffer
+	off int
+}
+
+type encodeState struct {
+	pending map[pendingKey]*pendingVar
+	bits    bitWriter
+	bases   map[*bytes.Buffer]int // offsets of temporary buffers in output
+	origin  int                   // offset where current `read` region starts
+}
+
+// tell returns current offset of output, if `w` is the output or a temporary
+// buffer (see `alt.Encode`).
+//
+func (p *encodeState) tell(w *bytes.Buffer) int {
+
+	return p.bases[w] + w.Len()
+}
+
+func (p *encodeState) rebase(from, to *bytes.Buffer, base int) {
+
+	for _, v := range p.pending {
+		if v.w == from {
+			v.w, v.off = to, v.off+base
+		}
+	}
+}
+
+func (p *Context) setPending(name string, r Ruler, w *bytes.Buffer) {
+
+	size := r.SizeOf()
+	w.Write(make([]byte, size))
+	p.enc.pending[pendingKey{p, name}] = &pendingVar{r: r, w: w, off: w.Len() - size}
+}
+
+func (p *Context) patch(name string, v interface{}) {
+
+	key := pendingKey{p, name}
+	pv, ok := p.enc.pending[key]
+	if !ok {
+		return
+	}
+	var b bytes.Buffer
+	if err := Encode(pv.r, &b, v, p.NewSub()); err != nil {
+		panic(err)
+	}
+	copy(pv.w.Bytes()[pv.off:], b.Bytes())
+}
+
+// -----------------------------------------------------------------------------
+
+func toInt64(v interface{}) (int64, bool) {
+
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := val.Float64(); err == nil {
+			return int64(f), true
+		}
+		return 0, false
+	case bool:
+		if val {
+			return 1, true
+		}
+		return 0, true
+	case EnumValue:
+		return toInt64(val.Val)
+	}
+	rv := reflect.ValueOf(v)
+	switch kind := rv.Kind(); {
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		return rv.Int(), true
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		return int64(rv.Uint()), true
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		return int64(rv.Float()), true
+	}
+	return 0, false
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+
+	if val, ok := v.(EnumValue); ok {
+		v = val.Val
+	}
+	if val, ok := v.(json.Number); ok {
+		if u, err := strconv.ParseUint(string(val), 0, 64); err == nil {
+			return u, true
+		}
+	}
+	rv := reflect.ValueOf(v)
+	if kind := rv.Kind(); kind >= reflect.Uint && kind <= reflect.Uintptr {
+		return rv.Uint(), true
+	}
+	i, ok := toInt64(v)
+	return uint64(i), ok
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+
+	if val, ok := v.(json.Number); ok {
+		f, err := val.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch kind := rv.Kind(); {
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		return rv.Float(), true
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		return float64(rv.Uint()), true
+	}
+	i, ok := toInt64(v)
+	return float64(i), ok
+}
+
+// normalize converts a numeric value (eg. a float64 or json.Number decoded
+// from JSON) or a byte array (eg. a base64 string) to type t.
+//
+func normalize(v interface{}, t reflect.Type) interface{} {
+
+	switch kind := t.Kind(); {
+	case kind == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		if b, ok := toBytes(v); ok {
+			return b
+		}
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		if i, ok := toInt64(v); ok {
+			return reflect.ValueOf(i).Convert(t).Interface()
+		}
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		if u, ok := toUint64(v); ok {
+			return reflect.ValueOf(u).Convert(t).Interface()
+		}
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		if f, ok := toFloat64(v); ok {
+			return reflect.ValueOf(f).Convert(t).Interface()
+		}
+	}
+	return v
+}
+
+// toBytes converts `dom` to []byte. A string is decoded as base64 (that is
+// how json.Marshal encodes []byte).
+//
+func toBytes(dom interface{}) (b []byte, ok bool) {
+
+	switch v := dom.(type) {
+	case []byte:
+		return v, true
+	case nil:
+		return nil, true
+	case string:
+		b, err := base64.StdEncoding.DecodeString(v)
+		return b, err == nil
+	case []interface{}:
+		b = make([]byte, len(v))
+		for i, e := range v {
+			u, ok := toUint64(e)
+			if !ok {
+				return nil, false
+			}
+			b[i] = byte(u)
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+func encodeArray(R Ruler, w *bytes.Buffer, dom interface{}, ctx *Context) (n int, err error) {
+
+	if dom == nil {
+		return
+	}
+	v := reflect.ValueOf(dom)
+	if v.Kind() != reflect.Slice {
+		return 0, &EncodeError{R: R, Dom: dom, Msg: "array isn't a slice"}
+	}
+	n = v.Len()
+	for i := 0; i < n; i++ {
+		err = Encode(R, w, v.Index(i).Interface(), ctx.NewSub())
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func doEncode(R Ruler, w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case string:
+				err = &EncodeError{R: R, Dom: dom, Msg: v}
+			case error:
+				err = v
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	return Encode(R, w, dom, ctx)
+}
+
+// -----------------------------------------------------------------------------
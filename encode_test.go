@@ -0,0 +1,69 @@
+package bpl_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestEncode(t *testing.T) {
+
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint16},
+		&bpl.Member{Name: "b", Type: bpl.Uintbe(3)},
+		&bpl.Member{Name: "c", Type: bpl.CString},
+		&bpl.Member{Name: "flag", Type: bpl.Bits(3)},
+		&bpl.Member{Name: "code", Type: bpl.Ue},
+		&bpl.Member{Name: "d", Type: bpl.Array(bpl.Uint8, 2)},
+		&bpl.Member{Name: "e", Type: bpl.Float32be},
+	})
+	dom := map[string]interface{}{
+		"a":    uint16(0x1234),
+		"b":    0x56789a,
+		"c":    "bpl",
+		"flag": 5,
+		"code": 3,
+		"d":    []interface{}{1.0, 2.0},
+		"e":    1.5,
+	}
+
+	var w bytes.Buffer
+	err := bpl.Encode(r, &w, dom, bpl.NewContext())
+	if err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	b := w.Bytes()
+	if !bytes.Equal(b, []byte{0x34, 0x12, 0x56, 0x78, 0x9a, 'b', 'p', 'l', 0, 0xa4, 1, 2, 0x3f, 0xc0, 0, 0}) {
+		t.Fatal("Encode:", b)
+	}
+
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	expected := map[string]interface{}{
+		"a":    uint16(0x1234),
+		"b":    uint(0x56789a),
+		"c":    "bpl",
+		"flag": uint(5),
+		"code": uint(3),
+		"d":    []uint8{1, 2},
+		"e":    float32(1.5),
+	}
+	vars := v.(*bpl.Map)
+	if !reflect.DeepEqual(vars.Vals(), expected) {
+		t.Fatal("Match:", v)
+	}
+	if keys := vars.Keys(); !reflect.DeepEqual(keys, []string{"a", "b", "c", "flag", "code", "d", "e"}) {
+		t.Fatal("Keys:", keys)
+	}
+
+	w.Reset()
+	err = bpl.Encode(r, &w, map[string]interface{}{"a": 1}, bpl.NewContext())
+	if _, ok := err.(*bpl.EncodeError); !ok {
+		t.Fatal("Encode:", err)
+	}
+}
@@ -0,0 +1,163 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+)
+
+// -----------------------------------------------------------------------------
+
+// ByteOrder returns the byte order of unsuffixed builtin types (BaseType, eg.
+// uint32) in current Context. It is binary.LittleEndian by default.
+//
+func (p *Context) ByteOrder() binary.ByteOrder {
+
+	if p.order == nil {
+		return binary.LittleEndian
+	}
+	return p.order
+}
+
+// SetByteOrder sets the byte order of unsuffixed builtin types in current
+// Context, and the Contexts created from it later (eg. members of a struct).
+//
+func (p *Context) SetByteOrder(order binary.ByteOrder) {
+
+	p.order = order
+}
+
+// byteOrderOf returns the byte order of a BaseType matched in Context `ctx`.
+//
+func byteOrderOf(ctx *Context) binary.ByteOrder {
+
+	if ctx == nil {
+		return binary.LittleEndian
+	}
+	return ctx.ByteOrder()
+}
+
+func readBits(in *bufio.Reader, n int, order binary.ByteOrder) (u uint64, err error) {
+
+	t, err := in.Peek(n)
+	if err != nil {
+		return
+	}
+	switch n {
+	case 1:
+		u = uint64(t[0])
+	case 2:
+		u = uint64(order.Uint16(t))
+	case 4:
+		u = uint64(order.Uint32(t))
+	default:
+		u = order.Uint64(t)
+	}
+	in.Discard(n)
+	return
+}
+
+func writeBits(w *bytes.Buffer, u uint64, n int, order binary.ByteOrder) {
+
+	var b [8]byte
+	switch n {
+	case 1:
+		b[0] = byte(u)
+	case 2:
+		order.PutUint16(b[:], uint16(u))
+	case 4:
+		order.PutUint32(b[:], uint32(u))
+	default:
+		order.PutUint64(b[:], u)
+	}
+	w.Write(b[:n])
+}
+
+// -----------------------------------------------------------------------------
+
+// A BaseTypeLE represents a matching unit of a builtin fixed size type in
+// little endian byte order, whatever the byte order of the Context is. Its
+// matching result has the same type as BaseType.
+//
+type BaseTypeLE uint
+
+// Match is required by a matching unit. see Ruler interface.
+//
+func (p BaseTypeLE) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	return baseTypes[p].read(in)
+}
+
+// Encode is the counterpart of Match. see Encoder interface.
+//
+func (p BaseTypeLE) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	val, err := bitsOf(p, reflect.Kind(p), dom)
+	if err != nil {
+		return err
+	}
+	writeBits(w, val, baseTypes[p].sizeOf, binary.LittleEndian)
+	return nil
+}
+
+// RetType returns matching result type.
+//
+func (p BaseTypeLE) RetType() reflect.Type {
+
+	return baseTypes[p].typ
+}
+
+// SizeOf is required by a matching unit. see Ruler interface.
+//
+func (p BaseTypeLE) SizeOf() int {
+
+	return baseTypes[p].sizeOf
+}
+
+// -----------------------------------------------------------------------------
+
+type endian struct {
+	order func(ctx *Context) binary.ByteOrder
+	r     Ruler
+}
+
+func (p *endian) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	old := ctx.order
+	ctx.order = p.order(ctx)
+	defer func() {
+		ctx.order = old
+	}()
+	return p.r.Match(in, ctx)
+}
+
+func (p *endian) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	old := ctx.order
+	ctx.order = p.order(ctx)
+	defer func() {
+		ctx.order = old
+	}()
+	return Encode(p.r, w, dom, ctx)
+}
+
+func (p *endian) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *endian) SizeOf() int {
+
+	return p.r.SizeOf()
+}
+
+// Endian returns a matching unit that matches R with unsuffixed builtin types
+// (BaseType) in byte order order(ctx), which is evaluated at matching time.
+//
+func Endian(order func(ctx *Context) binary.ByteOrder, r Ruler) Ruler {
+
+	return &endian{order: order, r: r}
+}
+
+// -----------------------------------------------------------------------------
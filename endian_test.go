@@ -0,0 +1,130 @@
+package bpl_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestByteOrder(t *testing.T) {
+
+	ctx := bpl.NewContext()
+	if ctx.ByteOrder() != binary.LittleEndian {
+		t.Fatal("default byte order isn't little endian")
+	}
+	b := []byte{1, 2, 1, 2, 0, 0, 0x80, 0x3f, 1, 2, 3, 4}
+	in := ctx.NewReaderBuffer(b)
+	ctx.SetByteOrder(binary.BigEndian)
+	r := bpl.Seq(bpl.Uint16, bpl.BaseTypeLE(bpl.Uint16), bpl.BaseTypeLE(bpl.Float32), bpl.BaseArray(bpl.Uint16, 2))
+	v, err := r.Match(in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `[258,513,1,[258,772]]` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	var w bytes.Buffer
+	if err = bpl.Encode(r, &w, v, ctx); err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	if !bytes.Equal(w.Bytes(), b) {
+		t.Fatal("Encode:", w.Bytes())
+	}
+}
+
+func TestBaseArrayByteOrder(t *testing.T) {
+
+	b := []byte{
+		1, 2, 3, 4,
+		0, 0, 0, 1, 0xff, 0xff, 0xff, 0xfe,
+		0x3f, 0xf0, 0, 0, 0, 0, 0, 0,
+	}
+	r := bpl.Seq(bpl.BaseArray(bpl.Uint16, 2), bpl.BaseArray(bpl.Int32, 2), bpl.BaseArray(bpl.Float64, 1))
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		ctx := bpl.NewContext()
+		ctx.SetByteOrder(order)
+		v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+		if err != nil {
+			t.Fatal("Match failed:", err)
+		}
+		expected := []interface{}{
+			[]uint16{order.Uint16(b[0:]), order.Uint16(b[2:])},
+			[]int32{int32(order.Uint32(b[4:])), int32(order.Uint32(b[8:]))},
+			[]float64{math.Float64frombits(order.Uint64(b[12:]))},
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Fatal(order, "ret:", v)
+		}
+		var w bytes.Buffer
+		if err = bpl.Encode(r, &w, v, ctx); err != nil {
+			t.Fatal("Encode failed:", err)
+		}
+		if !bytes.Equal(w.Bytes(), b) {
+			t.Fatal(order, "Encode:", w.Bytes())
+		}
+	}
+}
+
+func TestEndian(t *testing.T) {
+
+	big := func(ctx *bpl.Context) binary.ByteOrder {
+		return binary.BigEndian
+	}
+	hdr := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint32},
+		&bpl.Member{Name: "b", Type: bpl.Int16},
+	})
+	r := bpl.Seq(bpl.Endian(big, hdr), bpl.Uint16)
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer([]byte{0, 0, 0, 1, 0xff, 0xfe, 1, 0}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `[{"a":1,"b":-2},1]` {
+		t.Fatal("ret:", string(ret))
+	}
+	if ctx.ByteOrder() != binary.LittleEndian {
+		t.Fatal("byte order isn't restored")
+	}
+}
+
+type orderType struct {
+	A uint16
+	B uint16 `bpl:",le"`
+	C uint16 `bpl:",be"`
+}
+
+func TestTypeFromOrder(t *testing.T) {
+
+	r, err := bpl.TypeFrom(reflect.TypeOf(orderType{}))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	ctx := bpl.NewContext()
+	ctx.SetByteOrder(binary.BigEndian)
+	v, err := r.Match(ctx.NewReaderBuffer([]byte{1, 0, 1, 0, 1, 0}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"a":256,"b":1,"c":256}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
@@ -0,0 +1,176 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// An EnumItem is a symbolic name of an Enum.
+//
+type EnumItem struct {
+	Name string
+	Val  uint64
+}
+
+// An Enum is a matching unit of an enum (or flag set) declaration. It matches
+// like its base type, and its matching result is an EnumValue, which knows the
+// symbolic names of the value.
+//
+type Enum struct {
+	Name  string
+	Base  Ruler
+	Items []EnumItem
+	Flags bool // a flag set: a value is a combination of items
+}
+
+// Match is required by a matching unit. see Ruler interface.
+//
+func (p *Enum) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	v, err = p.Base.Match(in, ctx)
+	if err != nil {
+		return
+	}
+	return EnumValue{Val: v, Type: p}, nil
+}
+
+// Encode is the counterpart of Match. `dom` can be an EnumValue, an integer or
+// a symbolic name. see Encoder interface.
+//
+func (p *Enum) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	switch v := dom.(type) {
+	case EnumValue:
+		dom = v.Val
+	case string:
+		val, ok := p.valueOf(v)
+		if !ok {
+			return &EncodeError{R: p, Dom: dom, Msg: "unknown name of " + p.Name}
+		}
+		dom = val
+	}
+	return Encode(p.Base, w, dom, ctx)
+}
+
+// valueOf returns the value of a symbolic name. For a flag set, `name` can be
+// a combination of items, eg. `READONLY|HIDDEN`.
+//
+func (p *Enum) valueOf(name string) (val uint64, ok bool) {
+
+	parts := []string{name}
+	if p.Flags {
+		parts = strings.Split(name, "|")
+	}
+	for _, part := range parts {
+		found := false
+		for _, item := range p.Items {
+			if item.Name == part {
+				val |= item.Val
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return val, true
+}
+
+// RetType returns matching result type.
+//
+func (p *Enum) RetType() reflect.Type {
+
+	return tyEnumValue
+}
+
+// SizeOf returns expected length of result.
+//
+func (p *Enum) SizeOf() int {
+
+	return p.Base.SizeOf()
+}
+
+// -----------------------------------------------------------------------------
+
+// An EnumValue is the matching result of an Enum.
+//
+type EnumValue struct {
+	Val  interface{} // matching result of the base type
+	Type *Enum
+}
+
+var tyEnumValue = reflect.TypeOf(EnumValue{})
+
+// Uint returns the value as an unsigned integer.
+//
+func (v EnumValue) Uint() uint64 {
+
+	u, _ := toUint64(v.Val)
+	return u
+}
+
+// Name returns the symbolic name of the value. For a flag set, it is names of
+// all items set joined by `|`, and bits not named are appended in hex. It
+// returns "" if there isn't a name.
+//
+func (v EnumValue) Name() string {
+
+	u := v.Uint()
+	if !v.Type.Flags {
+		for _, item := range v.Type.Items {
+			if item.Val == u {
+				return item.Name
+			}
+		}
+		return ""
+	}
+	var names []string
+	rest := u
+	for _, item := range v.Type.Items {
+		if item.Val != 0 && u&item.Val == item.Val {
+			names = append(names, item.Name)
+			rest &^= item.Val
+		}
+	}
+	if names == nil {
+		return ""
+	}
+	if rest != 0 {
+		names = append(names, "0x"+strconv.FormatUint(rest, 16))
+	}
+	return strings.Join(names, "|")
+}
+
+// String returns the value with its symbolic name, eg. `2 (B)`, or `0x5
+// (READONLY|HIDDEN)` for a flag set.
+//
+func (v EnumValue) String() string {
+
+	var s string
+	if v.Type.Flags {
+		s = "0x" + strconv.FormatUint(v.Uint(), 16)
+	} else if i, ok := toInt64(v.Val); ok {
+		s = strconv.FormatInt(i, 10)
+	}
+	if name := v.Name(); name != "" {
+		return s + " (" + name + ")"
+	}
+	return s
+}
+
+// MarshalJSON is required by json.Marshal. An EnumValue is marshaled as its
+// base value.
+//
+func (v EnumValue) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(v.Val)
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,57 @@
+package bpl_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestEnum(t *testing.T) {
+
+	attr := &bpl.Enum{
+		Name:  "Attr",
+		Base:  bpl.Uint8,
+		Items: []bpl.EnumItem{{Name: "READONLY", Val: 1}, {Name: "HIDDEN", Val: 4}},
+		Flags: true,
+	}
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: attr},
+		&bpl.Member{Name: "b", Type: attr},
+	})
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer([]byte{0x0d, 2}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	vars := v.(*bpl.Map)
+	a, _ := vars.Get("a")
+	if s := a.(bpl.EnumValue).String(); s != "0xd (READONLY|HIDDEN|0x8)" {
+		t.Fatal("a:", s)
+	}
+	b, _ := vars.Get("b")
+	if s := b.(bpl.EnumValue).String(); s != "0x2" {
+		t.Fatal("b:", s)
+	}
+
+	var ret struct {
+		A uint8
+		B bpl.EnumValue
+	}
+	if err = bpl.Unmarshal(v, &ret); err != nil || ret.A != 0x0d || ret.B.Uint() != 2 {
+		t.Fatal("Unmarshal:", ret, err)
+	}
+
+	var w bytes.Buffer
+	dom := map[string]interface{}{"a": "READONLY|HIDDEN", "b": b}
+	if err = bpl.Encode(r, &w, dom, bpl.NewContext()); err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	if !bytes.Equal(w.Bytes(), []byte{5, 2}) {
+		t.Fatal("Encode:", w.Bytes())
+	}
+	dom["a"] = "WRITABLE"
+	if err = bpl.Encode(r, &w, dom, bpl.NewContext()); err == nil {
+		t.Fatal("Encode: no error for unknown name")
+	}
+}
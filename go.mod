@@ -6,6 +6,7 @@ require (
 	github.com/qiniu/text v1.9.2
 	github.com/qiniu/x v1.17.0
 	github.com/xushiwei/qlang v1.2.2
+	golang.org/x/text v0.3.6
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -0,0 +1,231 @@
+package bpl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	// ErrNegativeLength is returned when a length (eg. n of `[n]R`) is negative.
+	ErrNegativeLength = errors.New("negative length")
+)
+
+const maxInt = int(^uint(0) >> 1)
+
+// -----------------------------------------------------------------------------
+
+// Limits restricts resources used by matching, to guard against hostile input.
+// A zero value of a field means unlimited.
+//
+type Limits struct {
+	MaxAlloc       int             // max bytes of a single allocation, eg. `[n]byte`, `read n do R`
+	MaxTotalAlloc  int64           // max bytes of all allocations
+	MaxDepth       int             // max recursion depth of named rules (see `Named`) and TypeVars
+	MaxRepeat      int             // max element count of a repetition, eg. `[n]R`, `*R`, `R+`
+	MaxDecodedSize int             // max bytes of decoded data of `Decode`, zero means DefaultMaxDecodedSize
+	Context        context.Context // matching stops when Context is done (eg. deadline exceeded)
+}
+
+// DefaultMaxDecodedSize is the default of Limits.MaxDecodedSize. Unlike other
+// limits, decoded data is always limited, to guard against decompression bombs.
+//
+const DefaultMaxDecodedSize = 64 << 20
+
+// A LimitError is returned when a limit of Limits is exceeded.
+//
+type LimitError struct {
+	Name  string // name of the limit: MaxAlloc, MaxTotalAlloc, MaxDepth or MaxRepeat
+	Limit int64
+	Value int64
+}
+
+func (p *LimitError) Error() string {
+
+	return fmt.Sprintf("limit %s exceeded: %d > %d", p.Name, p.Value, p.Limit)
+}
+
+type limitState struct {
+	Limits
+	total int64
+	depth int
+}
+
+// SetLimits sets resource limits of matching. It applies to this Context and
+// all its sub Contexts created after.
+//
+func (p *Context) SetLimits(l Limits) {
+
+	p.limits = &limitState{Limits: l}
+}
+
+// Limits returns resource limits of matching.
+//
+func (p *Context) Limits() Limits {
+
+	if p.limits == nil {
+		return Limits{}
+	}
+	return p.limits.Limits
+}
+
+// maxDecodedSize returns the max bytes of decoded data of `Decode`.
+//
+func (p *Context) maxDecodedSize() int {
+
+	if p == nil || p.limits == nil || p.limits.MaxDecodedSize <= 0 {
+		return DefaultMaxDecodedSize
+	}
+	return p.limits.MaxDecodedSize
+}
+
+func (p *limitState) done() error {
+
+	if c := p.Context; c != nil {
+		return c.Err()
+	}
+	return nil
+}
+
+func (p *Context) checkDone() error {
+
+	if p == nil || p.limits == nil {
+		return nil
+	}
+	return p.limits.done()
+}
+
+// alloc checks if n bytes can be allocated.
+//
+func (p *Context) alloc(n int) error {
+
+	if n < 0 {
+		return ErrNegativeLength
+	}
+	if p == nil || p.limits == nil {
+		return nil
+	}
+	l := p.limits
+	if l.MaxAlloc > 0 && n > l.MaxAlloc {
+		return &LimitError{Name: "MaxAlloc", Limit: int64(l.MaxAlloc), Value: int64(n)}
+	}
+	if l.MaxTotalAlloc > 0 && l.total+int64(n) > l.MaxTotalAlloc {
+		return &LimitError{Name: "MaxTotalAlloc", Limit: l.MaxTotalAlloc, Value: l.total + int64(n)}
+	}
+	l.total += int64(n)
+	return l.done()
+}
+
+// grow checks if an allocation of size bytes can grow n bytes.
+//
+func (p *Context) grow(size, n int) error {
+
+	if p == nil || p.limits == nil {
+		return nil
+	}
+	l := p.limits
+	if l.MaxAlloc > 0 && size+n > l.MaxAlloc {
+		return &LimitError{Name: "MaxAlloc", Limit: int64(l.MaxAlloc), Value: int64(size + n)}
+	}
+	if l.MaxTotalAlloc > 0 && l.total+int64(n) > l.MaxTotalAlloc {
+		return &LimitError{Name: "MaxTotalAlloc", Limit: l.MaxTotalAlloc, Value: l.total + int64(n)}
+	}
+	l.total += int64(n)
+	return l.done()
+}
+
+// allocReader reads from r, and checks the bytes read so far with alloc as they
+// are read, eg. the output of a decompressor.
+//
+type allocReader struct {
+	r   io.Reader
+	ctx *Context
+	n   int
+}
+
+func (p *allocReader) Read(b []byte) (n int, err error) {
+
+	n, err = p.r.Read(b)
+	if n > 0 {
+		if e := p.ctx.grow(p.n, n); e != nil {
+			return 0, e
+		}
+		p.n += n
+	}
+	return
+}
+
+// allocn checks if n elements of size bytes can be allocated.
+//
+func (p *Context) allocn(n, size int) error {
+
+	if size > 0 && n > maxInt/size {
+		return p.alloc(maxInt)
+	}
+	return p.alloc(n * size)
+}
+
+// repeated checks if a repetition can have n elements.
+//
+func (p *Context) repeated(n int) error {
+
+	if n < 0 {
+		return ErrNegativeLength
+	}
+	if p == nil || p.limits == nil {
+		return nil
+	}
+	l := p.limits
+	if l.MaxRepeat > 0 && n > l.MaxRepeat {
+		return &LimitError{Name: "MaxRepeat", Limit: int64(l.MaxRepeat), Value: int64(n)}
+	}
+	return l.done()
+}
+
+// enter increases recursion depth. If it succeeds, leave must be called later.
+//
+func (p *Context) enter() error {
+
+	if p == nil || p.limits == nil {
+		return nil
+	}
+	l := p.limits
+	if l.MaxDepth > 0 && l.depth >= l.MaxDepth {
+		return &LimitError{Name: "MaxDepth", Limit: int64(l.MaxDepth), Value: int64(l.depth + 1)}
+	}
+	if err := l.done(); err != nil {
+		return err
+	}
+	l.depth++
+	return nil
+}
+
+func (p *Context) leave() {
+
+	if p != nil && p.limits != nil {
+		p.limits.depth--
+	}
+}
+
+// readAll reads the rest of input stream, and checks its size with alloc.
+//
+func (p *Context) readAll(in *bufio.Reader) (b []byte, err error) {
+
+	if p == nil || p.limits == nil || p.limits.MaxAlloc <= 0 {
+		b, err = ioutil.ReadAll(in) // bufiox.ReadAll ignores bytes read already if in is a ReaderBuffer
+	} else {
+		b, err = ioutil.ReadAll(io.LimitReader(in, int64(p.limits.MaxAlloc)+1))
+	}
+	if err != nil {
+		return
+	}
+	if err = p.alloc(len(b)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,133 @@
+package bpl_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func lenOf(n int) func(ctx *bpl.Context) int {
+
+	return func(ctx *bpl.Context) int {
+		return n
+	}
+}
+
+func checkLimitError(t *testing.T, err error, name string) {
+
+	var e *bpl.LimitError
+	if !errors.As(err, &e) || e.Name != name {
+		t.Fatal("expect LimitError", name, "- got:", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	ctx := bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 4})
+	_, err := bpl.Dynarray(bpl.Uint8, lenOf(1<<32)).Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 4})
+	_, err = bpl.Read(lenOf(5), bpl.Nil).Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 4})
+	_, err = bpl.ByteArray0.Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 4})
+	_, err = bpl.Dynarray(bpl.Uint32, lenOf(2)).Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxTotalAlloc: 6})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Dynarray(bpl.Uint8, lenOf(4))},
+		&bpl.Member{Name: "b", Type: bpl.Dynarray(bpl.Uint8, lenOf(4))},
+	})
+	_, err = r.Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxTotalAlloc")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxRepeat: 3})
+	_, err = bpl.Array0(bpl.Uint16).Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxRepeat")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxRepeat: 3})
+	_, err = bpl.Repeat0(bpl.Uint8).Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxRepeat")
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxRepeat: 4})
+	v, err := bpl.Array0(bpl.Uint16).Match(ctx.NewReaderBuffer(data), ctx)
+	if err != nil || len(v.([]uint16)) != 4 {
+		t.Fatal("Array0:", v, err)
+	}
+
+	_, err = bpl.Dynarray(bpl.Uint8, lenOf(-1)).Match(ctx.NewReaderBuffer(data), ctx)
+	if err != bpl.ErrNegativeLength {
+		t.Fatal("Dynarray:", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+
+	// list = {v byte; next ?list}
+	list := &bpl.TypeVar{Name: "list"}
+	list.Assign(bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "v", Type: bpl.Uint8},
+		&bpl.Member{Name: "next", Type: bpl.Repeat01(list)},
+	}))
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ctx := bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDepth: 8})
+	_, err := list.Match(ctx.NewReaderBuffer(data), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDepth: 7})
+	_, err = list.Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxDepth")
+	// named rules are counted too, eg. the recursion by Dyntype here
+	var node bpl.Ruler
+	node = bpl.Named("node", bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "v", Type: bpl.Uint8},
+		&bpl.Member{Name: "next", Type: bpl.Repeat01(bpl.Dyntype(func(ctx *bpl.Context) (bpl.Ruler, error) {
+			return node, nil
+		}))},
+	}))
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDepth: 8})
+	if _, err = node.Match(ctx.NewReaderBuffer(data), ctx); err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDepth: 7})
+	_, err = node.Match(ctx.NewReaderBuffer(data), ctx)
+	checkLimitError(t, err, "MaxDepth")
+}
+
+func TestLimitsContext(t *testing.T) {
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ctx := bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{Context: c})
+	_, err := bpl.Repeat0(bpl.Uint8).Match(ctx.NewReaderBuffer([]byte{1, 2, 3}), ctx)
+	if err != context.Canceled {
+		t.Fatal("Match:", err)
+	}
+}
@@ -0,0 +1,147 @@
+package bpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// -----------------------------------------------------------------------------
+
+// A Map is an ordered map. It is the matching result of a struct, and keeps
+// members in the order they are matched.
+//
+type Map struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+// NewMap returns an empty Map.
+//
+func NewMap() *Map {
+
+	return &Map{vals: make(map[string]interface{})}
+}
+
+// Len returns the number of members.
+//
+func (p *Map) Len() int {
+
+	return len(p.vals)
+}
+
+// Get returns the member named `key`.
+//
+func (p *Map) Get(key string) (v interface{}, ok bool) {
+
+	v, ok = p.vals[key]
+	return
+}
+
+// Set sets the member named `key`. A new member is put after all others.
+//
+func (p *Map) Set(key string, v interface{}) {
+
+	if _, ok := p.vals[key]; !ok {
+		p.keys = append(p.keys, key)
+	}
+	p.vals[key] = v
+}
+
+// Delete deletes the member named `key`.
+//
+func (p *Map) Delete(key string) {
+
+	if _, ok := p.vals[key]; ok {
+		delete(p.vals, key)
+		for i, k := range p.keys {
+			if k == key {
+				p.keys = append(p.keys[:i:i], p.keys[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Keys returns names of all members in order.
+//
+func (p *Map) Keys() []string {
+
+	keys := make([]string, 0, len(p.vals))
+	for _, k := range p.keys {
+		if _, ok := p.vals[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) != len(p.vals) { // members added to Vals() directly are put last, in alphabetical order
+		known := make(map[string]bool, len(p.keys))
+		for _, k := range p.keys {
+			known[k] = true
+		}
+		n := len(keys)
+		for k := range p.vals {
+			if !known[k] {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys[n:])
+	}
+	return keys
+}
+
+// Vals returns members as a builtin map, which shares storage with this Map.
+// It should be read only: members should be added by Set, so that they are in
+// order (members added to it directly are put after others alphabetically).
+//
+func (p *Map) Vals() map[string]interface{} {
+
+	return p.vals
+}
+
+func (p *Map) clone() *Map {
+
+	vals := make(map[string]interface{}, len(p.vals))
+	for k, v := range p.vals {
+		vals[k] = v
+	}
+	return &Map{keys: append([]string(nil), p.keys...), vals: vals}
+}
+
+// MarshalJSON is required by json.Marshal. Members are marshaled in order.
+//
+func (p *Map) MarshalJSON() ([]byte, error) {
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range p.Keys() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		val, err := json.Marshal(p.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// memberOf returns the member named `key` of a struct result, which is a Map
+// or a map[string]interface{} (eg. decoded from JSON).
+//
+func memberOf(dom interface{}, key string) (v interface{}, ok bool) {
+
+	switch vars := dom.(type) {
+	case *Map:
+		v, ok = vars.vals[key]
+	case map[string]interface{}:
+		v, ok = vars[key]
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,49 @@
+package bpl_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestMap(t *testing.T) {
+
+	m := bpl.NewMap()
+	m.Set("z", 1)
+	m.Set("b", 2)
+	m.Set("a", 3)
+	m.Set("z", 4)
+	m.Delete("b")
+	m.Vals()["y"] = 5
+	m.Vals()["c"] = 6
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"z", "a", "c", "y"}) {
+		t.Fatal("Keys:", keys)
+	}
+	if v, ok := m.Get("z"); !ok || v != 4 || m.Len() != 4 {
+		t.Fatal("Get:", v, ok, m.Len())
+	}
+	ret, err := json.Marshal(m)
+	if err != nil || string(ret) != `{"z":4,"a":3,"c":6,"y":5}` {
+		t.Fatal("json.Marshal:", string(ret), err)
+	}
+	m.Set("d", 7) // Keys doesn't change the order of members added later
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"z", "a", "d", "c", "y"}) {
+		t.Fatal("Keys:", keys)
+	}
+
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "len", Type: bpl.Uint8},
+		&bpl.Member{Name: "type", Type: bpl.Uint8},
+		&bpl.Member{Name: "body", Type: bpl.Uint8},
+	})
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer([]byte{1, 2, 3}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if keys := v.(*bpl.Map).Keys(); !reflect.DeepEqual(keys, []string{"len", "type", "body"}) {
+		t.Fatal("Keys:", keys)
+	}
+}
@@ -0,0 +1,197 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xushiwei/qlang/exec"
+)
+
+// MatchWindow is the max number of bytes before and after the failure point
+// kept in MatchError.Window.
+//
+var MatchWindow = 16
+
+// -----------------------------------------------------------------------------
+
+// A MatchError is returned when matching fails. It tells where matching failed.
+//
+type MatchError struct {
+	Err          error  // the original error
+	Offset       int64  // absolute offset of input stream, -1 if unknown
+	Path         string // rule path, eg. doc/Message[17]/body/OP_QUERY/query
+	File         string // source position of the failed rule
+	Line         int
+	Window       []byte // bytes around Offset, see MatchWindow
+	WindowOffset int64  // absolute offset of Window[0]
+
+	rpath []pathElem // components of Path, innermost first
+}
+
+func newMatchError(err error, in *bufio.Reader, ctx *Context) *MatchError {
+
+	e := &MatchError{Err: err, Offset: -1}
+	if ee, ok := err.(*exec.Error); ok { // errors of qlang expressions
+		e.Err, e.File, e.Line = ee.Err, ee.File, ee.Line
+	}
+	if ctx != nil {
+		e.Offset = ctx.Tell()
+	}
+
+	var before []byte
+	if off := e.Offset; off > 0 && ctx.src != nil && ctx.src.ra != nil {
+		n := int64(MatchWindow)
+		if n > off {
+			n = off
+		}
+		before = make([]byte, n)
+		if m, _ := ctx.src.ra.ReadAt(before, off-n); int64(m) != n {
+			before = nil
+		}
+	}
+	after, _ := in.Peek(in.Buffered()) // don't fill the buffer
+	if len(after) > MatchWindow {
+		after = after[:MatchWindow]
+	}
+	e.Window = append(before, after...)
+	if e.Offset >= 0 {
+		e.WindowOffset = e.Offset - int64(len(before))
+	}
+	return e
+}
+
+func (p *MatchError) push(c pathElem) {
+
+	p.rpath = append(p.rpath, c)
+
+	var b strings.Builder
+	index := ""
+	for i := len(p.rpath) - 1; i >= 0; i-- {
+		c := p.rpath[i]
+		if c.name[0] == '[' {
+			if i > 0 && p.rpath[i-1].rule { // an element of rule: Message[17]
+				index += c.name
+			} else { // an element of member: items[3]
+				b.WriteString(c.name)
+			}
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('/')
+		}
+		b.WriteString(c.name)
+		b.WriteString(index)
+		index = ""
+	}
+	p.Path = b.String()
+}
+
+func (p *MatchError) Error() string {
+
+	var b bytes.Buffer
+	if p.File != "" {
+		fmt.Fprintf(&b, "%s:%d: ", p.File, p.Line)
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path)
+		b.WriteString(": ")
+	}
+	if p.Offset >= 0 {
+		fmt.Fprintf(&b, "offset %d (0x%x): ", p.Offset, p.Offset)
+	}
+	b.WriteString(p.Err.Error())
+	if len(p.Window) > 0 {
+		b.WriteByte('\n')
+		p.dumpWindow(&b)
+	}
+	return b.String()
+}
+
+// dumpWindow dumps Window in `hexdump -C` style, and marks the failure point.
+//
+func (p *MatchError) dumpWindow(b *bytes.Buffer) {
+
+	base := p.WindowOffset
+	start := base &^ 15
+	end := base + int64(len(p.Window))
+	for line := start; line < end; line += 16 {
+		fmt.Fprintf(b, "%08x  ", line)
+		var ascii [16]byte
+		for i := int64(0); i < 16; i++ {
+			if i == 8 {
+				b.WriteByte(' ')
+			}
+			off := line + i
+			if off < base || off >= end {
+				b.WriteString("   ")
+				ascii[i] = ' '
+				continue
+			}
+			c := p.Window[off-base]
+			fmt.Fprintf(b, "%02x ", c)
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			ascii[i] = c
+		}
+		fmt.Fprintf(b, " |%s|\n", ascii[:])
+		if p.Offset >= line && p.Offset < line+16 {
+			col := 10 + 3*int(p.Offset-line)
+			if p.Offset-line >= 8 {
+				col++
+			}
+			b.WriteString(strings.Repeat(" ", col))
+			b.WriteString("^^\n")
+		}
+	}
+}
+
+// Unwrap returns the original error.
+//
+func (p *MatchError) Unwrap() error {
+
+	return p.Err
+}
+
+type pathElem struct {
+	name string // a rule name, a member name, or an index like `[17]`
+	rule bool
+}
+
+// matchError prepends component `c` to the rule path of the MatchError in err.
+// If err doesn't have a MatchError, it is created at the failure point `in`.
+//
+func matchError(err error, c pathElem, in *bufio.Reader, ctx *Context) error {
+
+	if e, ok := err.(*PartialError); ok { // keep PartialError outermost
+		e.Err = matchError(e.Err, c, in, ctx)
+		return e
+	}
+	e, ok := err.(*MatchError)
+	if !ok {
+		e = newMatchError(err, in, ctx)
+	}
+	if c.name != "" {
+		e.push(c)
+	}
+	return e
+}
+
+func matchErrorOf(err error) *MatchError {
+
+	if e, ok := err.(*PartialError); ok {
+		err = e.Err
+	}
+	e, _ := err.(*MatchError)
+	return e
+}
+
+func indexOf(i int) pathElem {
+
+	return pathElem{name: "[" + strconv.Itoa(i) + "]"}
+}
+
+// -----------------------------------------------------------------------------
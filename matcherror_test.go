@@ -0,0 +1,47 @@
+package bpl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestMatchError(t *testing.T) {
+
+	item := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "tag", Type: bpl.Uint8},
+		&bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Char, lenOf(3))},
+	})
+	r := bpl.Named("doc", bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "magic", Type: bpl.Uint16},
+		&bpl.Member{Name: "items", Type: bpl.Array0(bpl.Named("item", item))},
+	}))
+
+	b := []byte{1, 0, 1, 'a', 'b', 'c', 2, 'd'}
+	ctx := bpl.NewContext()
+	_, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	var e *bpl.MatchError
+	if !errors.As(err, &e) {
+		t.Fatal("Match:", err)
+	}
+	if e.Path != "doc/items/item[1]/data" || e.Offset != 8 || e.WindowOffset != 0 || string(e.Window) != string(b) {
+		t.Fatal("MatchError:", e.Path, e.Offset, e.WindowOffset, e.Window)
+	}
+	const msg = `doc/items/item[1]/data: offset 8 (0x8): unexpected EOF
+00000000  01 00 01 61 62 63 02 64                           |...abc.d        |
+                                   ^^
+`
+	if err.Error() != msg {
+		t.Fatal("MatchError.Error:", err)
+	}
+
+	r = bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "items", Type: bpl.Array0(item)},
+	})
+	ctx = bpl.NewContext()
+	_, err = r.Match(ctx.NewReaderBuffer(b[2:]), ctx)
+	if !errors.As(err, &e) || e.Path != "items[1]/data" {
+		t.Fatal("Match:", err)
+	}
+}
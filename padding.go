@@ -0,0 +1,140 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+var (
+	// ErrNoPosition is returned when position of input stream isn't tracked (see
+	// `Context.Tell`), but it's required (eg. by `Align`).
+	ErrNoPosition = errors.New("position of input stream isn't tracked")
+)
+
+// -----------------------------------------------------------------------------
+
+// A Padding is the number of padding bytes matched by `Align` or `PadTo`. It's
+// stored in the matching result of current struct as a hidden member named
+// `_pad0`, `_pad1`, etc. (in order of the padding statements matched, including
+// empty ones).
+//
+type Padding int
+
+type padding struct {
+	n    func(ctx *Context) int
+	fill int  // value of padding bytes, -1 if they aren't verified
+	pad  bool // relative to start of current struct (PadTo), or of current region (Align)
+}
+
+func (p *padding) sizeOf(off, origin int64, ctx *Context) (int, error) {
+
+	n := p.n(ctx)
+	if n <= 0 {
+		return 0, fmt.Errorf("padding: invalid alignment %d", n)
+	}
+	return int((int64(n) - (off-origin)%int64(n)) % int64(n)), nil
+}
+
+func (p *padding) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	off := ctx.Tell()
+	if off < 0 {
+		return nil, ErrNoPosition
+	}
+	origin := ctx.start
+	if !p.pad {
+		origin = ctx.src.origin
+	}
+	n, err := p.sizeOf(off, origin, ctx)
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		if err = ctx.alloc(n); err != nil {
+			return
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(in, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if p.fill >= 0 {
+			for i, c := range b {
+				if int(c) != p.fill {
+					return nil, fmt.Errorf("padding byte at offset %d isn't 0x%02x - 0x%02x", off+int64(i), p.fill, c)
+				}
+			}
+		}
+	}
+	if ctx.frame { // in a struct, recorded even if it's empty, so numbering doesn't depend on data
+		vars := ctx.requireVars()
+		for i := 0; ; i++ {
+			name := "_pad" + strconv.Itoa(i)
+			if _, ok := vars.Get(name); !ok {
+				vars.Set(name, Padding(n))
+				break
+			}
+		}
+	}
+	return Padding(n), nil
+}
+
+// Encode writes padding bytes, which are zero bytes if they aren't verified.
+//
+func (p *padding) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	ctx.AlignBits()
+	origin := ctx.start
+	if !p.pad {
+		origin = int64(ctx.enc.origin)
+	}
+	n, err := p.sizeOf(int64(ctx.enc.tell(w)), origin, ctx)
+	if err != nil {
+		return err
+	}
+	fill := p.fill
+	if fill < 0 {
+		fill = 0
+	}
+	w.Write(bytes.Repeat([]byte{byte(fill)}, n))
+	return nil
+}
+
+func (p *padding) RetType() reflect.Type {
+
+	return reflect.TypeOf(Padding(0))
+}
+
+func (p *padding) SizeOf() int {
+
+	return -1
+}
+
+// Align returns a matching unit that skips padding bytes, so that the offset
+// relative to current region (the input of current `read`, `eval` or `decode`,
+// or the whole input stream) is a multiple of n(ctx). If fill >= 0, padding
+// bytes must be equal to it.
+//
+func Align(n func(ctx *Context) int, fill int) Ruler {
+
+	return &padding{n: n, fill: fill}
+}
+
+// PadTo returns a matching unit that skips padding bytes, so that size of
+// current struct is a multiple of n(ctx). If fill >= 0, padding bytes must be
+// equal to it.
+//
+func PadTo(n func(ctx *Context) int, fill int) Ruler {
+
+	return &padding{n: n, fill: fill, pad: true}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,73 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestPadding(t *testing.T) {
+
+	n := func(n int) func(ctx *bpl.Context) int {
+		return func(ctx *bpl.Context) int {
+			return n
+		}
+	}
+	rec := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint8},
+		bpl.Align(n(4), 0),
+		&bpl.Member{Name: "b", Type: bpl.Uint16},
+		bpl.PadTo(n(8), -1),
+	})
+	r := bpl.Seq(bpl.Uint8, bpl.Read(n(8), rec))
+	b := []byte{9, 1, 0, 0, 0, 1, 2, 0xaa, 0xbb}
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `[9,{"a":1,"_pad0":3,"b":513,"_pad1":2}]` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	var w bytes.Buffer
+	if err = bpl.Encode(r, &w, v, bpl.NewContext()); err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	if !bytes.Equal(w.Bytes(), []byte{9, 1, 0, 0, 0, 1, 2, 0, 0}) {
+		t.Fatal("Encode:", w.Bytes())
+	}
+
+	// empty paddings are recorded too, so `_pad1` is always the second one
+	rec2 := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint16},
+		bpl.Align(n(2), 0),
+		&bpl.Member{Name: "b", Type: bpl.Uint16},
+		bpl.PadTo(n(8), -1),
+	})
+	ctx = bpl.NewContext()
+	v, err = rec2.Match(ctx.NewReaderBuffer([]byte{1, 0, 2, 0, 0xaa, 0xbb, 0xcc, 0xdd}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if ret, _ = json.Marshal(v); string(ret) != `{"a":1,"_pad0":0,"b":2,"_pad1":4}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	ctx = bpl.NewContext()
+	if _, err = r.Match(ctx.NewReaderBuffer([]byte{9, 1, 0, 7, 0, 1, 2, 0, 0}), ctx); err == nil {
+		t.Fatal("Match: no error")
+	}
+	ctx = bpl.NewContext()
+	if _, err = rec.Match(bufio.NewReader(bytes.NewReader(b)), ctx); !errors.Is(err, bpl.ErrNoPosition) {
+		t.Fatal("Match:", err)
+	}
+}
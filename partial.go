@@ -0,0 +1,77 @@
+package bpl
+
+import (
+	"reflect"
+)
+
+// -----------------------------------------------------------------------------
+
+// A PartialError is returned when matching fails. Dom is the matching result
+// built so far: a struct holds its matched members (and the partial result of
+// the failed member), an array holds its matched elements (and the partial
+// result of the failed element). Results of `*R`, `+R` and repetitions in streaming mode
+// are discarded, so a PartialError passes through them with the partial result
+// of the failed element.
+//
+type PartialError struct {
+	Err error
+	Dom interface{}
+}
+
+func (p *PartialError) Error() string {
+
+	return p.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+//
+func (p *PartialError) Unwrap() error {
+
+	return p.Err
+}
+
+// PartialDom returns the partial matching result attached to err, if any.
+//
+func PartialDom(err error) (dom interface{}, ok bool) {
+
+	if e, ok := err.(*PartialError); ok {
+		return e.Dom, true
+	}
+	return
+}
+
+func (p *Context) setPartial(name string, v interface{}) {
+
+	if p.dom == nil {
+		p.dom = NewMap()
+	}
+	if vars, ok := p.dom.(*Map); ok {
+		if _, ok = vars.Get(name); !ok {
+			vars.Set(name, v)
+		}
+	}
+}
+
+func withPartial(err error, dom interface{}) error {
+
+	if e, ok := err.(*PartialError); ok {
+		e.Dom = dom
+		return e
+	}
+	return &PartialError{Err: err, Dom: dom}
+}
+
+// partialSlice appends the partial result of the failed element to matched
+// elements `ret`, and attaches them to err.
+//
+func partialSlice(err error, ret reflect.Value) error {
+
+	if dom, ok := PartialDom(err); ok && dom != nil {
+		if v := reflect.ValueOf(dom); v.Type().AssignableTo(ret.Type().Elem()) {
+			ret = reflect.Append(ret, v)
+		}
+	}
+	return withPartial(err, ret.Interface())
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,45 @@
+package bpl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestPartialError(t *testing.T) {
+
+	item := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "tag", Type: bpl.Uint8},
+		&bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Char, lenOf(3))},
+	})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "magic", Type: bpl.Uint16},
+		&bpl.Member{Name: "items", Type: bpl.Dynarray(item, lenOf(3))},
+		&bpl.Member{Name: "crc", Type: bpl.Uint32},
+	})
+
+	b := []byte{1, 0, 1, 'a', 'b', 'c', 2, 'd'}
+	ctx := bpl.NewContext()
+	_, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	e, ok := err.(*bpl.PartialError)
+	if !ok || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("Match:", err)
+	}
+	ret, err := json.Marshal(e.Dom)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"magic":1,"items":[{"tag":1,"data":"abc"},{"tag":2,"data":"d"}]}` {
+		t.Fatal("partial:", string(ret))
+	}
+
+	ctx = bpl.NewContext()
+	_, err = r.Match(ctx.NewReader(bytes.NewReader(nil)), ctx)
+	if dom, ok := bpl.PartialDom(err); !ok || dom != nil {
+		t.Fatal("Match:", err, dom)
+	}
+}
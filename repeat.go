@@ -2,6 +2,8 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"reflect"
 )
@@ -10,11 +12,16 @@ import (
 
 func directRepeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	defer func(index int) {
+		ctx.index = index
+	}(ctx.index)
+
+	ctx.index = 0
 	_, err = R.Match(in, ctx)
 	if err != nil {
-		return
+		return nil, matchError(err, indexOf(0), in, ctx)
 	}
-	for {
+	for n := 2; ; n++ {
 		_, err = in.Peek(1)
 		if err != nil {
 			if err == io.EOF {
@@ -22,9 +29,13 @@ func directRepeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err e
 			}
 			return
 		}
+		if err = ctx.repeated(n); err != nil {
+			return
+		}
+		ctx.index = n - 1
 		_, err = R.Match(in, ctx)
 		if err != nil {
-			return
+			return nil, matchError(err, indexOf(n-1), in, ctx)
 		}
 	}
 }
@@ -35,11 +46,13 @@ func repeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error)
 		return directRepeat(R, in, ctx)
 	}
 
-	_, err = R.Match(in, ctx.NewSub())
+	sub := ctx.newElem(0)
+	_, err = R.Match(in, sub)
+	sub.endSpan()
 	if err != nil {
-		return
+		return nil, matchError(err, indexOf(0), in, ctx)
 	}
-	for {
+	for n := 2; ; n++ {
 		_, err = in.Peek(1)
 		if err != nil {
 			if err == io.EOF {
@@ -47,11 +60,37 @@ func repeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error)
 			}
 			return
 		}
-		_, err = R.Match(in, ctx.NewSub())
-		if err != nil {
+		if err = ctx.repeated(n); err != nil {
 			return
 		}
+		sub = ctx.newElem(n - 1)
+		_, err = R.Match(in, sub)
+		sub.endSpan()
+		if err != nil {
+			return nil, matchError(err, indexOf(n-1), in, ctx)
+		}
+	}
+}
+
+func encodeRepeat(R Ruler, w *bytes.Buffer, dom interface{}, ctx *Context) (n int, err error) {
+
+	if r, ok := R.(*seq); ok { // results of `*[R1 R2 ... Rn]` are flattened
+		vals, ok := dom.([]interface{})
+		if !ok && dom != nil {
+			return 0, &EncodeError{R: R, Dom: dom, Msg: "value isn't a []interface{}"}
+		}
+		m := len(r.rs)
+		if len(vals)%m != 0 {
+			return 0, &EncodeError{R: R, Dom: dom, Msg: fmt.Sprintf("len(value) isn't a multiple of %d", m)}
+		}
+		for i := 0; i < len(vals); i += m {
+			if err = Encode(R, w, vals[i:i+m], ctx); err != nil {
+				return
+			}
+		}
+		return len(vals) / m, nil
 	}
+	return encodeArray(R, w, dom, ctx)
 }
 
 // -----------------------------------------------------------------------------
@@ -62,6 +101,9 @@ type repeat0 struct {
 
 func (p *repeat0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	if s := ctx.streaming(in); s != nil {
+		return nil, matchRecords(s, p.r, in, ctx, 0)
+	}
 	_, err = in.Peek(1)
 	if err != nil {
 		if err == io.EOF {
@@ -72,6 +114,12 @@ func (p *repeat0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	return repeat(p.r, in, ctx)
 }
 
+func (p *repeat0) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	_, err := encodeRepeat(p.r, w, dom, ctx)
+	return err
+}
+
 func (p *repeat0) RetType() reflect.Type {
 
 	return TyInterface
@@ -97,6 +145,9 @@ type repeat1 struct {
 
 func (p *repeat1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	if s := ctx.streaming(in); s != nil {
+		return nil, matchRecords(s, p.r, in, ctx, 1)
+	}
 	_, err = in.Peek(1)
 	if err != nil {
 		return
@@ -104,6 +155,15 @@ func (p *repeat1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	return repeat(p.r, in, ctx)
 }
 
+func (p *repeat1) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	n, err := encodeRepeat(p.r, w, dom, ctx)
+	if err == nil && n == 0 {
+		err = &EncodeError{R: p, Dom: dom, Msg: "R+ requires at least one element"}
+	}
+	return err
+}
+
 func (p *repeat1) RetType() reflect.Type {
 
 	return TyInterface
@@ -139,6 +199,14 @@ func (p *repeat01) Match(in *bufio.Reader, ctx *Context) (v interface{}, err err
 	return p.r.Match(in, ctx)
 }
 
+func (p *repeat01) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	if dom == nil {
+		return nil
+	}
+	return Encode(p.r, w, dom, ctx)
+}
+
 func (p *repeat01) RetType() reflect.Type {
 
 	return TyInterface
@@ -0,0 +1,198 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/qiniu/x/bufiox"
+)
+
+var (
+	// ErrNoRandomAccess is returned when input stream doesn't support random access.
+	ErrNoRandomAccess = errors.New("input stream doesn't support random access")
+)
+
+// -----------------------------------------------------------------------------
+
+// A source tracks the position of an input stream, and holds its random
+// access capabilities.
+//
+type source struct {
+	in   *bufio.Reader
+	r    io.Reader   // underlying reader of `in` (nil if `in` is a memory buffer)
+	ra   io.ReaderAt // nil if random access isn't supported
+	base int64       // absolute offset of the first byte of underlying reader
+	n    int64       // number of bytes `in` has read from underlying reader
+
+	origin int64 // absolute offset where current `read` region starts (see Align)
+
+	noSeek bool
+}
+
+func (p *source) Read(b []byte) (n int, err error) {
+
+	n, err = p.r.Read(b)
+	p.n += int64(n)
+	return
+}
+
+func (p *source) tell() int64 {
+
+	return p.base + p.n - int64(p.in.Buffered())
+}
+
+func (p *source) skip(n int) (int, error) {
+
+	buffered := p.in.Buffered()
+	if n > buffered && !p.noSeek {
+		if seeker, ok := p.r.(io.Seeker); ok {
+			p.in.Discard(buffered)
+			if pos, err := seeker.Seek(int64(n-buffered), io.SeekCurrent); err == nil {
+				return p.seeked(seeker, pos, n-buffered, buffered)
+			}
+			p.noSeek = true // eg. os.Stdin is a pipe
+			m, err := p.in.Discard(n - buffered)
+			return buffered + m, err
+		}
+	}
+	return p.in.Discard(n)
+}
+
+// seeked checks if the input is skipped to pos past EOF after a Seek of delta
+// bytes, which is an io.EOF like reading and discarding.
+//
+func (p *source) seeked(seeker io.Seeker, pos int64, delta, buffered int) (int, error) {
+
+	if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+		if end < pos {
+			skipped := int(end - (pos - int64(delta)))
+			p.n += int64(skipped)
+			return buffered + skipped, io.EOF
+		}
+		if _, err = seeker.Seek(pos, io.SeekStart); err != nil {
+			return buffered, err
+		}
+	}
+	p.n += int64(delta)
+	return buffered + delta, nil
+}
+
+func newSource(r io.Reader, base int64) *source {
+
+	src := &source{r: r, base: base}
+	src.ra, _ = r.(io.ReaderAt)
+	src.in = bufio.NewReader(src)
+	return src
+}
+
+func newSourceBuffer(b []byte, base int64) *source {
+
+	in := bufiox.NewReaderBuffer(b)
+	return &source{in: in, base: base, n: int64(len(b))}
+}
+
+// NewReader returns a buffered reader of `r` whose position is tracked by
+// this Context (see `Context.Tell`). If `r` is an io.ReaderAt, random access
+// (see `At`) is supported. If `r` is an io.Seeker, `Skip` seeks instead of
+// reading and discarding.
+//
+func (p *Context) NewReader(r io.Reader) *bufio.Reader {
+
+	p.src = newSource(r, 0)
+	p.trackStream()
+	return p.src.in
+}
+
+// NewReaderBuffer returns a buffered reader of `b` whose position is tracked
+// by this Context. Random access is supported.
+//
+func (p *Context) NewReaderBuffer(b []byte) *bufio.Reader {
+
+	src := newSourceBuffer(b, 0)
+	src.ra = bytes.NewReader(b)
+	p.src = src
+	p.trackStream()
+	return src.in
+}
+
+// Tell returns the absolute offset of current input stream. It returns -1 if
+// the input stream isn't created by `Context.NewReader` or `Context.NewReaderBuffer`.
+//
+func (p *Context) Tell() int64 {
+
+	if p.src == nil {
+		return -1
+	}
+	return p.src.tell()
+}
+
+// skip skips n bytes of `in`. A skip that stops short at EOF after skipping
+// some bytes fails with io.ErrUnexpectedEOF, while io.EOF is kept if nothing
+// is left to skip.
+//
+func (p *Context) skip(in *bufio.Reader, n int) (m int, err error) {
+
+	if src := p.src; src != nil && src.in == in && src.r != nil {
+		m, err = src.skip(n)
+	} else {
+		m, err = in.Discard(n)
+	}
+	if err == io.EOF && m > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+type at struct {
+	off func(ctx *Context) int64
+	r   Ruler
+}
+
+func (p *at) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	old := ctx.src
+	if old == nil || old.ra == nil {
+		return nil, ErrNoRandomAccess
+	}
+
+	off := p.off(ctx)
+	if off < 0 {
+		return nil, fmt.Errorf("at: negative offset %d", off)
+	}
+	sr := io.NewSectionReader(old.ra, off, math.MaxInt64-off)
+	src := newSource(sr, off)
+	src.ra, src.origin = old.ra, old.origin
+	ctx.src = src
+	defer func() {
+		ctx.src = old
+	}()
+	return MatchStream(p.r, src.in, ctx)
+}
+
+func (p *at) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *at) SizeOf() int {
+
+	return -1
+}
+
+// At returns a matching unit that matches R at absolute offset off(ctx) of
+// input stream. It doesn't change current position of input stream.
+//
+func At(off func(ctx *Context) int64, r Ruler) Ruler {
+
+	return &at{off: off, r: r}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,141 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestSkipAndAt(t *testing.T) {
+
+	b := make([]byte, 10000)
+	b[9000], b[100] = 1, 2
+
+	ctx := bpl.NewContext()
+	in := ctx.NewReader(bytes.NewReader(b))
+	r := bpl.Struct([]bpl.Ruler{
+		bpl.Skip(func(ctx *bpl.Context) int { return 9000 }),
+		&bpl.Member{Name: "a", Type: bpl.Uint8},
+		&bpl.Member{Name: "b", Type: bpl.At(func(ctx *bpl.Context) int64 { return 100 }, bpl.Uint8)},
+		&bpl.Member{Name: "c", Type: bpl.Uint8},
+	})
+	_, err := r.Match(in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if v, _ := ctx.Var("a"); v != uint8(1) {
+		t.Fatal("a != 1:", v)
+	}
+	if v, _ := ctx.Var("b"); v != uint8(2) {
+		t.Fatal("b != 2:", v)
+	}
+	if off := ctx.Tell(); off != 9002 {
+		t.Fatal("Tell:", off)
+	}
+
+	ctx = bpl.NewContext()
+	_, err = r.Match(bufio.NewReader(bytes.NewReader(b)), ctx)
+	if !errors.Is(err, bpl.ErrNoRandomAccess) {
+		t.Fatal("Match:", err)
+	}
+	// skip past EOF, by seeking or by discarding
+	skip := bpl.Skip(func(ctx *bpl.Context) int { return 20000 })
+	ctx = bpl.NewContext()
+	_, err = skip.Match(ctx.NewReader(bytes.NewReader(b)), ctx)
+	if err != io.ErrUnexpectedEOF || ctx.Tell() != 10000 {
+		t.Fatal("Skip:", err, ctx.Tell())
+	}
+	ctx = bpl.NewContext()
+	_, err = skip.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("Skip:", err)
+	}
+	// skip at EOF, by seeking or by discarding
+	ctx = bpl.NewContext()
+	in = ctx.NewReader(bytes.NewReader(b))
+	if _, err = bpl.Skip(func(ctx *bpl.Context) int { return len(b) }).Match(in, ctx); err != nil {
+		t.Fatal("Skip:", err)
+	}
+	if _, err = skip.Match(in, ctx); err != io.EOF || ctx.Tell() != 10000 {
+		t.Fatal("Skip at EOF:", err, ctx.Tell())
+	}
+	ctx = bpl.NewContext()
+	in = ctx.NewReaderBuffer(b)
+	if _, err = bpl.Skip(func(ctx *bpl.Context) int { return len(b) }).Match(in, ctx); err != nil {
+		t.Fatal("Skip:", err)
+	}
+	if _, err = skip.Match(in, ctx); err != io.EOF {
+		t.Fatal("Skip at EOF:", err)
+	}
+
+	ctx = bpl.NewContext()
+	at := bpl.At(func(ctx *bpl.Context) int64 { return -1 }, bpl.Uint8)
+	if _, err = at.Match(ctx.NewReaderBuffer(b), ctx); err == nil {
+		t.Fatal("At: no error")
+	}
+}
+
+func TestTellInAlt(t *testing.T) {
+
+	var pos int64
+	r := bpl.Alt(bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint8},
+		bpl.Do(func(ctx *bpl.Context) error {
+			pos = ctx.Tell()
+			return nil
+		}),
+	}), bpl.Nil)
+
+	ctx := bpl.NewContext()
+	_, err := r.Match(ctx.NewReaderBuffer([]byte{1, 2}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if pos != 1 || ctx.Tell() != 1 {
+		t.Fatal("Tell:", pos, ctx.Tell())
+	}
+}
+
+func TestPosition(t *testing.T) {
+
+	type pos struct {
+		start, consumed int64
+		index           int
+		parent          interface{}
+	}
+	var got []pos
+	item := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint8},
+		&bpl.Member{Name: "b", Type: bpl.Uint8},
+		bpl.Do(func(ctx *bpl.Context) error {
+			parent := ctx.ParentDom().(*bpl.Map).Vals()
+			got = append(got, pos{ctx.Start(), ctx.Consumed(), ctx.Index(), parent["ver"]})
+			return nil
+		}),
+	})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "ver", Type: bpl.Uint8},
+		&bpl.Member{Name: "items", Type: bpl.Array0(item)},
+	})
+
+	ctx := bpl.NewContext()
+	_, err := r.Match(ctx.NewReaderBuffer([]byte{7, 1, 2, 3, 4}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if len(got) != 2 || got[0] != (pos{1, 2, 0, uint8(7)}) || got[1] != (pos{3, 2, 1, uint8(7)}) {
+		t.Fatal("position:", got)
+	}
+	if ctx.Index() != -1 || ctx.ParentDom() != nil {
+		t.Fatal("root:", ctx.Index(), ctx.ParentDom())
+	}
+
+	ctx = bpl.NewContext()
+	if ctx.Start() != -1 || ctx.Consumed() != -1 {
+		t.Fatal("untracked:", ctx.Start(), ctx.Consumed())
+	}
+}
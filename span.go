@@ -0,0 +1,125 @@
+package bpl
+
+// -----------------------------------------------------------------------------
+
+// A Span tells which bytes of the input stream produce a node of matching
+// result. Spans form a tree parallel to the matching result: spans of struct
+// members are in Members (in match order, see `Member`), and spans of array
+// elements are in Elems.
+//
+type Span struct {
+	Name    string  `json:"name,omitempty"`    // name of the struct member, empty if it isn't a member
+	Offset  int64   `json:"offset"`            // absolute offset of the first byte
+	Length  int64   `json:"length"`            // number of bytes consumed
+	Rule    string  `json:"rule,omitempty"`    // name of the rule, empty if anonymous
+	Members []*Span `json:"members,omitempty"` // spans of struct members
+	Elems   []*Span `json:"elems,omitempty"`   // spans of array elements
+}
+
+// Member returns the span of struct member `name`, or nil if it isn't found.
+//
+func (p *Span) Member(name string) *Span {
+
+	if i := p.memberIndex(name); i >= 0 {
+		return p.Members[i]
+	}
+	return nil
+}
+
+func (p *Span) memberIndex(name string) int {
+
+	for i, m := range p.Members {
+		if m.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// EnableSpans turns on span recording: matching with this Context records the
+// span of every struct member and array element (see `Context.Span`). It
+// requires the input stream to be created by `Context.NewReader` or
+// `Context.NewReaderBuffer`, so it must be called after them.
+//
+func (p *Context) EnableSpans() {
+
+	p.span = &Span{Offset: p.Tell()}
+}
+
+// Span returns the span of matching result of this Context. It returns nil if
+// span recording isn't turned on.
+//
+func (p *Context) Span() *Span {
+
+	return p.span
+}
+
+func (p *Context) memberSpan(name string) *Span {
+
+	parent := p.span
+	if parent == nil {
+		return nil
+	}
+	span := &Span{Name: name, Offset: p.Tell()}
+	if name != "_" {
+		if i := parent.memberIndex(name); i >= 0 { // matched again, it keeps its position as in Map
+			members := append(parent.Members[:i:i], span) // a copy, see `saveSpan`
+			parent.Members = append(members, parent.Members[i+1:]...)
+		} else {
+			parent.Members = append(parent.Members, span)
+		}
+	}
+	return span
+}
+
+func (p *Context) elemSpan() *Span {
+
+	parent := p.span
+	if parent == nil {
+		return nil
+	}
+	span := &Span{Offset: p.Tell()}
+	parent.Elems = append(parent.Elems, span)
+	return span
+}
+
+func (p *Context) endSpan() {
+
+	if span := p.span; span != nil {
+		span.Length = p.Tell() - span.Offset
+	}
+}
+
+func (p *Context) setSpanRule(name string) {
+
+	if span := p.span; span != nil && span.Rule == "" {
+		span.Rule = name
+	}
+}
+
+type spanState struct {
+	members []*Span
+	elems   int
+}
+
+// saveSpan saves the spans of current node. Members needn't be copied, because
+// they are only appended, or copied before replacing one (see `memberSpan`).
+//
+func (p *Context) saveSpan() (s spanState) {
+
+	if span := p.span; span != nil {
+		s.members = span.Members
+		s.elems = len(span.Elems)
+	}
+	return
+}
+
+func (p *Context) restoreSpan(s spanState) {
+
+	if span := p.span; span != nil {
+		span.Members = s.members
+		span.Elems = span.Elems[:s.elems]
+	}
+}
+
+// -----------------------------------------------------------------------------
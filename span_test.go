@@ -0,0 +1,57 @@
+package bpl_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestSpan(t *testing.T) {
+
+	item := bpl.Alt(
+		bpl.Struct([]bpl.Ruler{
+			&bpl.Member{Name: "tag", Type: bpl.Uint8},
+			bpl.Assert(func(ctx *bpl.Context) bool {
+				v, _ := ctx.Var("tag")
+				return v == uint8(1)
+			}, "tag != 1"),
+			&bpl.Member{Name: "a", Type: bpl.Uint16},
+		}),
+		bpl.Struct([]bpl.Ruler{
+			&bpl.Member{Name: "tag", Type: bpl.Uint8},
+			&bpl.Member{Name: "b", Type: bpl.Uint8},
+		}),
+	)
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "items", Type: bpl.Array0(item)},
+	})
+
+	ctx := bpl.NewContext()
+	in := ctx.NewReaderBuffer([]byte{1, 2, 3, 2, 4})
+	ctx.EnableSpans()
+	_, err := bpl.MatchStream(r, in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	span := ctx.Span()
+	if span.Offset != 0 || span.Length != 5 {
+		t.Fatal("span:", *span)
+	}
+	elems := span.Member("items").Elems
+	if len(elems) != 2 || elems[0].Offset != 0 || elems[0].Length != 3 || elems[1].Offset != 3 || elems[1].Length != 2 {
+		t.Fatal("items:", elems)
+	}
+	if b := elems[1].Member("b"); len(elems[1].Members) != 2 || b.Offset != 4 || b.Length != 1 {
+		t.Fatal("items[1]:", elems[1].Members)
+	}
+	text, err := json.Marshal(elems[1])
+	if err != nil || string(text) != `{"offset":3,"length":2,"members":[{"name":"tag","offset":3,"length":1},{"name":"b","offset":4,"length":1}]}` {
+		t.Fatal("json.Marshal:", string(text), err)
+	}
+
+	ctx = bpl.NewContext()
+	if ctx.Span() != nil {
+		t.Fatal("Span:", ctx.Span())
+	}
+}
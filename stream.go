@@ -0,0 +1,96 @@
+package bpl
+
+import (
+	"bufio"
+	"io"
+)
+
+// -----------------------------------------------------------------------------
+
+type streamState struct {
+	fn     func(v interface{}) error
+	in     *bufio.Reader // the input stream, nil if it isn't tracked
+	active bool
+}
+
+// SetRecordFunc turns on streaming mode. In streaming mode, elements of the
+// outermost `*R` or `+R` repetition (including `R*` and `R+` arrays) are
+// passed to fn as soon as they are matched, and then discarded, so that the
+// matching result doesn't grow without bound. If fn returns an error, matching
+// stops with this error.
+//
+// The outermost repetition is the matching unit itself, or a member of it if
+// it's a struct. And it must read the input stream, rather than a part of it
+// (eg. input of `read n do`), if the input stream is tracked (see `NewReader`).
+// It must also be the last unit of its struct, `Seq` or `And`, because the
+// units following it (eg. `dump`, `let`) may use its matching result. Other
+// repetitions, eg. ones in a header struct, are matched as usual.
+//
+func (p *Context) SetRecordFunc(fn func(v interface{}) error) {
+
+	p.stream = &streamState{fn: fn}
+	if p.src != nil {
+		p.trackStream()
+	}
+}
+
+func (p *Context) streaming(in *bufio.Reader) *streamState {
+
+	s := p.stream
+	if s == nil || s.active || (s.in != nil && s.in != in) {
+		return nil
+	}
+	frames := 0
+	for q := p; q != nil; q = q.Parent {
+		if q.follows { // its matching result is used by the units following it, eg. `dump`
+			return nil
+		}
+		if q.frame {
+			if frames++; frames > 1 { // not in the outermost struct
+				return nil
+			}
+		}
+	}
+	return s
+}
+
+// trackStream makes the input stream of current streaming mode the one created
+// by NewReader or NewReaderBuffer.
+//
+func (p *Context) trackStream() {
+
+	if p.stream != nil {
+		p.stream.in = p.src.in
+	}
+}
+
+func matchRecords(s *streamState, R Ruler, in *bufio.Reader, ctx *Context, min int) (err error) {
+
+	s.active = true
+	defer func() {
+		s.active = false
+	}()
+	for n := 0; ; n++ {
+		_, err = in.Peek(1)
+		if err != nil {
+			if err == io.EOF && n >= min {
+				return nil
+			}
+			return
+		}
+		if err = ctx.repeated(n + 1); err != nil {
+			return
+		}
+		sub := ctx.NewSub() // records are discarded, and so are their spans
+		sub.index, sub.span = n, nil
+		v, err := R.Match(in, sub)
+		if err != nil {
+			return matchError(err, indexOf(n), in, ctx)
+		}
+		if err = s.fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
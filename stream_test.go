@@ -0,0 +1,101 @@
+package bpl_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestRecordFunc(t *testing.T) {
+
+	record := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "n", Type: bpl.Uint8},
+		&bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Uint8, func(ctx *bpl.Context) int {
+			v, _ := ctx.Parent.Var("n")
+			return int(v.(uint8))
+		})},
+	})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "magic", Type: bpl.Uint8},
+		&bpl.Member{Name: "records", Type: bpl.Array0(record)},
+	})
+
+	var ns []uint8
+	ctx := bpl.NewContext()
+	ctx.SetRecordFunc(func(v interface{}) error {
+		ns = append(ns, v.(*bpl.Map).Vals()["n"].(uint8))
+		return nil
+	})
+	_, err := r.Match(ctx.NewReaderBuffer([]byte{0xff, 1, 'a', 2, 'b', 'c', 0}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if len(ns) != 3 || ns[0] != 1 || ns[1] != 2 || ns[2] != 0 {
+		t.Fatal("records:", ns)
+	}
+	if v, _ := ctx.Var("records"); v != nil {
+		t.Fatal("records:", v)
+	}
+
+	errStop := errors.New("stop")
+	ctx = bpl.NewContext()
+	ctx.SetRecordFunc(func(v interface{}) error {
+		return errStop
+	})
+	_, err = bpl.Repeat0(record).Match(ctx.NewReaderBuffer([]byte{1, 'a', 0}), ctx)
+	if err != errStop {
+		t.Fatal("Match:", err)
+	}
+}
+
+func TestRecordFuncOutermost(t *testing.T) {
+
+	u8 := func(name string) func(ctx *bpl.Context) int {
+		return func(ctx *bpl.Context) int {
+			v, _ := ctx.Parent.Var(name)
+			return int(v.(uint8))
+		}
+	}
+	hdr := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "n", Type: bpl.Uint8},
+		&bpl.Member{Name: "tags", Type: bpl.Array0(bpl.Int8)},
+	})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "n", Type: bpl.Uint8},
+		&bpl.Member{Name: "hdr", Type: bpl.Read(u8("n"), hdr)},
+		&bpl.Member{Name: "m", Type: bpl.Uint8},
+		&bpl.Member{Name: "flags", Type: bpl.Read(u8("m"), bpl.Array1(bpl.Int8))},
+		&bpl.Member{Name: "records", Type: bpl.Array0(bpl.Uint16)},
+	})
+
+	var records []interface{}
+	ctx := bpl.NewContext()
+	ctx.SetRecordFunc(func(v interface{}) error {
+		records = append(records, v)
+		return nil
+	})
+	in := ctx.NewReaderBuffer([]byte{3, 1, 7, 8, 2, 5, 6, 1, 0, 2, 0})
+	v, err := r.Match(in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	text, _ := json.Marshal(v)
+	if string(text) != `{"n":3,"hdr":{"n":1,"tags":[7,8]},"m":2,"flags":[5,6],"records":null}` {
+		t.Fatal("ret:", string(text))
+	}
+	if len(records) != 2 || records[0] != uint16(1) || records[1] != uint16(2) {
+		t.Fatal("records:", records)
+	}
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxRepeat: 1})
+	ctx.SetRecordFunc(func(v interface{}) error {
+		return nil
+	})
+	_, err = bpl.Repeat0(bpl.Uint8).Match(ctx.NewReaderBuffer([]byte{1, 2}), ctx)
+	if e, ok := err.(*bpl.LimitError); !ok || e.Name != "MaxRepeat" {
+		t.Fatal("Match:", err)
+	}
+}
@@ -2,8 +2,11 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/qiniu/x/log"
@@ -53,8 +56,20 @@ type Member struct {
 //
 func (p *Member) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	v, err = p.Type.Match(in, ctx.NewSub())
+	if !isBitRuler(p.Type) {
+		ctx.AlignBits()
+	}
+	sub := ctx.NewSub()
+	sub.span = ctx.memberSpan(p.Name)
+	v, err = p.Type.Match(in, sub)
+	sub.endSpan()
 	if err != nil {
+		if dom, ok := PartialDom(err); ok && dom != nil && p.Name != "_" {
+			ctx.setPartial(p.Name, dom)
+		}
+		if p.Name != "_" {
+			err = matchError(err, pathElem{name: p.Name}, in, ctx)
+		}
 		return
 	}
 	if p.Name != "_" {
@@ -63,6 +78,45 @@ func (p *Member) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	return
 }
 
+// Encode is the counterpart of Match. see Encoder interface. Here `dom` is the
+// matching result of the enclosing struct, from which the member value is taken.
+// If the member is missing, and its type has a fixed size, zero bytes are written
+// and they can be back-patched later by `let <member> = <expr>`.
+//
+func (p *Member) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	v, ok := memberOf(dom, p.Name)
+	if !ok || p.Name == "_" {
+		size := p.Type.SizeOf()
+		if size < 0 {
+			return &EncodeError{R: p, Dom: dom, Msg: "member `" + p.Name + "` is missing"}
+		}
+		if p.Name == "_" {
+			w.Write(make([]byte, size))
+			return
+		}
+		ctx.setPending(p.Name, p.Type, w)
+		ctx.SetVar(p.Name, normalize(0, p.Type.RetType()))
+		return
+	}
+
+	if !isBitRuler(p.Type) {
+		ctx.AlignBits()
+	}
+	sub := ctx.NewSub()
+	err = Encode(p.Type, w, v, sub)
+	if err != nil {
+		return
+	}
+	if dom := sub.Dom(); dom != nil {
+		v = dom
+	} else {
+		v = normalize(v, p.Type.RetType())
+	}
+	ctx.SetVar(p.Name, v)
+	return
+}
+
 // RetType returns matching result type.
 //
 func (p *Member) RetType() reflect.Type {
@@ -86,15 +140,52 @@ type structType struct {
 
 func (p *structType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	for _, r := range p.rulers {
+	var checks []func() error
+	old, frame := ctx.checks, ctx.frame
+	if !frame { // a body of `if` or `case` is matched in the Context of its enclosing struct
+		ctx.start = ctx.Tell()
+	}
+	ctx.checks, ctx.frame = &checks, true
+	follows, last := ctx.follows, len(p.rulers)-1
+	defer func() {
+		ctx.frame, ctx.follows = frame, follows
+	}()
+	for i, r := range p.rulers {
+		ctx.follows = follows || i < last
 		_, err = r.Match(in, ctx)
 		if err != nil {
-			return
+			ctx.checks = old
+			return nil, withPartial(err, ctx.Dom())
+		}
+	}
+	ctx.checks = old
+	for _, check := range checks {
+		if err = check(); err != nil {
+			return nil, withPartial(err, ctx.Dom())
 		}
 	}
 	return ctx.Dom(), nil
 }
 
+func (p *structType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) (err error) {
+
+	frame := ctx.frame
+	if ctx.enc != nil && !frame {
+		ctx.start = int64(ctx.enc.tell(w))
+	}
+	ctx.frame = true
+	defer func() {
+		ctx.frame = frame
+	}()
+	for _, r := range p.rulers {
+		err = Encode(r, w, dom, ctx)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (p *structType) RetType() reflect.Type {
 
 	return TyInterface
@@ -136,35 +227,190 @@ func Struct(members []Ruler) Ruler {
 
 // -----------------------------------------------------------------------------
 
+// A TypeRuler is implemented by a Go type which defines its own matching unit.
+// TypeFrom uses it instead of deriving one from the Go type. BplRuler is called
+// on a zero value of the type, or a pointer to a zero value if the type is a
+// pointer type or BplRuler has a pointer receiver.
+//
+type TypeRuler interface {
+	BplRuler() Ruler
+}
+
+var tyTypeRuler = reflect.TypeOf((*TypeRuler)(nil)).Elem()
+
+// A fieldTag is the parsed `bpl` tag of a struct field. Its format is
+// `bpl:"[name][,option...]"`, see TypeFrom.
+//
+type fieldTag struct {
+	name string // member name, "-" means the field isn't on the wire
+	len  string // `len=Field`: length of a slice or string is taken from Field
+	size int    // `size=N`: length of a fixed-size string
+	be   bool   // `be`: big endian byte order
+	le   bool   // `le`: little endian byte order
+}
+
+func parseTag(sf reflect.StructField) (tag fieldTag, err error) {
+
+	parts := strings.Split(sf.Tag.Get("bpl"), ",")
+	tag.name = parts[0]
+	if tag.name == "" {
+		tag.name = strings.ToLower(sf.Name)
+	}
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "be":
+			tag.be, tag.le = true, false
+		case opt == "le":
+			tag.be, tag.le = false, true
+		case strings.HasPrefix(opt, "len="):
+			tag.len = opt[4:]
+		case strings.HasPrefix(opt, "size="):
+			if tag.size, err = strconv.Atoi(opt[5:]); err != nil || tag.size < 0 {
+				return tag, fmt.Errorf("bpl.TypeFrom: invalid tag of field %s - %s", sf.Name, opt)
+			}
+		case opt != "":
+			return tag, fmt.Errorf("bpl.TypeFrom: unknown tag option of field %s - %s", sf.Name, opt)
+		}
+	}
+	return
+}
+
 func structFrom(t reflect.Type) (r Ruler, err error) {
 
 	n := t.NumField()
-	rulers := make([]Ruler, n)
+	rulers := make([]Ruler, 0, n)
 	for i := 0; i < n; i++ {
 		sf := t.Field(i)
-		r, err = TypeFrom(sf.Type)
+		var tag fieldTag
+		if tag, err = parseTag(sf); err != nil {
+			log.Warn("bpl.TypeFrom failed:", err)
+			return
+		}
+		if tag.name == "-" {
+			continue
+		}
+		var n func(ctx *Context) int
+		if tag.len != "" {
+			n = lenFrom(t, tag.len)
+		}
+		r, err = typeFrom(sf.Type, &tag, n)
 		if err != nil {
 			log.Warn("bpl.TypeFrom failed:", err)
 			return
 		}
-		rulers[i] = &Member{Name: strings.ToLower(sf.Name), Type: r}
+		rulers = append(rulers, &Member{Name: tag.name, Type: r})
 	}
 	return Struct(rulers), nil
 }
 
-// TypeFrom creates a matching unit from a Go type.
+// lenFrom returns the length taken from member `name` (or the member of Go
+// field `name`) of struct t.
+//
+func lenFrom(t reflect.Type, name string) func(ctx *Context) int {
+
+	if sf, ok := t.FieldByName(name); ok {
+		if tag, err := parseTag(sf); err == nil {
+			name = tag.name
+		}
+	}
+	return func(ctx *Context) int {
+		v, ok := ctx.Parent.Var(name) // ctx is the Context of the member
+		if !ok {
+			panic(fmt.Errorf("bpl.TypeFrom: length member `%s` not found", name))
+		}
+		n, ok := toInt64(v)
+		if !ok {
+			panic(fmt.Errorf("bpl.TypeFrom: length member `%s` isn't an integer", name))
+		}
+		return int(n)
+	}
+}
+
+// TypeFrom creates a matching unit from a Go type:
+//
+//   - a struct matches its fields in order, see below;
+//   - int8 ~ int64, uint8 ~ uint64, float32 and float64 match fixed size types;
+//   - a string matches a cstring;
+//   - an array [N]T matches [N]T;
+//   - a slice []T matches *T (until EOF);
+//   - a pointer matches what it points to;
+//   - a type implementing TypeRuler matches its BplRuler().
+//
+// A struct field is matched as a member named by its lowercased name. Its `bpl`
+// tag, in form of `bpl:"[name][,option...]"`, changes it: `name` is the member
+// name, `-` means the field isn't on the wire, and `_` means its bytes are
+// consumed without being captured (padding). Options are:
+//
+//   - be, le: byte order of the field (or its elements), default is the byte
+//     order of the Context (see Context.SetByteOrder);
+//   - len=Field: a slice or string has as many elements as the value of Field,
+//     a previous field (named by its Go name or member name);
+//   - size=N: a string has N bytes (it is a [N]char).
+//
+// Fields of type uint and uintptr are 8 bytes, as uint64.
 //
 func TypeFrom(t reflect.Type) (r Ruler, err error) {
 
+	return typeFrom(t, &fieldTag{}, nil)
+}
+
+func typeFrom(t reflect.Type, tag *fieldTag, n func(ctx *Context) int) (r Ruler, err error) {
+
 retry:
+	if t.Implements(tyTypeRuler) {
+		v := reflect.Zero(t)
+		if t.Kind() == reflect.Ptr { // don't call BplRuler on a nil pointer
+			v = reflect.New(t.Elem())
+		}
+		return v.Interface().(TypeRuler).BplRuler(), nil
+	}
+	if reflect.PtrTo(t).Implements(tyTypeRuler) {
+		return reflect.New(t).Interface().(TypeRuler).BplRuler(), nil
+	}
 	kind := t.Kind()
 	switch {
 	case kind == reflect.Struct:
 		return structFrom(t)
-	case kind >= reflect.Int8 && kind <= reflect.Float64:
-		return BaseType(kind), nil
+	case isBaseKind(kind):
+		return baseTypeFrom(kind, tag), nil
 	case kind == reflect.String:
+		if n != nil {
+			return CharDynarray(n), nil
+		}
+		if tag.size > 0 {
+			return CharArray(tag.size), nil
+		}
 		return CString, nil
+	case kind == reflect.Array:
+		elem := t.Elem()
+		if k := elem.Kind(); k == reflect.Uint8 && !elem.Implements(tyTypeRuler) {
+			return ByteArray(t.Len()), nil
+		} else if isSizedKind(k) && !tag.be && !tag.le {
+			return BaseArray(BaseType(k), t.Len()), nil
+		}
+		if r, err = typeFrom(elem, tag, nil); err != nil {
+			return
+		}
+		return Array(r, t.Len()), nil
+	case kind == reflect.Slice:
+		elem := t.Elem()
+		k := elem.Kind()
+		if k == reflect.Uint8 && !elem.Implements(tyTypeRuler) {
+			if n != nil {
+				return ByteDynarray(n), nil
+			}
+			return ByteArray0, nil
+		}
+		if n != nil && isSizedKind(k) && !tag.be && !tag.le {
+			return BaseDynarray(BaseType(k), n), nil
+		}
+		if r, err = typeFrom(elem, tag, nil); err != nil {
+			return
+		}
+		if n != nil {
+			return Dynarray(r, n), nil
+		}
+		return Array0(r), nil
 	case kind == reflect.Ptr:
 		t = t.Elem()
 		goto retry
@@ -172,4 +418,37 @@ retry:
 	return nil, fmt.Errorf("bpl.TypeFrom: unsupported type - %v", t)
 }
 
+func isBaseKind(kind reflect.Kind) bool {
+
+	return kind >= reflect.Int8 && kind <= reflect.Float64
+}
+
+// isSizedKind reports whether kind is a base kind of a fixed size, that is, not
+// uint or uintptr.
+//
+func isSizedKind(kind reflect.Kind) bool {
+
+	return isBaseKind(kind) && kind != reflect.Uint && kind != reflect.Uintptr
+}
+
+func baseTypeFrom(kind reflect.Kind, tag *fieldTag) Ruler {
+
+	if !isSizedKind(kind) { // uint and uintptr are matched as uint64
+		kind = reflect.Uint64
+	}
+	if kind != reflect.Int8 && kind != reflect.Uint8 {
+		if tag.be {
+			return Endian(bigEndian, BaseType(kind))
+		} else if tag.le {
+			return BaseTypeLE(kind)
+		}
+	}
+	return BaseType(kind)
+}
+
+func bigEndian(ctx *Context) binary.ByteOrder {
+
+	return binary.BigEndian
+}
+
 // -----------------------------------------------------------------------------
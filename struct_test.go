@@ -169,3 +169,194 @@ func TestSeq2(t *testing.T) {
 		t.Fatal("ret:", string(ret))
 	}
 }
+
+func TestAlt(t *testing.T) {
+
+	isOne := func(ctx *bpl.Context) bool {
+		v, _ := ctx.Var("a")
+		return v == uint8(1)
+	}
+	r1 := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "a", Type: bpl.Uint8},
+		bpl.Assert(isOne, "a == 1"),
+	})
+	r2 := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "b", Type: bpl.Uint16},
+	})
+	r := bpl.Alt(r1, r2)
+
+	for _, c := range []struct {
+		in  []byte
+		ret string
+	}{
+		{[]byte{1, 3}, `{"a":1}`},
+		{[]byte{2, 3}, `{"b":770}`},
+	} {
+		in := bufiox.NewReaderBuffer(c.in)
+		ret, err := r.Match(in, bpl.NewContext())
+		if err != nil {
+			t.Fatal("Alt.Match failed:", err)
+		}
+		text, err := json.Marshal(ret)
+		if err != nil {
+			t.Fatal("json.Marshal failed:", err)
+		}
+		if string(text) != c.ret {
+			t.Fatal("json.Marshal result:", string(text))
+		}
+		if c.ret == `{"a":1}` && in.Buffered() != 1 {
+			t.Fatal("Alt.Match: unexpected input position -", in.Buffered())
+		}
+	}
+
+	b := []byte{0, 2, 3}
+	in := bufiox.NewReaderBuffer(b)
+	in.ReadByte()
+	_, err := r.Match(in, bpl.NewContext())
+	if err != nil || b[0] != 0 {
+		t.Fatal("Alt.Match: input buffer is modified -", b, err)
+	}
+	// globals set by a failed alternative are undone, even if they are set by
+	// a nested alternative which succeeded
+	set := func(name string, v interface{}) bpl.Ruler {
+		return bpl.Do(func(ctx *bpl.Context) error {
+			ctx.Globals.SetVar(name, v)
+			return nil
+		})
+	}
+	fail := bpl.Assert(func(ctx *bpl.Context) bool { return false }, "fail")
+	r = bpl.Alt(
+		bpl.And(set("x", 1), bpl.Alt(bpl.And(set("y", 2), fail), set("y", 3)), set("x", 4), fail),
+		set("z", 5),
+	)
+	ctx := bpl.NewContext()
+	ctx.Globals.SetVar("x", 0)
+	if _, err = r.Match(bufiox.NewReaderBuffer(nil), ctx); err != nil {
+		t.Fatal("Alt.Match failed:", err)
+	}
+	if text, _ := json.Marshal(ctx.Globals.Impl); string(text) != `{"x":0,"z":5}` {
+		t.Fatal("Globals:", string(text))
+	}
+}
+
+type version uint16
+
+func (version) BplRuler() bpl.Ruler {
+	return bpl.Uintbe(2)
+}
+
+type counter struct {
+	size int
+}
+
+func (p *counter) BplRuler() bpl.Ruler {
+	if p.size == 0 {
+		return bpl.Uint8
+	}
+	return bpl.Uintbe(p.size)
+}
+
+type wireType struct {
+	Magic uint32 `bpl:",be"`
+	Count uint16
+	_     [2]byte
+	Name  string   `bpl:",size=4"`
+	Items []int16  `bpl:"items,len=Count"`
+	Vals  []uint16 `bpl:",be,len=count"`
+	Blob  []byte   `bpl:",len=Count"`
+	Ver   version  `bpl:"version"`
+	Skip  int      `bpl:"-"`
+	Tail  []byte
+}
+
+func TestTypeFrom(t *testing.T) {
+
+	r, err := bpl.TypeFrom(reflect.TypeOf(wireType{}))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	b := []byte{
+		1, 2, 3, 4, 2, 0, 9, 9, 'a', 'b', 'c', 'd',
+		0xff, 0xff, 5, 0, 0, 7, 1, 0, 'x', 'y', 0, 3, 'z',
+	}
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"magic":16909060,"count":2,"name":"abcd","items":[-1,5],"vals":[7,256],"blob":"eHk=","version":3,"tail":"eg=="}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	var w wireType
+	if err = bpl.Unmarshal(v, &w); err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	if w.Magic != 0x01020304 || w.Name != "abcd" || w.Items[0] != -1 || w.Vals[1] != 256 || w.Ver != 3 || string(w.Tail) != "z" {
+		t.Fatal("Unmarshal:", w)
+	}
+
+	r, err = bpl.TypeFrom(reflect.TypeOf(struct {
+		A int16   `bpl:",be"`
+		B float32 `bpl:",be"`
+		C uint16  `bpl:",be"`
+	}{}))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	ctx = bpl.NewContext()
+	v, err = r.Match(ctx.NewReaderBuffer([]byte{0xff, 0xfe, 0x3f, 0x80, 0, 0, 1, 2}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if ret, _ = json.Marshal(v); string(ret) != `{"a":-2,"b":1,"c":258}` {
+		t.Fatal("ret:", string(ret))
+	}
+	if c, _ := v.(*bpl.Map).Get("c"); reflect.TypeOf(c) != reflect.TypeOf(uint16(0)) {
+		t.Fatal("type of be field:", reflect.TypeOf(c))
+	}
+
+	type sizeless struct {
+		A uint
+		B uintptr `bpl:",be"`
+		C []uint  `bpl:",len=A"`
+	}
+	r, err = bpl.TypeFrom(reflect.TypeOf(sizeless{}))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	ctx = bpl.NewContext()
+	v, err = r.Match(ctx.NewReaderBuffer([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var s sizeless
+	if err = bpl.Unmarshal(v, &s); err != nil || s.A != 1 || s.B != 2 || len(s.C) != 1 || s.C[0] != 3 {
+		t.Fatal("Unmarshal:", s, err)
+	}
+
+	r, err = bpl.TypeFrom(reflect.TypeOf(struct {
+		N *counter
+	}{}))
+	if err != nil {
+		t.Fatal("bpl.TypeFrom failed:", err)
+	}
+	ctx = bpl.NewContext()
+	if v, err = r.Match(ctx.NewReaderBuffer([]byte{7}), ctx); err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if ret, _ = json.Marshal(v); string(ret) != `{"n":7}` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	_, err = bpl.TypeFrom(reflect.TypeOf(struct {
+		A int `bpl:",bad"`
+	}{}))
+	if err == nil {
+		t.Fatal("TypeFrom: no error")
+	}
+}
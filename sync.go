@@ -0,0 +1,153 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+
+	"github.com/qiniu/x/bufiox"
+	"github.com/qiniu/x/log"
+)
+
+// -----------------------------------------------------------------------------
+
+// A SyncFunc reports whether the input stream `in` is at a synchronization
+// point. It must not consume `in`.
+//
+type SyncFunc func(in *bufio.Reader, ctx *Context) (bool, error)
+
+// peekFull returns the next n bytes of `in` without consuming them, reading
+// more data if necessary. It returns io.EOF if `in` ends before n bytes, and
+// bufio.ErrBufferFull if n is larger than the buffer of `in`. A memory buffer
+// (see bufiox.NewReaderBuffer) isn't filled, because filling moves its data.
+//
+func peekFull(in *bufio.Reader, n int) (b []byte, err error) {
+
+	if n > in.Buffered() && bufiox.IsReaderBuffer(in) {
+		return nil, io.EOF
+	}
+	return in.Peek(n)
+}
+
+// SyncPattern returns a SyncFunc that reports whether `pattern` occurs at the
+// current position. If period > 0, pattern must also occur `period` bytes later
+// (unless the input stream ends before), eg. SyncPattern([]byte{0x47}, 188) for
+// MPEG-TS packets.
+//
+func SyncPattern(pattern []byte, period int) SyncFunc {
+
+	n := len(pattern)
+	return func(in *bufio.Reader, ctx *Context) (bool, error) {
+		b, err := peekFull(in, n)
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		if !bytes.Equal(b, pattern) {
+			return false, nil
+		}
+		if period > 0 {
+			b, err = peekFull(in, period+n)
+			if err != nil {
+				if err == io.EOF { // input stream ends before
+					return true, nil
+				}
+				return false, err
+			}
+			if !bytes.Equal(b[period:], pattern) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+type syncType struct {
+	sync SyncFunc
+	r    Ruler
+}
+
+func (p *syncType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	start := ctx.Tell()
+	v, err = doMatch(p.r, in, ctx)
+	if err == nil {
+		return
+	}
+	switch causeOf(err).(type) {
+	case *LimitError:
+		return
+	}
+	if e := ctx.checkDone(); e != nil {
+		return nil, e
+	}
+
+	log.Debug("sync:", err)
+	rec := NewMap()
+	rec.Set("_error", err.Error())
+	if start >= 0 {
+		rec.Set("_offset", start)
+	}
+
+	skipped := 0
+	if start < 0 || ctx.Tell() == start { // make progress
+		if _, e := in.Discard(1); e != nil {
+			rec.Set("_skipped", skipped)
+			return rec, nil
+		}
+		skipped++
+	}
+	for {
+		if _, e := in.Peek(1); e != nil { // EOF
+			break
+		}
+		ok, e := p.sync(in, ctx)
+		if e != nil {
+			return nil, e
+		}
+		if ok {
+			break
+		}
+		in.Discard(1)
+		skipped++
+		if skipped&0xfff == 0 {
+			if e := ctx.checkDone(); e != nil {
+				return nil, e
+			}
+		}
+	}
+	rec.Set("_skipped", skipped)
+	return rec, nil
+}
+
+func (p *syncType) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return Encode(p.r, w, dom, ctx)
+}
+
+func (p *syncType) RetType() reflect.Type {
+
+	return TyInterface
+}
+
+func (p *syncType) SizeOf() int {
+
+	return -1
+}
+
+// Sync returns a matching unit that matches R. If R fails, the error is recorded
+// in the matching result as `{_error: <message>, _offset: <start>, _skipped: <n>}`,
+// and the input stream is skipped forward to the next synchronization point
+// reported by sync (or EOF), so that the enclosing repetition can resume there.
+// Errors of Limits aren't recovered.
+//
+func Sync(sync SyncFunc, R Ruler) Ruler {
+
+	return &syncType{sync: sync, r: R}
+}
+
+// -----------------------------------------------------------------------------
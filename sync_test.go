@@ -0,0 +1,96 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/goplus/bpl"
+)
+
+func TestSync(t *testing.T) {
+
+	packet := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "sync", Type: bpl.Uint8},
+		&bpl.Member{Name: "n", Type: bpl.Uint8},
+		&bpl.Member{Name: "data", Type: bpl.Dynarray(bpl.Uint8, func(ctx *bpl.Context) int {
+			v, _ := ctx.Parent.Var("n")
+			return int(v.(uint8))
+		})},
+	})
+	r := bpl.Array0(bpl.Sync(bpl.SyncPattern([]byte{0xff}, 0), packet))
+
+	// the second packet claims 9 bytes of data, which runs out of input.
+	b := []byte{0xff, 1, 'a', 0xff, 9, 'b', 0xff, 2, 'c', 'd', 0xff, 5}
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	pkts := v.([]interface{})
+	if len(pkts) != 2 {
+		t.Fatal("packets:", pkts)
+	}
+	if data := pkts[0].(*bpl.Map).Vals()["data"].([]byte); string(data) != "a" {
+		t.Fatal("packets[0]:", pkts[0])
+	}
+	bad := pkts[1].(*bpl.Map).Vals()
+	if bad["_offset"] != int64(3) || bad["_skipped"] != 0 || bad["_error"] == nil {
+		t.Fatal("packets[1]:", bad)
+	}
+
+	ctx = bpl.NewContext()
+	ctx.SetLimits(bpl.Limits{MaxAlloc: 4})
+	_, err = r.Match(ctx.NewReaderBuffer(b), ctx)
+	checkLimitError(t, err, "MaxAlloc")
+}
+
+func TestSyncPattern(t *testing.T) {
+
+	sync := bpl.SyncPattern([]byte{0x47}, 4)
+	cases := []struct {
+		b  []byte
+		ok bool
+	}{
+		{[]byte{0x47, 1, 2, 3, 0x47}, true},
+		{[]byte{0x47, 1, 2, 3, 0x48}, false},
+		{[]byte{0x47, 1, 2}, true},
+		{[]byte{0x48}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		ctx := bpl.NewContext()
+		if ok, err := sync(ctx.NewReaderBuffer(c.b), ctx); err != nil || ok != c.ok {
+			t.Fatal("SyncPattern:", c.b, ok, err)
+		}
+	}
+
+	ctx := bpl.NewContext()
+	in := bufio.NewReaderSize(bytes.NewReader(make([]byte, 64)), 16)
+	if _, err := bpl.SyncPattern([]byte{0}, 32)(in, ctx); err != bufio.ErrBufferFull {
+		t.Fatal("SyncPattern:", err)
+	}
+}
+
+func TestSyncShortRead(t *testing.T) {
+
+	fail := bpl.Do(func(ctx *bpl.Context) error {
+		return errors.New("fail")
+	})
+	r := bpl.Sync(bpl.SyncPattern([]byte("AB"), 0), fail)
+	ctx := bpl.NewContext()
+	in := ctx.NewReader(iotest.OneByteReader(strings.NewReader("xyzABzz")))
+	v, err := r.Match(in, ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if skipped := v.(*bpl.Map).Vals()["_skipped"]; skipped != 3 {
+		t.Fatal("_skipped:", skipped)
+	}
+	if b, _ := in.Peek(2); string(b) != "AB" {
+		t.Fatal("Peek:", string(b))
+	}
+}
@@ -0,0 +1,292 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// -----------------------------------------------------------------------------
+
+// A TextEncoding is an encoding of strings.
+//
+type TextEncoding struct {
+	Name string
+	Enc  encoding.Encoding // nil means UTF-8 (no transcoding)
+	Unit int               // size of a code unit (and of NUL): 2 for UTF-16, 1 for others
+}
+
+// TextEncodings holds all text encodings known by name. `utf16` is UTF-16 with
+// an optional byte order mark (big endian if there isn't one).
+//
+var TextEncodings = map[string]*TextEncoding{
+	"utf8":     {Name: "utf8", Unit: 1},
+	"latin1":   {Name: "latin1", Enc: charmap.ISO8859_1, Unit: 1},
+	"utf16":    {Name: "utf16", Enc: unicode.UTF16(unicode.BigEndian, unicode.UseBOM), Unit: 2},
+	"utf16le":  {Name: "utf16le", Enc: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), Unit: 2},
+	"utf16be":  {Name: "utf16be", Enc: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), Unit: 2},
+	"gbk":      {Name: "gbk", Enc: simplifiedchinese.GBK, Unit: 1},
+	"gb18030":  {Name: "gb18030", Enc: simplifiedchinese.GB18030, Unit: 1},
+	"shiftjis": {Name: "shiftjis", Enc: japanese.ShiftJIS, Unit: 1},
+}
+
+func (p *TextEncoding) unit() int {
+
+	if p == nil {
+		return 1
+	}
+	return p.Unit
+}
+
+func (p *TextEncoding) name() string {
+
+	if p == nil {
+		return "utf8"
+	}
+	return p.Name
+}
+
+func (p *TextEncoding) decode(b []byte) (string, error) {
+
+	if p == nil || p.Enc == nil {
+		return string(b), nil
+	}
+	ret, err := p.Enc.NewDecoder().Bytes(b)
+	return string(ret), err
+}
+
+func (p *TextEncoding) encode(s string) ([]byte, error) {
+
+	if p == nil || p.Enc == nil {
+		return []byte(s), nil
+	}
+	return p.Enc.NewEncoder().Bytes([]byte(s))
+}
+
+// trimNul returns b before its first NUL code unit.
+//
+func trimNul(b []byte, unit int) []byte {
+
+	for i := 0; i+unit <= len(b); i += unit {
+		if isNul(b[i : i+unit]) {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+func isNul(b []byte) bool {
+
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// -----------------------------------------------------------------------------
+
+// A Text is a matching unit of a NUL-terminated string in encoding Enc (nil
+// means UTF-8). Its matching result is the string in UTF-8.
+//
+type Text struct {
+	Enc *TextEncoding
+}
+
+// Match is required by a matching unit. see Ruler interface.
+//
+func (p *Text) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	unit := p.Enc.unit()
+	var b []byte
+	var c [2]byte
+	for {
+		if _, err = io.ReadFull(in, c[:unit]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if isNul(c[:unit]) {
+			break
+		}
+		b = append(b, c[:unit]...)
+	}
+	return p.Enc.decode(b)
+}
+
+// Encode is the counterpart of Match. see Encoder interface.
+//
+func (p *Text) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	b, err := encodeText(p, p.Enc, dom)
+	if err != nil {
+		return err
+	}
+	w.Write(b)
+	w.Write(make([]byte, p.Enc.unit()))
+	return nil
+}
+
+// RetType returns matching result type.
+//
+func (p *Text) RetType() reflect.Type {
+
+	return tyString
+}
+
+// SizeOf returns expected length of result.
+//
+func (p *Text) SizeOf() int {
+
+	return -1
+}
+
+func encodeText(r Ruler, enc *TextEncoding, dom interface{}) ([]byte, error) {
+
+	s, ok := dom.(string)
+	if !ok {
+		return nil, &EncodeError{R: r, Dom: dom, Msg: "value isn't a string"}
+	}
+	b, err := enc.encode(s)
+	if err != nil {
+		return nil, &EncodeError{R: r, Dom: dom, Msg: "can't be encoded in " + enc.name()}
+	}
+	return b, nil
+}
+
+// -----------------------------------------------------------------------------
+
+func readText(in *bufio.Reader, n int, ctx *Context) (b []byte, err error) {
+
+	if err = ctx.alloc(n); err != nil {
+		return
+	}
+	b = make([]byte, n)
+	_, err = io.ReadFull(in, b)
+	return
+}
+
+type textArray struct {
+	enc  *TextEncoding
+	n    func(ctx *Context) int
+	size int // size if n is a constant, -1 otherwise
+}
+
+func (p *textArray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	b, err := readText(in, p.n(ctx), ctx)
+	if err != nil {
+		return
+	}
+	return p.enc.decode(trimNul(b, p.enc.unit()))
+}
+
+func (p *textArray) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	b, err := encodeText(p, p.enc, dom)
+	if err != nil {
+		return err
+	}
+	n := p.n(ctx)
+	if len(b) > n {
+		return &EncodeError{R: p, Dom: dom, Msg: fmt.Sprintf("len(value) > %d", n)}
+	}
+	w.Write(b)
+	w.Write(make([]byte, n-len(b)))
+	return nil
+}
+
+func (p *textArray) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p *textArray) SizeOf() int {
+
+	return p.size
+}
+
+// TextArray returns a matching unit that matches a string of n bytes in
+// encoding `enc` (nil means UTF-8). The string is padded with NULs, which are
+// trimmed from matching result.
+//
+func TextArray(enc *TextEncoding, n int) Ruler {
+
+	return &textArray{enc: enc, n: func(ctx *Context) int { return n }, size: n}
+}
+
+// TextDynarray returns a matching unit that matches a string of n(ctx) bytes
+// in encoding `enc`, padded with NULs. see TextArray.
+//
+func TextDynarray(enc *TextEncoding, n func(ctx *Context) int) Ruler {
+
+	return &textArray{enc: enc, n: n, size: -1}
+}
+
+// -----------------------------------------------------------------------------
+
+type pstring struct {
+	n   Ruler
+	enc *TextEncoding
+}
+
+func (p *pstring) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	v, err = p.n.Match(in, ctx)
+	if err != nil {
+		return
+	}
+	n, ok := toInt64(v)
+	if !ok {
+		return nil, fmt.Errorf("pstring: length isn't an integer - %v", v)
+	}
+	b, err := readText(in, int(n), ctx)
+	if err != nil {
+		return
+	}
+	return p.enc.decode(b)
+}
+
+func (p *pstring) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	b, err := encodeText(p, p.enc, dom)
+	if err != nil {
+		return err
+	}
+	if err = Encode(p.n, w, len(b), ctx); err != nil {
+		return err
+	}
+	w.Write(b)
+	return nil
+}
+
+func (p *pstring) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p *pstring) SizeOf() int {
+
+	return -1
+}
+
+// PString returns a matching unit that matches a length-prefixed (Pascal)
+// string: its length in bytes, matched by R, and then its bytes in encoding
+// `enc` (nil means UTF-8).
+//
+func PString(r Ruler, enc *TextEncoding) Ruler {
+
+	return &pstring{n: r, enc: enc}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,53 @@
+package bpl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func TestText(t *testing.T) {
+
+	b := []byte{
+		'a', 0, 'b', 0, 0, 0,
+		0xd6, 0xd0, 0,
+		'x', 'y', 0, 0,
+		2, 'o', 'k',
+	}
+	r := bpl.Seq(
+		&bpl.Text{Enc: bpl.TextEncodings["utf16le"]},
+		&bpl.Text{Enc: bpl.TextEncodings["gbk"]},
+		bpl.TextArray(nil, 4),
+		bpl.PString(bpl.Uint8, bpl.TextEncodings["latin1"]),
+	)
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `["ab","中","xy","ok"]` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	var w bytes.Buffer
+	if err = bpl.Encode(r, &w, v, ctx); err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	if !bytes.Equal(w.Bytes(), b) {
+		t.Fatal("Encode:", w.Bytes())
+	}
+
+	w.Reset()
+	if err = bpl.Encode(bpl.TextArray(nil, 2), &w, "abc", ctx); err == nil {
+		t.Fatal("Encode: no error")
+	}
+	if err = bpl.Encode(&bpl.Text{Enc: bpl.TextEncodings["latin1"]}, &w, "中", ctx); err == nil {
+		t.Fatal("Encode: no error")
+	}
+}
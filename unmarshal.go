@@ -0,0 +1,262 @@
+package bpl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// An UnmarshalError is returned when a node of matching result can't be
+// stored in a Go value.
+//
+type UnmarshalError struct {
+	Path  string       // path of the node, eg. hdr.items[3].len
+	Value interface{}  // the node
+	Type  reflect.Type // type of the Go value
+	Msg   string
+}
+
+func (p *UnmarshalError) Error() string {
+
+	msg := p.Msg
+	if msg == "" {
+		msg = fmt.Sprintf("cannot unmarshal %T into Go value of type %v", p.Value, p.Type)
+	}
+	if p.Path != "" {
+		return "bpl.Unmarshal " + p.Path + ": " + msg
+	}
+	return "bpl.Unmarshal: " + msg
+}
+
+// ErrUnmarshalNonPointer is returned when the Go value to unmarshal into isn't
+// a non-nil pointer.
+//
+var ErrUnmarshalNonPointer = errors.New("bpl.Unmarshal: non-pointer or nil value")
+
+// Unmarshal stores `dom`, a matching result, in the Go value pointed to by v.
+//
+// A struct result is stored in a Go struct: each member is stored in the field
+// whose `bpl:"name"` tag is the member name (or, without a tag, whose name
+// equals the member name case-insensitively). Fields tagged `bpl:"-"` and
+// members without a field are ignored. A struct result can also be stored in a
+// map with string keys.
+//
+// Integers are converted to any integer or floating-point type they fit in,
+// arrays and repetitions are stored in slices or arrays, `[n]byte` and strings
+// are interchangeable, and any node can be stored in an interface{}. A node is
+// left untouched if it is nil. An EnumValue is stored as its base value unless
+// v is an EnumValue.
+//
+func Unmarshal(dom interface{}, v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrUnmarshalNonPointer
+	}
+	return unmarshal(dom, rv.Elem(), "")
+}
+
+func unmarshal(dom interface{}, v reflect.Value, path string) error {
+
+	if dom == nil {
+		return nil
+	}
+	t := v.Type()
+	if dv := reflect.ValueOf(dom); dv.Type().AssignableTo(t) {
+		v.Set(dv)
+		return nil
+	}
+	if e, ok := dom.(EnumValue); ok {
+		return unmarshal(e.Val, v, path)
+	}
+	switch kind := t.Kind(); kind {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return unmarshal(dom, v.Elem(), path)
+	case reflect.Struct:
+		if vars, ok := varsOf(dom); ok {
+			return unmarshalStruct(vars, v, path)
+		}
+	case reflect.Map:
+		if vars, ok := varsOf(dom); ok && t.Key().Kind() == reflect.String {
+			return unmarshalMap(vars, v, path)
+		}
+	case reflect.Slice, reflect.Array:
+		return unmarshalSlice(dom, v, path)
+	case reflect.String:
+		switch val := dom.(type) {
+		case string:
+			v.SetString(val)
+			return nil
+		case []byte:
+			v.SetString(string(val))
+			return nil
+		}
+	case reflect.Bool:
+		if val, ok := dom.(bool); ok {
+			v.SetBool(val)
+			return nil
+		}
+	default:
+		if isNumber(kind) {
+			return unmarshalNumber(dom, v, path)
+		}
+	}
+	return &UnmarshalError{Path: path, Value: dom, Type: t}
+}
+
+func varsOf(dom interface{}) (vars *Map, ok bool) {
+
+	switch val := dom.(type) {
+	case *Map:
+		return val, true
+	case map[string]interface{}:
+		return &Map{vals: val}, true
+	}
+	return
+}
+
+func unmarshalStruct(vars *Map, v reflect.Value, path string) error {
+
+	t := v.Type()
+	for i, n := 0, t.NumField(); i < n; i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		name := strings.SplitN(field.Tag.Get("bpl"), ",", 2)[0] // options are for TypeFrom
+		if name == "-" || name == "_" || field.Name == "_" {
+			continue
+		}
+		var val interface{}
+		var ok bool
+		if name != "" {
+			val, ok = vars.Get(name)
+		} else {
+			name = field.Name
+			for _, key := range vars.Keys() {
+				if strings.EqualFold(key, name) {
+					name, val, ok = key, vars.vals[key], true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := unmarshal(val, v.Field(i), joinPath(path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalMap(vars *Map, v reflect.Value, path string) error {
+
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, vars.Len()))
+	}
+	for _, key := range vars.Keys() {
+		elem := reflect.New(t.Elem()).Elem()
+		if err := unmarshal(vars.vals[key], elem, joinPath(path, key)); err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), elem)
+	}
+	return nil
+}
+
+func unmarshalSlice(dom interface{}, v reflect.Value, path string) error {
+
+	t := v.Type()
+	if s, ok := dom.(string); ok && t.Elem().Kind() == reflect.Uint8 { // [n]char => []byte
+		dom = []byte(s)
+	}
+	dv := reflect.ValueOf(dom)
+	if k := dv.Kind(); k != reflect.Slice && k != reflect.Array {
+		return &UnmarshalError{Path: path, Value: dom, Type: t}
+	}
+	n := dv.Len()
+	if t.Kind() == reflect.Array {
+		if n != t.Len() {
+			return &UnmarshalError{Path: path, Value: dom, Type: t, Msg: fmt.Sprintf("len(value) = %d, but len(%v) = %d", n, t, t.Len())}
+		}
+	} else {
+		v.Set(reflect.MakeSlice(t, n, n))
+	}
+	for i := 0; i < n; i++ {
+		if err := unmarshal(dv.Index(i).Interface(), v.Index(i), path+indexOf(i).name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNumber(kind reflect.Kind) bool {
+
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+func unmarshalNumber(dom interface{}, v reflect.Value, path string) error {
+
+	dv := reflect.ValueOf(dom)
+	var overflow bool
+	switch kind := dv.Kind(); {
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		val := dv.Int()
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(val))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if overflow = val < 0 || v.OverflowUint(uint64(val)); !overflow {
+				v.SetUint(uint64(val))
+			}
+		default:
+			if overflow = v.OverflowInt(val); !overflow {
+				v.SetInt(val)
+			}
+		}
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		val := dv.Uint()
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(val))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if overflow = v.OverflowUint(val); !overflow {
+				v.SetUint(val)
+			}
+		default:
+			if overflow = val > math.MaxInt64 || v.OverflowInt(int64(val)); !overflow {
+				v.SetInt(int64(val))
+			}
+		}
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		if k := v.Kind(); k != reflect.Float32 && k != reflect.Float64 {
+			return &UnmarshalError{Path: path, Value: dom, Type: v.Type()}
+		}
+		v.SetFloat(dv.Float())
+	default:
+		return &UnmarshalError{Path: path, Value: dom, Type: v.Type()}
+	}
+	if overflow {
+		return &UnmarshalError{Path: path, Value: dom, Type: v.Type(), Msg: fmt.Sprintf("value %v overflows %v", dom, v.Type())}
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// -----------------------------------------------------------------------------
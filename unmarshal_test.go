@@ -0,0 +1,77 @@
+package bpl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+type header struct {
+	Len   int    `bpl:"len"`
+	Kind  uint8  `bpl:"type"`
+	Flags uint64 // matched case-insensitively
+	Skip  int    `bpl:"-"`
+}
+
+type message struct {
+	Hdr   *header `bpl:"hdr"`
+	Items []int16 `bpl:"items"`
+	Name  string  `bpl:"name"`
+	Tag   [2]byte `bpl:"tag"`
+	Rest  interface{}
+	Extra map[string]uint32 `bpl:"extra"`
+}
+
+func TestUnmarshal(t *testing.T) {
+
+	hdr := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "len", Type: bpl.Uint32},
+		&bpl.Member{Name: "type", Type: bpl.Uint8},
+		&bpl.Member{Name: "flags", Type: bpl.Uint8},
+	})
+	r := bpl.Struct([]bpl.Ruler{
+		&bpl.Member{Name: "hdr", Type: hdr},
+		&bpl.Member{Name: "items", Type: bpl.Dynarray(bpl.Uint8, lenOf(2))},
+		&bpl.Member{Name: "name", Type: bpl.Dynarray(bpl.Uint8, lenOf(3))},
+		&bpl.Member{Name: "tag", Type: bpl.Dynarray(bpl.Char, lenOf(2))},
+		&bpl.Member{Name: "rest", Type: bpl.Uint16},
+		&bpl.Member{Name: "extra", Type: bpl.Struct([]bpl.Ruler{
+			&bpl.Member{Name: "a", Type: bpl.Uint8},
+		})},
+	})
+	b := []byte{5, 0, 0, 0, 1, 2, 3, 4, 'b', 'p', 'l', 'o', 'k', 6, 0, 7}
+
+	ctx := bpl.NewContext()
+	dom, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var msg message
+	if err = bpl.Unmarshal(dom, &msg); err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	if *msg.Hdr != (header{Len: 5, Kind: 1, Flags: 2}) || len(msg.Items) != 2 || msg.Items[0] != 3 || msg.Items[1] != 4 ||
+		msg.Name != "bpl" || msg.Tag != [2]byte{'o', 'k'} || msg.Rest != uint16(6) || msg.Extra["a"] != 7 {
+		t.Fatal("Unmarshal:", msg, *msg.Hdr)
+	}
+
+	var e *bpl.UnmarshalError
+	var bad struct {
+		Hdr struct {
+			Len int8 `bpl:"type"`
+			Typ bool `bpl:"len"`
+		}
+	}
+	err = bpl.Unmarshal(map[string]interface{}{"hdr": map[string]interface{}{"type": 200}}, &bad)
+	if !errors.As(err, &e) || e.Path != "hdr.type" || err.Error() != "bpl.Unmarshal hdr.type: value 200 overflows int8" {
+		t.Fatal("Unmarshal:", err)
+	}
+	err = bpl.Unmarshal(dom, &bad)
+	if !errors.As(err, &e) || e.Path != "hdr.len" {
+		t.Fatal("Unmarshal:", err)
+	}
+	if err = bpl.Unmarshal(dom, bad); err != bpl.ErrUnmarshalNonPointer {
+		t.Fatal("Unmarshal:", err)
+	}
+}
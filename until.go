@@ -0,0 +1,206 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+)
+
+var errTerminator = errors.New("terminator")
+
+// -----------------------------------------------------------------------------
+
+type until struct {
+	r    Ruler
+	cond func(ctx *Context, v interface{}) bool
+	incl bool
+}
+
+func (p *until) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	t := p.r.RetType()
+	ret := reflect.MakeSlice(reflect.SliceOf(t), 0, 4)
+	for {
+		_, err = in.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				if !p.incl {
+					return ret.Interface(), nil
+				}
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, partialSlice(err, ret)
+		}
+		if err = ctx.repeated(ret.Len() + 1); err != nil {
+			return nil, partialSlice(err, ret)
+		}
+		sub := ctx.newElem(ret.Len())
+		if p.incl {
+			v, err = p.r.Match(in, sub)
+		} else {
+			v, err = tryMatch(&whileElem{p}, in, sub)
+		}
+		sub.endSpan()
+		if err != nil {
+			if err == errTerminator {
+				ctx.dropElemSpan()
+				return ret.Interface(), nil
+			}
+			err = matchError(err, indexOf(ret.Len()), in, ctx)
+			return nil, partialSlice(err, ret)
+		}
+		ret = reflect.Append(ret, valueOf(v, t))
+		if p.incl && p.cond(sub, v) {
+			return ret.Interface(), nil
+		}
+	}
+}
+
+func (p *until) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	return encodeArrayN(p, p.r, -1, w, dom, ctx)
+}
+
+func (p *until) RetType() reflect.Type {
+
+	return reflect.SliceOf(p.r.RetType())
+}
+
+func (p *until) SizeOf() int {
+
+	return -1
+}
+
+// whileElem matches an element of `R while <cond>`, and fails with
+// errTerminator if the element doesn't satisfy <cond>.
+//
+type whileElem struct {
+	p *until
+}
+
+func (p *whileElem) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	v, err = p.p.r.Match(in, ctx)
+	if err == nil && p.p.cond(ctx, v) {
+		err = errTerminator
+	}
+	return
+}
+
+func (p *whileElem) RetType() reflect.Type {
+
+	return p.p.r.RetType()
+}
+
+func (p *whileElem) SizeOf() int {
+
+	return p.p.r.SizeOf()
+}
+
+func (p *Context) dropElemSpan() {
+
+	if span := p.span; span != nil && len(span.Elems) > 0 {
+		span.Elems = span.Elems[:len(span.Elems)-1]
+	}
+}
+
+// Until returns a matching unit that matches R repeatedly until an element
+// `v` is a terminator, that is, cond(elemCtx, v) returns true. Its matching
+// result is a slice of the elements.
+//
+// If inclusive is true, the terminator is consumed and is the last element of
+// matching result, and it's an error if the input ends before the terminator.
+// Otherwise, the terminator is matched by lookahead, so it isn't consumed and
+// isn't a part of matching result, and matching stops at the end of input too.
+// Every element is matched by lookahead then, so an element longer than the
+// buffer of input stream fails with ErrLookaheadTooLong.
+//
+func Until(R Ruler, cond func(ctx *Context, v interface{}) bool, inclusive bool) Ruler {
+
+	return &until{r: R, cond: cond, incl: inclusive}
+}
+
+// -----------------------------------------------------------------------------
+
+type untilPattern struct {
+	r       Ruler
+	pattern func(ctx *Context) []byte
+	incl    bool
+}
+
+func (p *untilPattern) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	ctx.AlignBits()
+	pattern := p.pattern(ctx)
+	if len(pattern) == 0 {
+		return nil, errors.New("until: empty terminator pattern")
+	}
+	t := p.r.RetType()
+	ret := reflect.MakeSlice(reflect.SliceOf(t), 0, 4)
+	for {
+		b, err := in.Peek(len(pattern))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, partialSlice(err, ret)
+		}
+		if bytes.Equal(b, pattern) {
+			if p.incl {
+				in.Discard(len(pattern))
+			}
+			return ret.Interface(), nil
+		}
+		if err = ctx.repeated(ret.Len() + 1); err != nil {
+			return nil, partialSlice(err, ret)
+		}
+		sub := ctx.newElem(ret.Len())
+		v, err = p.r.Match(in, sub)
+		sub.endSpan()
+		if err != nil {
+			err = matchError(err, indexOf(ret.Len()), in, ctx)
+			return nil, partialSlice(err, ret)
+		}
+		ret = reflect.Append(ret, valueOf(v, t))
+	}
+}
+
+func (p *untilPattern) Encode(w *bytes.Buffer, dom interface{}, ctx *Context) error {
+
+	ctx.AlignBits()
+	if err := encodeArrayN(p, p.r, -1, w, dom, ctx); err != nil {
+		return err
+	}
+	if p.incl {
+		w.Write(p.pattern(ctx))
+	}
+	return nil
+}
+
+func (p *untilPattern) RetType() reflect.Type {
+
+	return reflect.SliceOf(p.r.RetType())
+}
+
+func (p *untilPattern) SizeOf() int {
+
+	return -1
+}
+
+// UntilPattern returns a matching unit that matches R repeatedly until the next
+// bytes of input equal to pattern(ctx). Its matching result is a slice of the
+// elements, and it's an error if the input ends before the pattern, even if it
+// isn't inclusive (unlike `Until`, the pattern is a required terminator).
+//
+// If inclusive is true, the pattern is consumed (but it isn't a part of matching
+// result). Otherwise, it's left in the input.
+//
+func UntilPattern(R Ruler, pattern func(ctx *Context) []byte, inclusive bool) Ruler {
+
+	return &untilPattern{r: R, pattern: pattern, incl: inclusive}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,90 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/goplus/bpl"
+)
+
+func isZero(ctx *bpl.Context, v interface{}) bool {
+
+	return v.(uint8) == 0
+}
+
+func TestUntil(t *testing.T) {
+
+	zero := func(ctx *bpl.Context) []byte {
+		return []byte{0, 0}
+	}
+	b := []byte{1, 2, 0, 3, 0, 4, 5, 6, 0, 0, 7, 0, 0}
+	r := bpl.Seq(
+		bpl.Until(bpl.Uint8, isZero, true),
+		bpl.Until(bpl.Uint8, isZero, false),
+		bpl.Uint8,
+		bpl.UntilPattern(bpl.Uint8, zero, true),
+		bpl.UntilPattern(bpl.Uint8, zero, false),
+		bpl.Uint16,
+	)
+	ctx := bpl.NewContext()
+	v, err := r.Match(ctx.NewReaderBuffer(b), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `["AQIA","Aw==",0,"BAUG","Bw==",0]` {
+		t.Fatal("ret:", string(ret))
+	}
+
+	var w bytes.Buffer
+	if err = bpl.Encode(r, &w, v, ctx); err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	if !bytes.Equal(w.Bytes(), b) {
+		t.Fatal("Encode:", w.Bytes())
+	}
+
+	for _, r := range []bpl.Ruler{bpl.Until(bpl.Uint8, isZero, true), bpl.UntilPattern(bpl.Uint8, zero, false)} {
+		ctx = bpl.NewContext()
+		if _, err = r.Match(ctx.NewReaderBuffer([]byte{1, 2, 0x80}), ctx); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal("Match:", err)
+		}
+	}
+	ctx = bpl.NewContext()
+	v, err = bpl.Until(bpl.Uint8, isZero, false).Match(ctx.NewReaderBuffer([]byte{1, 2}), ctx)
+	if err != nil || !bytes.Equal(v.([]byte), []byte{1, 2}) {
+		t.Fatal("Match:", v, err)
+	}
+}
+
+func TestUntilLookahead(t *testing.T) {
+
+	never := func(ctx *bpl.Context, v interface{}) bool {
+		return false
+	}
+	elem := bpl.ByteArray(20)
+	data := make([]byte, 40)
+
+	// every element of an exclusive Until is matched by lookahead
+	in := bufio.NewReaderSize(bytes.NewReader(data), 16)
+	if _, err := bpl.Until(elem, never, false).Match(in, bpl.NewContext()); !errors.Is(err, bpl.ErrLookaheadTooLong) {
+		t.Fatal("Match:", err)
+	}
+
+	// it isn't required if the terminator is consumed
+	in = bufio.NewReaderSize(bytes.NewReader(data), 16)
+	v, err := bpl.Until(elem, never, true).Match(in, bpl.NewContext())
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("Match:", v, err)
+	}
+	if dom, ok := bpl.PartialDom(err); !ok || len(dom.([][]byte)) != 2 {
+		t.Fatal("PartialDom:", dom)
+	}
+}